@@ -0,0 +1,135 @@
+package kv
+
+import (
+	"context"
+	"encoding/binary"
+)
+
+// ErrNotCounter is returned by atomic mutations of a value that is not an
+// encoded counter
+const ErrNotCounter KvError = "value is not an 8 byte counter"
+
+// maxRetries is the number of times a conflicting transaction is retried
+// by stores without native support
+const maxRetries = 100
+
+// MutationType is an atomic operation applied to a counter, see Mutate
+type MutationType int
+
+const (
+	// MutationAdd adds the operand to the counter
+	MutationAdd MutationType = iota
+	// MutationMin keeps the smaller of the counter and the operand
+	MutationMin
+	// MutationMax keeps the larger of the counter and the operand
+	MutationMax
+	// MutationBitOr sets the counter to the bitwise or of it and the operand
+	MutationBitOr
+	// MutationBitAnd sets the counter to the bitwise and of it and the operand
+	MutationBitAnd
+)
+
+// Mutator is implemented by stores that apply mutations without read-modify-
+// write transaction conflicts, e.g. by locking the row.
+type Mutator interface {
+	Mutate(ctx context.Context, key []byte, op MutationType, operand int64) (int64, error)
+}
+
+// EncodeCounter returns the stored form of a counter, 8 bytes little-endian
+func EncodeCounter(n int64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(n))
+	return b
+}
+
+// DecodeCounter parses a value written by EncodeCounter
+func DecodeCounter(value []byte) (int64, error) {
+	if len(value) != 8 {
+		return 0, ErrNotCounter
+	}
+	return int64(binary.LittleEndian.Uint64(value)), nil
+}
+
+// Apply returns the result of applying op with operand to the counter n
+func (op MutationType) Apply(n, operand int64) int64 {
+	switch op {
+	case MutationMin:
+		if operand < n {
+			return operand
+		}
+		return n
+	case MutationMax:
+		if operand > n {
+			return operand
+		}
+		return n
+	case MutationBitOr:
+		return n | operand
+	case MutationBitAnd:
+		return n & operand
+	default:
+		return n + operand
+	}
+}
+
+// Add atomically adds delta to the counter at key and returns the new value.
+// A missing key counts as 0.
+func Add(ctx context.Context, db OrderedTransactional, key []byte, delta int64) (int64, error) {
+	return Mutate(ctx, db, key, MutationAdd, delta)
+}
+
+// Mutate atomically applies op to the counter at key and returns the new
+// value. Like in FoundationDB a missing key is set to the operand for all
+// operations. Stores implementing Mutator apply the mutation natively, others
+// in a transaction that is retried on conflicts.
+//
+// The transactional fallback is only atomic on stores that detect conflicting
+// writes, like badger and datastore. SQL stores run transactions at READ
+// COMMITTED by default and never return ErrConflict, so concurrent mutations
+// through a wrapper that hides GormDB's Mutator, e.g. subspaced, can lose
+// updates.
+func Mutate(ctx context.Context, db OrderedTransactional, key []byte, op MutationType, operand int64) (int64, error) {
+	if m, ok := db.(Mutator); ok {
+		return m.Mutate(ctx, key, op, operand)
+	}
+	for attempt := 0; ; attempt++ {
+		n, err := mutateTx(ctx, db, key, op, operand)
+		if err == ErrConflict && attempt < maxRetries {
+			continue
+		}
+		return n, err
+	}
+}
+
+func mutateTx(ctx context.Context, db OrderedTransactional, key []byte, op MutationType, operand int64) (int64, error) {
+	tx, err := db.NewTransaction(ctx, false)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Discard(ctx)
+	n, err := mutate(ctx, tx, key, op, operand)
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit(ctx)
+}
+
+// mutate applies op within tx
+func mutate(ctx context.Context, tx Basic, key []byte, op MutationType, operand int64) (int64, error) {
+	n := operand
+	value, err := tx.Get(ctx, key)
+	switch {
+	case err == nil:
+		cur, err := DecodeCounter(value)
+		if err != nil {
+			return 0, err
+		}
+		n = op.Apply(cur, operand)
+	case err != ErrNotFound:
+		return 0, err
+	}
+	if err := tx.Put(ctx, key, EncodeCounter(n)); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
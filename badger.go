@@ -1,9 +1,12 @@
 package kv
 
 import (
+	"bytes"
 	"context"
+	"math"
 	"net/url"
 	"runtime"
+	"sync"
 	"time"
 
 	"github.com/dgraph-io/badger/v2"
@@ -13,21 +16,109 @@ const gcWorkers = 2
 const gcThreshold = 0.5
 const gcInterval = time.Hour * 5
 
+// discardInterval is how often history mode moves the discard timestamp
+const discardInterval = time.Minute
+
+// deleteRangeBatch is the number of keys DeleteRange deletes per transaction
+const deleteRangeBatch = 1000
+
 type BadgerDB struct {
 	*badger.DB
 
 	ctx    context.Context
 	cancel func()
+
+	// history mode runs badger in managed mode with the time of commits as
+	// their timestamps; clock is nil otherwise
+	history HistoryOptions
+	clock   *badgerClock
 }
 
 type badgerTransaction struct {
 	*badger.Txn
+	db   *BadgerDB
+	done bool
+}
+
+// badgerClock hands out unix nanosecond timestamps for managed transactions.
+//
+// Commits take their timestamp and run under one lock, so they land in
+// timestamp order, and transactions read at the timestamp of the last
+// completed commit. A commit can therefore never land below the read
+// timestamp of a transaction that started after it, which badger would not
+// detect as a conflict, and reads at a timestamp are stable.
+type badgerClock struct {
+	mu    sync.Mutex
+	last  uint64         // timestamp of the last completed commit
+	reads map[uint64]int // read timestamps of open transactions
+}
+
+// newBadgerClock starts at the current time, after the commits of earlier runs
+func newBadgerClock() *badgerClock {
+	return &badgerClock{
+		last:  uint64(time.Now().UnixNano()),
+		reads: map[uint64]int{},
+	}
+}
+
+// beginRead registers a transaction reading at ts, or at the last commit if
+// ts is later, and returns its read timestamp
+func (c *badgerClock) beginRead(ts uint64) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ts > c.last {
+		ts = c.last
+	}
+	c.reads[ts]++
+	return ts
+}
+
+func (c *badgerClock) endRead(ts uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reads[ts]--; c.reads[ts] <= 0 {
+		delete(c.reads, ts)
+	}
+}
+
+// commit commits txn at a timestamp after all earlier commits
+func (c *badgerClock) commit(txn *badger.Txn) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ts := uint64(time.Now().UnixNano())
+	if ts <= c.last {
+		ts = c.last + 1
+	}
+	err := txn.CommitAt(ts, nil)
+	c.last = ts
+	return err
+}
+
+// discardTs returns the timestamp up to which versions beyond the retained
+// ones may be dropped, keeping the versions open transactions read
+func (c *badgerClock) discardTs(retention time.Duration) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ts := uint64(time.Now().Add(-retention).UnixNano())
+	for r := range c.reads {
+		if r-1 < ts {
+			ts = r - 1
+		}
+	}
+	return ts
 }
 
 type badgerIterator struct {
 	*badger.Iterator
 }
 
+type badgerHistoryIterator struct {
+	*badger.Iterator
+	db  *BadgerDB
+	txn *badger.Txn
+	key []byte
+}
+
 func NewBadgerDbFromUrl(u *url.URL) (*BadgerDB, error) {
 	var db *badger.DB
 	var err error
@@ -44,45 +135,131 @@ func NewBadgerDbFromUrl(u *url.URL) (*BadgerDB, error) {
 		path = path[1:]
 	}
 
+	history, err := historyOptionsFromUrl(u)
+	if err != nil {
+		return nil, err
+	}
+
+	var opts badger.Options
 	if u.Query().Get("memory") == "true" {
-		db, err = badger.Open(badger.DefaultOptions("").WithInMemory(true))
+		opts = badger.DefaultOptions("").WithInMemory(true)
 	} else {
-		db, err = badger.Open(
-			badger.DefaultOptions(path).
-				// Lower RAM usage without mmap
-				WithNumVersionsToKeep(0).
-				WithEncryptionKey([]byte(passw)[:32]).
-				WithTruncate(true), // this would trucate faulty value logs; something that should NOT be problematic with syncWrites(true)
-		)
+		opts = badger.DefaultOptions(path).
+			// Lower RAM usage without mmap
+			WithNumVersionsToKeep(0).
+			WithEncryptionKey([]byte(passw)[:32]).
+			WithTruncate(true) // this would trucate faulty value logs; something that should NOT be problematic with syncWrites(true)
+	}
+
+	if !history.Enabled() {
+		db, err = badger.Open(opts)
+		if err != nil {
+			return nil, err
+		}
+		return NewbadgerFromDB(db)
 	}
 
+	versions := history.Versions
+	if versions < 1 {
+		versions = 1
+	}
+	db, err = badger.OpenManaged(opts.WithNumVersionsToKeep(versions))
 	if err != nil {
 		return nil, err
 	}
-
-	return NewbadgerFromDB(db)
+	return newBadgerDb(db, history, newBadgerClock()), nil
 }
 
+// NewbadgerFromDB wraps a badger DB opened without managed transactions
 func NewbadgerFromDB(db *badger.DB) (*BadgerDB, error) {
+	return newBadgerDb(db, HistoryOptions{}, nil), nil
+}
+
+func newBadgerDb(db *badger.DB, history HistoryOptions, clock *badgerClock) *BadgerDB {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	bdb := &BadgerDB{
 		db,
 		ctx,
 		cancel,
+		history,
+		clock,
 	}
 
+	if clock != nil {
+		bdb.setDiscardTs()
+	}
 	go bdb.runGc()
 
-	return bdb, nil
+	return bdb
+}
+
+// setDiscardTs allows badger to drop versions older than the retention, except
+// for the history.Versions newest of each key
+func (bdb *BadgerDB) setDiscardTs() {
+	bdb.DB.SetDiscardTs(bdb.clock.discardTs(bdb.history.Retention))
+}
+
+// newTxn starts a transaction, in history mode reading at the last commit
+func (bdb *BadgerDB) newTxn(update bool) *badger.Txn {
+	if bdb.clock == nil {
+		return bdb.DB.NewTransaction(update)
+	}
+	return bdb.DB.NewTransactionAt(bdb.clock.beginRead(math.MaxUint64), update)
+}
+
+// newTxnAt starts a read-only transaction reading at ts in history mode
+func (bdb *BadgerDB) newTxnAt(ts uint64) *badger.Txn {
+	return bdb.DB.NewTransactionAt(bdb.clock.beginRead(ts), false)
+}
+
+func (bdb *BadgerDB) commit(txn *badger.Txn) error {
+	if bdb.clock == nil {
+		return txn.Commit()
+	}
+	return bdb.clock.commit(txn)
+}
+
+// discard discards a transaction started with newTxn or newTxnAt. It must
+// be called exactly once per transaction.
+func (bdb *BadgerDB) discard(txn *badger.Txn) {
+	txn.Discard()
+	if bdb.clock != nil {
+		bdb.clock.endRead(txn.ReadTs())
+	}
+}
+
+// view is badger.DB.View for both managed and unmanaged mode
+func (bdb *BadgerDB) view(fn func(txn *badger.Txn) error) error {
+	txn := bdb.newTxn(false)
+	defer bdb.discard(txn)
+	return fn(txn)
+}
+
+// update is badger.DB.Update for both managed and unmanaged mode
+func (bdb *BadgerDB) update(fn func(txn *badger.Txn) error) error {
+	txn := bdb.newTxn(true)
+	defer bdb.discard(txn)
+	if err := fn(txn); err != nil {
+		return err
+	}
+	return bdb.commit(txn)
 }
 
 // TODO: parametrize these constants
 func (bdb *BadgerDB) runGc() {
 	ticker := time.NewTicker(gcInterval)
 	defer ticker.Stop()
+	var discard <-chan time.Time
+	if bdb.clock != nil {
+		discardTicker := time.NewTicker(discardInterval)
+		defer discardTicker.Stop()
+		discard = discardTicker.C
+	}
 	for {
 		select {
+		case <-discard:
+			bdb.setDiscardTs()
 		case <-ticker.C:
 			bdb.DB.Flatten(gcWorkers) // 4 number of workers
 			var err error
@@ -104,7 +281,10 @@ func (bdb *BadgerDB) Close() error {
 
 // Get gets the value of a key within a single query transaction
 func (bdb *BadgerDB) Get(ctx context.Context, key []byte) (res []byte, err error) {
-	err = bdb.DB.View(func(txn *badger.Txn) error {
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	err = bdb.view(func(txn *badger.Txn) error {
 		item, err := txn.Get(key)
 		if err != nil {
 			return err
@@ -120,7 +300,10 @@ func (bdb *BadgerDB) Get(ctx context.Context, key []byte) (res []byte, err error
 
 // Put sets the value of a key within a single query transaction
 func (bdb *BadgerDB) Put(ctx context.Context, key, value []byte) error {
-	err := bdb.DB.Update(func(txn *badger.Txn) error {
+	if err := contextErr(ctx); err != nil {
+		return err
+	}
+	err := bdb.update(func(txn *badger.Txn) error {
 		return txn.Set(key, value)
 	})
 	if err == badger.ErrKeyNotFound {
@@ -131,7 +314,10 @@ func (bdb *BadgerDB) Put(ctx context.Context, key, value []byte) error {
 
 // Delete removes a key within a single transaction
 func (bdb *BadgerDB) Delete(ctx context.Context, key []byte) error {
-	return bdb.DB.Update(func(txn *badger.Txn) error {
+	if err := contextErr(ctx); err != nil {
+		return err
+	}
+	return bdb.update(func(txn *badger.Txn) error {
 		err := txn.Delete(key)
 		if err == badger.ErrKeyNotFound {
 			return ErrNotFound
@@ -140,10 +326,205 @@ func (bdb *BadgerDB) Delete(ctx context.Context, key []byte) error {
 	})
 }
 
+// DeleteRange deletes all keys in [start, end). Ranges covering exactly the
+// keys of a prefix are dropped with DropPrefix, which does not report the
+// number of deleted keys; others are deleted in transactions of
+// deleteRangeBatch keys. In history mode keys are always deleted in
+// transactions, as dropping them would also drop their history.
+func (bdb *BadgerDB) DeleteRange(ctx context.Context, start, end []byte) (int64, error) {
+	if err := contextErr(ctx); err != nil {
+		return 0, err
+	}
+	if bdb.clock == nil && len(start) > 0 && bytes.Equal(end, PrefixEnd(start)) {
+		return -1, bdb.DB.DropPrefix(start)
+	}
+	var deleted int64
+	for {
+		n := 0
+		err := bdb.update(func(txn *badger.Txn) error {
+			opts := badger.DefaultIteratorOptions
+			opts.PrefetchValues = false
+			it := txn.NewIterator(opts)
+			var keys [][]byte
+			for it.Seek(start); it.Valid() && len(keys) < deleteRangeBatch; it.Next() {
+				k := it.Item().KeyCopy(nil)
+				if end != nil && bytes.Compare(k, end) >= 0 {
+					break
+				}
+				keys = append(keys, k)
+			}
+			it.Close()
+			for _, k := range keys {
+				if err := txn.Delete(k); err != nil {
+					return err
+				}
+			}
+			n = len(keys)
+			return nil
+		})
+		if err != nil {
+			return deleted, err
+		}
+		deleted += int64(n)
+		if n < deleteRangeBatch {
+			return deleted, nil
+		}
+		if err := contextErr(ctx); err != nil {
+			return deleted, err
+		}
+	}
+}
+
+// GetWithVersion returns the value of a key and the commit timestamp of its
+// last write as version
+func (bdb *BadgerDB) GetWithVersion(ctx context.Context, key []byte) (res []byte, version uint64, err error) {
+	if err := contextErr(ctx); err != nil {
+		return nil, VersionNotExist, err
+	}
+	err = bdb.view(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		version = item.Version()
+		res, err = item.ValueCopy(res)
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		err = ErrNotFound
+	}
+	return res, version, err
+}
+
+// PutIfVersion sets the value of a key if its version is expectedVersion
+func (bdb *BadgerDB) PutIfVersion(ctx context.Context, key, value []byte, expectedVersion uint64) error {
+	if err := contextErr(ctx); err != nil {
+		return err
+	}
+	err := bdb.update(func(txn *badger.Txn) error {
+		version := VersionNotExist
+		item, err := txn.Get(key)
+		switch {
+		case err == nil:
+			version = item.Version()
+		case err != badger.ErrKeyNotFound:
+			return err
+		}
+		if version != expectedVersion {
+			return ErrVersionMismatch
+		}
+		return txn.Set(key, value)
+	})
+	if err == badger.ErrConflict {
+		// the key was written since it was read
+		err = ErrVersionMismatch
+	}
+	return err
+}
+
+// DeleteIfVersion removes a key if its version is expectedVersion
+func (bdb *BadgerDB) DeleteIfVersion(ctx context.Context, key []byte, expectedVersion uint64) error {
+	if err := contextErr(ctx); err != nil {
+		return err
+	}
+	err := bdb.update(func(txn *badger.Txn) error {
+		version := VersionNotExist
+		item, err := txn.Get(key)
+		switch {
+		case err == nil:
+			version = item.Version()
+		case err != badger.ErrKeyNotFound:
+			return err
+		}
+		if version != expectedVersion {
+			return ErrVersionMismatch
+		}
+		if version == VersionNotExist {
+			return nil
+		}
+		return txn.Delete(key)
+	})
+	if err == badger.ErrConflict {
+		// the key was written since it was read
+		err = ErrVersionMismatch
+	}
+	return err
+}
+
+// GetAt returns the value key had at ts, read at ts from the versions badger
+// retains in history mode
+func (bdb *BadgerDB) GetAt(ctx context.Context, key []byte, ts time.Time) (res []byte, err error) {
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	if bdb.clock == nil {
+		return nil, ErrHistoryDisabled
+	}
+	if ts.UnixNano() <= 0 {
+		return nil, ErrNotFound
+	}
+	txn := bdb.newTxnAt(uint64(ts.UnixNano()))
+	defer bdb.discard(txn)
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(res)
+}
+
+// History iterates the versions of key badger retains in history mode
+func (bdb *BadgerDB) History(ctx context.Context, key []byte) (HistoryIterator, error) {
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	if bdb.clock == nil {
+		return nil, ErrHistoryDisabled
+	}
+	txn := bdb.newTxn(false)
+	opts := badger.DefaultIteratorOptions
+	opts.AllVersions = true
+	opts.Prefix = key
+	it := txn.NewIterator(opts)
+	it.Seek(key)
+	return &badgerHistoryIterator{it, bdb, txn, key}, nil
+}
+
 // NewTransaction for batching multiple values inside a transaction
 func (bdb *BadgerDB) NewTransaction(ctx context.Context, readOnly bool) (OrderedTransaction, error) {
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	return &badgerTransaction{
+		bdb.newTxn(!readOnly),
+		bdb,
+		false,
+	}, nil
+}
+
+// NewSnapshot starts a read-only transaction reading at readTs. Badger
+// transactions always read a consistent snapshot; reading at a given time
+// needs the timestamps of history mode.
+func (bdb *BadgerDB) NewSnapshot(ctx context.Context, readTs time.Time) (OrderedTransaction, error) {
+	if readTs.IsZero() {
+		return bdb.NewTransaction(ctx, true)
+	}
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	if bdb.clock == nil {
+		return nil, ErrSnapshotUnsupported
+	}
+	var ts uint64
+	if readTs.UnixNano() > 0 {
+		ts = uint64(readTs.UnixNano())
+	}
 	return &badgerTransaction{
-		bdb.DB.NewTransaction(!readOnly),
+		bdb.newTxnAt(ts),
+		bdb,
+		false,
 	}, nil
 }
 
@@ -157,6 +538,9 @@ func (bdb *badgerTransaction) Close() error {
 
 // Get gets the value of a key within a single query transaction
 func (bdb *badgerTransaction) Get(ctx context.Context, key []byte) (res []byte, err error) {
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
 	item, err := bdb.Txn.Get(key)
 	if err != nil {
 		if err == badger.ErrKeyNotFound {
@@ -169,23 +553,38 @@ func (bdb *badgerTransaction) Get(ctx context.Context, key []byte) (res []byte,
 
 // Put sets the value of a key within a single query transaction
 func (bdb *badgerTransaction) Put(ctx context.Context, key, value []byte) error {
+	if err := contextErr(ctx); err != nil {
+		return err
+	}
 	err := bdb.Txn.Set(key, value)
-	if err == badger.ErrKeyNotFound {
+	switch err {
+	case badger.ErrKeyNotFound:
 		err = ErrNotFound
+	case badger.ErrReadOnlyTxn:
+		err = ErrReadOnly
 	}
 	return err
 }
 
 // Delete removes a key within a single transaction
 func (bdb *badgerTransaction) Delete(ctx context.Context, key []byte) error {
+	if err := contextErr(ctx); err != nil {
+		return err
+	}
 	err := bdb.Txn.Delete(key)
-	if err == badger.ErrKeyNotFound {
-		return ErrNotFound
+	switch err {
+	case badger.ErrKeyNotFound:
+		err = ErrNotFound
+	case badger.ErrReadOnlyTxn:
+		err = ErrReadOnly
 	}
 	return err
 }
 
 func (bdb *badgerTransaction) Seek(ctx context.Context, StartKey []byte) (Iterator, error) {
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
 	it := bdb.Txn.NewIterator(badger.DefaultIteratorOptions)
 	it.Seek(StartKey)
 	return &badgerIterator{
@@ -195,27 +594,45 @@ func (bdb *badgerTransaction) Seek(ctx context.Context, StartKey []byte) (Iterat
 
 // Discard removes all sides effects of the transaction
 func (bdb *badgerTransaction) Discard(ctx context.Context) error {
-	bdb.Txn.Discard()
+	if !bdb.done {
+		bdb.done = true
+		bdb.db.discard(bdb.Txn)
+	}
 	return nil
 }
 
 // Commit persists all side effects of the transaction and returns an error if there are any conflics
 func (bdb *badgerTransaction) Commit(ctx context.Context) error {
-	return bdb.Txn.Commit()
+	if err := contextErr(ctx); err != nil {
+		return err
+	}
+	if bdb.done {
+		return badger.ErrDiscardedTxn
+	}
+	err := bdb.db.commit(bdb.Txn)
+	bdb.Discard(ctx)
+	if err == badger.ErrConflict {
+		err = ErrConflict
+	}
+	return err
 }
 
 // badgerIterator
 
 // Next yeilds the next key-value in iterator. Key-values can not be re-used between iterations. Make sure top copy the values if you must.
 func (it *badgerIterator) Next(ctx context.Context) (key, value []byte, err error) {
+	if err := contextErr(ctx); err != nil {
+		return nil, nil, err
+	}
 	if !it.Iterator.Valid() {
 		return nil, nil, ErrNotFound
 	}
 
 	defer it.Iterator.Next()
 
+	// Key() is only valid until the iterator advances, which happens before returning
 	value, err = it.Iterator.Item().ValueCopy(value)
-	return it.Iterator.Item().Key(), value, err
+	return it.Iterator.Item().KeyCopy(nil), value, err
 }
 
 // Close must always be called to clean up iterators.
@@ -223,3 +640,35 @@ func (bdb *badgerIterator) Close() error {
 	bdb.Iterator.Close()
 	return nil
 }
+
+// badgerHistoryIterator
+
+// Next yields the next older version of the key
+func (it *badgerHistoryIterator) Next(ctx context.Context) (Revision, error) {
+	if err := contextErr(ctx); err != nil {
+		return Revision{}, err
+	}
+	if !it.Iterator.Valid() || !bytes.Equal(it.Iterator.Item().Key(), it.key) {
+		return Revision{}, ErrNotFound
+	}
+	defer it.Iterator.Next()
+
+	item := it.Iterator.Item()
+	r := Revision{
+		Time:    time.Unix(0, int64(item.Version())),
+		Deleted: item.IsDeletedOrExpired(),
+	}
+	if r.Deleted {
+		return r, nil
+	}
+	var err error
+	r.Value, err = item.ValueCopy(nil)
+	return r, err
+}
+
+// Close must always be called to clean up iterators.
+func (it *badgerHistoryIterator) Close() error {
+	it.Iterator.Close()
+	it.db.discard(it.txn)
+	return nil
+}
@@ -0,0 +1,131 @@
+package cached
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/zatte/kv"
+)
+
+type CachedDb struct {
+	kv.OrderedTransactional
+	cache  *lru
+	hits   uint64
+	misses uint64
+}
+
+// CachedDbTransaction reads and writes straight through to the underlying
+// transaction, which gives read-your-writes and keeps conflict detection
+// intact. Written keys are invalidated in the cache once the transaction
+// commits.
+type CachedDbTransaction struct {
+	kv.OrderedTransaction
+	db      *CachedDb
+	written [][]byte
+}
+
+// Stats are the hit and miss counts of the cache. Cached ErrNotFound
+// results count as hits.
+type Stats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+}
+
+// New creates a DB with a read-through LRU cache of at most size keys in
+// front of Get. Missing keys are cached as well.
+func New(db kv.OrderedTransactional, size int) *CachedDb {
+	return &CachedDb{
+		OrderedTransactional: db,
+		cache:                newLru(size),
+	}
+}
+
+// NewFromStr creates a cached DB. Supports all connections strings of kv.New()
+func NewFromStr(connectionString string, size int) (*CachedDb, error) {
+	db, err := kv.New(connectionString)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(db, size), nil
+}
+
+// Stats returns the current cache statistics
+func (cdb *CachedDb) Stats() Stats {
+	return Stats{
+		Hits:    atomic.LoadUint64(&cdb.hits),
+		Misses:  atomic.LoadUint64(&cdb.misses),
+		Entries: cdb.cache.len(),
+	}
+}
+
+// Get gets the value of a key from the cache or else from the underlying DB
+func (cdb *CachedDb) Get(ctx context.Context, key []byte) (res []byte, err error) {
+	if v, found, ok := cdb.cache.get(key); ok {
+		atomic.AddUint64(&cdb.hits, 1)
+		if !found {
+			return nil, kv.ErrNotFound
+		}
+		return v, nil
+	}
+	atomic.AddUint64(&cdb.misses, 1)
+
+	gen := cdb.cache.generation()
+	res, err = cdb.OrderedTransactional.Get(ctx, key)
+	switch err {
+	case nil:
+		cdb.cache.add(gen, key, res, true)
+	case kv.ErrNotFound:
+		cdb.cache.add(gen, key, nil, false)
+	}
+	return res, err
+}
+
+// Put sets the value of a key and invalidates it in the cache
+func (cdb *CachedDb) Put(ctx context.Context, key, value []byte) error {
+	defer cdb.cache.invalidate(key)
+	return cdb.OrderedTransactional.Put(ctx, key, value)
+}
+
+// Delete removes a key and invalidates it in the cache
+func (cdb *CachedDb) Delete(ctx context.Context, key []byte) error {
+	defer cdb.cache.invalidate(key)
+	return cdb.OrderedTransactional.Delete(ctx, key)
+}
+
+// DeleteRange deletes all keys in [start, end) and invalidates them in the cache
+func (cdb *CachedDb) DeleteRange(ctx context.Context, start, end []byte) (int64, error) {
+	defer cdb.cache.invalidateRange(start, end)
+	return cdb.OrderedTransactional.DeleteRange(ctx, start, end)
+}
+
+// NewTransaction for batching multiple values inside a transaction
+func (cdb *CachedDb) NewTransaction(ctx context.Context, readOnly bool) (kv.OrderedTransaction, error) {
+	ot, err := cdb.OrderedTransactional.NewTransaction(ctx, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return &CachedDbTransaction{OrderedTransaction: ot, db: cdb}, nil
+}
+
+// Put sets the value of a key within the transaction
+func (tx *CachedDbTransaction) Put(ctx context.Context, key, value []byte) error {
+	tx.written = append(tx.written, copyBytes(key))
+	return tx.OrderedTransaction.Put(ctx, key, value)
+}
+
+// Delete removes a key within the transaction
+func (tx *CachedDbTransaction) Delete(ctx context.Context, key []byte) error {
+	tx.written = append(tx.written, copyBytes(key))
+	return tx.OrderedTransaction.Delete(ctx, key)
+}
+
+// Commit persists the transaction and invalidates all written keys in the cache
+func (tx *CachedDbTransaction) Commit(ctx context.Context) error {
+	if len(tx.written) > 0 {
+		// also on failure; the backend might have applied the commit
+		defer tx.db.cache.invalidate(tx.written...)
+	}
+	return tx.OrderedTransaction.Commit(ctx)
+}
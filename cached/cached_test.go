@@ -0,0 +1,90 @@
+package cached
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zatte/kv"
+)
+
+func TestCached(t *testing.T) {
+	ctx := context.Background()
+	raw, err := kv.New("badger:///?memory=true")
+	require.NoError(t, err)
+	db := New(raw, 2)
+
+	t.Run("read through and negative caching", func(t *testing.T) {
+		require.NoError(t, db.Put(ctx, []byte("A"), []byte("1")))
+
+		for i := 0; i < 2; i++ {
+			v, err := db.Get(ctx, []byte("A"))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("1"), v)
+
+			_, err = db.Get(ctx, []byte("missing"))
+			assert.EqualError(t, err, kv.ErrNotFound.Error())
+		}
+		assert.Equal(t, Stats{Hits: 2, Misses: 2, Entries: 2}, db.Stats())
+
+		// bypassing the cache is not visible until invalidated
+		require.NoError(t, raw.Put(ctx, []byte("missing"), []byte("2")))
+		_, err = db.Get(ctx, []byte("missing"))
+		assert.EqualError(t, err, kv.ErrNotFound.Error())
+	})
+
+	t.Run("put and delete invalidate", func(t *testing.T) {
+		require.NoError(t, db.Put(ctx, []byte("A"), []byte("3")))
+		v, err := db.Get(ctx, []byte("A"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("3"), v)
+
+		require.NoError(t, db.Delete(ctx, []byte("A")))
+		_, err = db.Get(ctx, []byte("A"))
+		assert.EqualError(t, err, kv.ErrNotFound.Error())
+	})
+
+	t.Run("bounded size", func(t *testing.T) {
+		for _, k := range []string{"X", "Y", "Z"} {
+			db.Get(ctx, []byte(k))
+		}
+		assert.Equal(t, 2, db.Stats().Entries)
+	})
+
+	t.Run("transactions invalidate on commit only", func(t *testing.T) {
+		require.NoError(t, db.Put(ctx, []byte("B"), []byte("1")))
+		db.Get(ctx, []byte("B"))
+
+		tx, err := db.NewTransaction(ctx, false)
+		require.NoError(t, err)
+		require.NoError(t, tx.Put(ctx, []byte("B"), []byte("2")))
+
+		v, err := tx.Get(ctx, []byte("B"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("2"), v, "read your writes")
+		require.NoError(t, tx.Discard(ctx))
+
+		v, err = db.Get(ctx, []byte("B"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("1"), v)
+
+		tx, err = db.NewTransaction(ctx, false)
+		require.NoError(t, err)
+		require.NoError(t, tx.Put(ctx, []byte("B"), []byte("3")))
+		require.NoError(t, tx.Commit(ctx))
+
+		v, err = db.Get(ctx, []byte("B"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("3"), v)
+	})
+
+	t.Run("delete range invalidates cached keys", func(t *testing.T) {
+		require.NoError(t, db.Put(ctx, []byte("R1"), []byte("1")))
+		db.Get(ctx, []byte("R1"))
+		_, err := db.DeleteRange(ctx, []byte("R"), []byte("S"))
+		require.NoError(t, err)
+		_, err = db.Get(ctx, []byte("R1"))
+		assert.Equal(t, kv.ErrNotFound, err)
+	})
+}
@@ -0,0 +1,111 @@
+package cached
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lru is a bounded least recently used cache of values by key. A nil value
+// with found == false is a cached ErrNotFound.
+type lru struct {
+	mu      sync.Mutex
+	size    int
+	ll      *list.List
+	entries map[string]*list.Element
+	gen     uint64 // incremented on every invalidation
+}
+
+type lruEntry struct {
+	key   string
+	value []byte
+	found bool
+}
+
+func newLru(size int) *lru {
+	return &lru{
+		size:    size,
+		ll:      list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// get returns the cached value of a key and whether it was cached at all.
+func (c *lru) get(key []byte) (value []byte, found, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[string(key)]
+	if !ok {
+		return nil, false, false
+	}
+	c.ll.MoveToFront(el)
+	e := el.Value.(*lruEntry)
+	return copyBytes(e.value), e.found, true
+}
+
+// generation is used to detect invalidations that happen while a value is
+// read from the backend; see add.
+func (c *lru) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// add caches a value read while the cache was at generation gen. The value is
+// dropped if anything was invalidated since, as it might be stale.
+func (c *lru) add(gen uint64, key, value []byte, found bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen || c.size <= 0 {
+		return
+	}
+	if el, ok := c.entries[string(key)]; ok {
+		c.ll.MoveToFront(el)
+		e := el.Value.(*lruEntry)
+		e.value, e.found = copyBytes(value), found
+		return
+	}
+	c.entries[string(key)] = c.ll.PushFront(&lruEntry{string(key), copyBytes(value), found})
+	for c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (c *lru) invalidate(keys ...[]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for _, key := range keys {
+		if el, ok := c.entries[string(key)]; ok {
+			c.ll.Remove(el)
+			delete(c.entries, string(key))
+		}
+	}
+}
+
+// invalidateRange drops all keys in [start, end), or from start on for a nil end
+func (c *lru) invalidateRange(start, end []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for key, el := range c.entries {
+		if key >= string(start) && (end == nil || key < string(end)) {
+			c.ll.Remove(el)
+			delete(c.entries, key)
+		}
+	}
+}
+
+func (c *lru) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
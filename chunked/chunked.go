@@ -0,0 +1,323 @@
+package chunked
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+
+	"github.com/zatte/fdbtuple"
+	"github.com/zatte/kv"
+)
+
+// DefaultChunkSize keeps every stored entity well below the 1MB datastore limit
+const DefaultChunkSize = 512 * 1024
+
+// manifest types, stored as the first byte of the value at index 0 of a key
+const (
+	manifestInline  byte = 0
+	manifestChunked byte = 1
+)
+
+// ErrCorrupt is returned when the manifest and the stored chunks of a key disagree
+const ErrCorrupt kv.KvError = "chunked: corrupt value"
+
+type ChunkedDb struct {
+	kv.OrderedTransactional
+	chunkSize int
+}
+
+type ChunkedDbTransaction struct {
+	kv.OrderedTransaction
+	chunkSize int
+}
+
+type ChunkedDbIterator struct {
+	kv.Iterator
+}
+
+// New creates a DB where values larger than chunkSize are transparently split
+// into multiple ordered sub keys. Every key is stored as a manifest at
+// (key, 0) followed by its chunks at (key, 1..n). A chunkSize <= 0 uses
+// DefaultChunkSize.
+func New(db kv.OrderedTransactional, chunkSize int) *ChunkedDb {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	return &ChunkedDb{db, chunkSize}
+}
+
+// NewFromStr creates a chunked DB. Supports all connections strings of kv.New()
+func NewFromStr(connectionString string, chunkSize int) (*ChunkedDb, error) {
+	db, err := kv.New(connectionString)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(db, chunkSize), nil
+}
+
+func chunkKey(key []byte, i int) []byte {
+	return fdbtuple.Tuple{key, int64(i)}.Pack()
+}
+
+// Get gets the value of a key within a single query transaction
+func (cdb *ChunkedDb) Get(ctx context.Context, key []byte) (res []byte, err error) {
+	tx, err := cdb.NewTransaction(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Discard(ctx)
+	return tx.Get(ctx, key)
+}
+
+// Put sets the value of a key and all its chunks within a single transaction
+func (cdb *ChunkedDb) Put(ctx context.Context, key, value []byte) error {
+	tx, err := cdb.NewTransaction(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer tx.Discard(ctx)
+	if err := tx.Put(ctx, key, value); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Delete removes a key and all its chunks within a single transaction
+func (cdb *ChunkedDb) Delete(ctx context.Context, key []byte) error {
+	tx, err := cdb.NewTransaction(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer tx.Discard(ctx)
+	if err := tx.Delete(ctx, key); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// DeleteRange deletes all keys in [start, end) with their chunks. The number
+// of deleted keys is unknown as chunks are stored as keys of their own, so -1
+// is returned unless nothing was deleted.
+func (cdb *ChunkedDb) DeleteRange(ctx context.Context, start, end []byte) (int64, error) {
+	var rawEnd []byte
+	if end != nil {
+		rawEnd = fdbtuple.Tuple{end}.Pack()
+	}
+	n, err := cdb.OrderedTransactional.DeleteRange(ctx, fdbtuple.Tuple{start}.Pack(), rawEnd)
+	if n > 0 {
+		n = -1
+	}
+	return n, err
+}
+
+// NewTransaction for batching multiple values inside a transaction
+func (cdb *ChunkedDb) NewTransaction(ctx context.Context, readOnly bool) (kv.OrderedTransaction, error) {
+	ot, err := cdb.OrderedTransactional.NewTransaction(ctx, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return &ChunkedDbTransaction{ot, cdb.chunkSize}, nil
+}
+
+// chunkedDbTransaction
+
+// chunks returns the number of chunks stored for a key; 0 for inline values.
+func (tx *ChunkedDbTransaction) chunks(ctx context.Context, key []byte) (int, error) {
+	m, err := tx.OrderedTransaction.Get(ctx, chunkKey(key, 0))
+	if err != nil {
+		return 0, err
+	}
+	n, _, err := parseManifest(m)
+	return n, err
+}
+
+// Seek initializes an iterator at the given key (inclusive)
+func (tx *ChunkedDbTransaction) Seek(ctx context.Context, StartKey []byte) (kv.Iterator, error) {
+	it, err := tx.OrderedTransaction.Seek(ctx, fdbtuple.Tuple{StartKey}.Pack())
+	if err != nil {
+		return nil, err
+	}
+	return &ChunkedDbIterator{it}, nil
+}
+
+// Get gets the value of a key by reading the manifest and all its chunks
+func (tx *ChunkedDbTransaction) Get(ctx context.Context, key []byte) (res []byte, err error) {
+	m, err := tx.OrderedTransaction.Get(ctx, chunkKey(key, 0))
+	if err != nil {
+		return nil, err
+	}
+	n, size, err := parseManifest(m)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return m[1:], nil
+	}
+
+	res = make([]byte, 0, size)
+	for i := 1; i <= n; i++ {
+		c, err := tx.OrderedTransaction.Get(ctx, chunkKey(key, i))
+		if err == kv.ErrNotFound {
+			return nil, ErrCorrupt
+		}
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, c...)
+	}
+	if len(res) != size {
+		return nil, ErrCorrupt
+	}
+	return res, nil
+}
+
+// Put writes the manifest and the chunks of the value, removing any chunks
+// left over from a previous larger value.
+func (tx *ChunkedDbTransaction) Put(ctx context.Context, key, value []byte) error {
+	old, err := tx.chunks(ctx, key)
+	if err != nil && err != kv.ErrNotFound {
+		return err
+	}
+
+	n := 0
+	if len(value) > tx.chunkSize {
+		n = (len(value) + tx.chunkSize - 1) / tx.chunkSize
+	}
+
+	if err := tx.OrderedTransaction.Put(ctx, chunkKey(key, 0), newManifest(n, value)); err != nil {
+		return err
+	}
+	for i := 1; i <= n; i++ {
+		end := i * tx.chunkSize
+		if end > len(value) {
+			end = len(value)
+		}
+		if err := tx.OrderedTransaction.Put(ctx, chunkKey(key, i), value[(i-1)*tx.chunkSize:end]); err != nil {
+			return err
+		}
+	}
+	for i := n + 1; i <= old; i++ {
+		if err := tx.OrderedTransaction.Delete(ctx, chunkKey(key, i)); err != nil && err != kv.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes the manifest and all chunks of a key
+func (tx *ChunkedDbTransaction) Delete(ctx context.Context, key []byte) error {
+	n, err := tx.chunks(ctx, key)
+	if err == kv.ErrNotFound {
+		return tx.OrderedTransaction.Delete(ctx, chunkKey(key, 0))
+	}
+	if err != nil {
+		return err
+	}
+	for i := 1; i <= n; i++ {
+		if err := tx.OrderedTransaction.Delete(ctx, chunkKey(key, i)); err != nil && err != kv.ErrNotFound {
+			return err
+		}
+	}
+	return tx.OrderedTransaction.Delete(ctx, chunkKey(key, 0))
+}
+
+// chunkedDbIterator
+
+// Next yields the next key with its value reassembled from the chunks following its manifest.
+func (it *ChunkedDbIterator) Next(ctx context.Context) (key, value []byte, err error) {
+	key, i, m, err := it.next(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if i != 0 {
+		return nil, nil, ErrCorrupt
+	}
+	n, size, err := parseManifest(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	if n == 0 {
+		return key, m[1:], nil
+	}
+
+	value = make([]byte, 0, size)
+	for c := 1; c <= n; c++ {
+		ck, ci, cv, err := it.next(ctx)
+		if err == kv.ErrNotFound || (err == nil && (ci != c || !bytes.Equal(ck, key))) {
+			return nil, nil, ErrCorrupt
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		value = append(value, cv...)
+	}
+	if len(value) != size {
+		return nil, nil, ErrCorrupt
+	}
+	return key, value, nil
+}
+
+func (it *ChunkedDbIterator) next(ctx context.Context) (key []byte, i int, value []byte, err error) {
+	k, v, err := it.Iterator.Next(ctx)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	t, err := fdbtuple.Unpack(k)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if len(t) != 2 {
+		return nil, 0, nil, ErrCorrupt
+	}
+	key, ok := t[0].([]byte)
+	if !ok {
+		return nil, 0, nil, ErrCorrupt
+	}
+	idx, ok := t[1].(int64)
+	if !ok {
+		return nil, 0, nil, ErrCorrupt
+	}
+	return key, int(idx), v, nil
+}
+
+// manifest
+
+func newManifest(chunks int, value []byte) []byte {
+	if chunks == 0 {
+		return append([]byte{manifestInline}, value...)
+	}
+	m := make([]byte, 1, 1+2*binary.MaxVarintLen64)
+	m[0] = manifestChunked
+	m = appendUvarint(m, uint64(chunks))
+	return appendUvarint(m, uint64(len(value)))
+}
+
+// parseManifest returns the number of chunks and the total size of the value
+func parseManifest(m []byte) (chunks, size int, err error) {
+	if len(m) == 0 {
+		return 0, 0, ErrCorrupt
+	}
+	switch m[0] {
+	case manifestInline:
+		return 0, len(m) - 1, nil
+	case manifestChunked:
+		c, n := binary.Uvarint(m[1:])
+		if n <= 0 {
+			return 0, 0, ErrCorrupt
+		}
+		s, n2 := binary.Uvarint(m[1+n:])
+		if n2 <= 0 {
+			return 0, 0, ErrCorrupt
+		}
+		return int(c), int(s), nil
+	default:
+		return 0, 0, ErrCorrupt
+	}
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
@@ -0,0 +1,107 @@
+package chunked
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zatte/kv"
+)
+
+func TestChunked(t *testing.T) {
+	ctx := context.Background()
+	raw, err := kv.New("badger:///?memory=true")
+	require.NoError(t, err)
+	db := New(raw, 4)
+
+	large := []byte("0123456789abcdefghij-")
+	small := []byte("xy")
+
+	t.Run("put get large and small values", func(t *testing.T) {
+		require.NoError(t, db.Put(ctx, []byte("A"), large))
+		require.NoError(t, db.Put(ctx, []byte("B"), small))
+
+		v, err := db.Get(ctx, []byte("A"))
+		assert.NoError(t, err)
+		assert.Equal(t, large, v)
+
+		v, err = db.Get(ctx, []byte("B"))
+		assert.NoError(t, err)
+		assert.Equal(t, small, v)
+
+		_, err = db.Get(ctx, []byte("C"))
+		assert.EqualError(t, err, kv.ErrNotFound.Error())
+	})
+
+	t.Run("overwrite removes stale chunks", func(t *testing.T) {
+		require.NoError(t, db.Put(ctx, []byte("A"), small))
+		_, err := raw.Get(ctx, chunkKey([]byte("A"), 1))
+		assert.EqualError(t, err, kv.ErrNotFound.Error())
+
+		v, err := db.Get(ctx, []byte("A"))
+		assert.NoError(t, err)
+		assert.Equal(t, small, v)
+		require.NoError(t, db.Put(ctx, []byte("A"), large))
+	})
+
+	t.Run("seek reassembles values in order", func(t *testing.T) {
+		require.NoError(t, db.Put(ctx, []byte("A1"), bytes.Repeat([]byte("z"), 9)))
+
+		tx, err := db.NewTransaction(ctx, true)
+		require.NoError(t, err)
+		defer tx.Discard(ctx)
+
+		it, err := tx.Seek(ctx, []byte("A"))
+		require.NoError(t, err)
+		defer it.Close()
+
+		var keys []string
+		var values [][]byte
+		k, v, err := it.Next(ctx)
+		for ; err == nil; k, v, err = it.Next(ctx) {
+			keys = append(keys, string(k))
+			values = append(values, v)
+		}
+		assert.EqualError(t, err, kv.ErrNotFound.Error())
+		assert.Equal(t, []string{"A", "A1", "B"}, keys)
+		assert.Equal(t, [][]byte{large, bytes.Repeat([]byte("z"), 9), small}, values)
+	})
+
+	t.Run("delete removes all chunks", func(t *testing.T) {
+		require.NoError(t, db.Delete(ctx, []byte("A")))
+		for i := 0; i <= 6; i++ {
+			_, err := raw.Get(ctx, chunkKey([]byte("A"), i))
+			assert.EqualError(t, err, kv.ErrNotFound.Error())
+		}
+		_, err := db.Get(ctx, []byte("A"))
+		assert.EqualError(t, err, kv.ErrNotFound.Error())
+	})
+
+	t.Run("discarded transactions leave no chunks", func(t *testing.T) {
+		tx, err := db.NewTransaction(ctx, false)
+		require.NoError(t, err)
+		require.NoError(t, tx.Put(ctx, []byte("D"), large))
+		require.NoError(t, tx.Discard(ctx))
+
+		_, err = raw.Get(ctx, chunkKey([]byte("D"), 1))
+		assert.EqualError(t, err, kv.ErrNotFound.Error())
+	})
+
+	t.Run("delete range removes all chunks", func(t *testing.T) {
+		require.NoError(t, db.Put(ctx, []byte("E"), large))
+		require.NoError(t, db.Put(ctx, []byte("F"), []byte("small")))
+		require.NoError(t, db.Put(ctx, []byte("G"), []byte("kept")))
+		_, err := db.DeleteRange(ctx, []byte("E"), []byte("G"))
+		require.NoError(t, err)
+
+		_, err = raw.Get(ctx, chunkKey([]byte("E"), 1))
+		assert.EqualError(t, err, kv.ErrNotFound.Error())
+		_, err = db.Get(ctx, []byte("F"))
+		assert.EqualError(t, err, kv.ErrNotFound.Error())
+		v, err := db.Get(ctx, []byte("G"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("kept"), v)
+	})
+}
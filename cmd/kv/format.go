@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// format converts keys and values between bytes and their command line form
+type format string
+
+const (
+	formatUTF8   format = "utf8"
+	formatHex    format = "hex"
+	formatBase64 format = "base64"
+)
+
+func parseFormat(s string) (format, error) {
+	switch f := format(strings.ToLower(s)); f {
+	case formatUTF8, formatHex, formatBase64:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown format %q, use utf8, hex or base64", s)
+}
+
+func (f format) decode(s string) ([]byte, error) {
+	switch f {
+	case formatHex:
+		return hex.DecodeString(s)
+	case formatBase64:
+		return base64.StdEncoding.DecodeString(s)
+	}
+	return []byte(s), nil
+}
+
+func (f format) encode(b []byte) string {
+	switch f {
+	case formatHex:
+		return hex.EncodeToString(b)
+	case formatBase64:
+		return base64.StdEncoding.EncodeToString(b)
+	}
+	return string(b)
+}
+
+// parseTuple parses a comma separated list of tuple elements. Integers become
+// int64 elements, everything else strings; quote an element ("42") to force a
+// string.
+func parseTuple(s string) []interface{} {
+	if s == "" {
+		return nil
+	}
+	var t []interface{}
+	for _, e := range strings.Split(s, ",") {
+		if len(e) >= 2 && e[0] == '"' && e[len(e)-1] == '"' {
+			t = append(t, e[1:len(e)-1])
+		} else if i, err := strconv.ParseInt(e, 10, 64); err == nil {
+			t = append(t, i)
+		} else {
+			t = append(t, e)
+		}
+	}
+	return t
+}
@@ -0,0 +1,372 @@
+// Command kv inspects and edits any store supported by kv.New.
+//
+//	kv -db badger:///./data.db get mykey
+//	kv -db badger:///./data.db -value-format hex put mykey 0a0b
+//	kv -db badger:///./data.db -subspace users,42 scan -prefix profile/ -limit 10
+//	kv -db badger:///./data.db count -prefix users/
+//
+// The connection string can also be set through the KV_DB environment variable.
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+
+	"github.com/zatte/kv"
+	"github.com/zatte/kv/subspaced"
+)
+
+const usage = `usage: kv [flags] <command> [args]
+
+commands:
+  get <key>                   print the value of a key
+  put <key> [value]           set a key, reads the value from stdin if omitted
+  delete <key>                remove a key
+  scan [scan flags]           print key/values in key order
+  count [range flags]         count keys
+  export [export flags]       write a dump to stdout
+  import [import flags]       read a dump from stdin
+
+flags:
+`
+
+type cli struct {
+	db          kv.OrderedTransactional
+	keyFormat   format
+	valueFormat format
+	out         io.Writer
+}
+
+func main() {
+	flags := flag.NewFlagSet("kv", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	var (
+		conn        = flags.String("db", os.Getenv("KV_DB"), "connection string, defaults to $KV_DB")
+		keyFormat   = flags.String("key-format", "utf8", "key format: utf8, hex or base64")
+		valueFormat = flags.String("value-format", "utf8", "value format: utf8, hex or base64")
+		subspace    = flags.String("subspace", "", "comma separated tuple prefix, e.g. users,42")
+	)
+	flags.Parse(os.Args[1:])
+	if *conn == "" || flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	if err := run(ctx, *conn, *keyFormat, *valueFormat, *subspace, flags.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, "kv:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, conn, keyFormat, valueFormat, subspace string, args []string) (err error) {
+	kf, err := parseFormat(keyFormat)
+	if err != nil {
+		return err
+	}
+	vf, err := parseFormat(valueFormat)
+	if err != nil {
+		return err
+	}
+	db, err := kv.NewWithContext(ctx, conn)
+	if err != nil {
+		return err
+	}
+	defer closeDb(db, &err)
+	if prefixes := parseTuple(subspace); len(prefixes) > 0 {
+		db = subspaced.New(db, prefixes...)
+	}
+
+	c := &cli{db, kf, vf, os.Stdout}
+	switch cmd, args := args[0], args[1:]; cmd {
+	case "get":
+		return c.get(ctx, args)
+	case "put":
+		return c.put(ctx, args)
+	case "delete", "del":
+		return c.delete(ctx, args)
+	case "scan":
+		return c.scan(ctx, args)
+	case "count":
+		return c.count(ctx, args)
+	case "export":
+		return c.export(ctx, args)
+	case "import":
+		return c.importDump(ctx, args)
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+}
+
+// closeDb closes db if its backend holds resources, e.g. badger flushes its
+// writes to disk, and keeps the first error in err
+func closeDb(db kv.OrderedTransactional, err *error) {
+	c, ok := db.(io.Closer)
+	if !ok {
+		return
+	}
+	if cerr := c.Close(); cerr != nil && *err == nil {
+		*err = cerr
+	}
+}
+
+func (c *cli) key(args []string, n int) ([]byte, error) {
+	if len(args) < 1 || len(args) > n {
+		return nil, fmt.Errorf("expected a key")
+	}
+	return c.keyFormat.decode(args[0])
+}
+
+func (c *cli) get(ctx context.Context, args []string) error {
+	key, err := c.key(args, 1)
+	if err != nil {
+		return err
+	}
+	v, err := c.db.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(c.out, c.valueFormat.encode(v))
+	return err
+}
+
+func (c *cli) put(ctx context.Context, args []string) error {
+	key, err := c.key(args, 2)
+	if err != nil {
+		return err
+	}
+	var value []byte
+	if len(args) == 2 {
+		value, err = c.valueFormat.decode(args[1])
+	} else {
+		value, err = ioutil.ReadAll(os.Stdin)
+		if err == nil && c.valueFormat != formatUTF8 {
+			value, err = c.valueFormat.decode(string(bytes.TrimSpace(value)))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return c.db.Put(ctx, key, value)
+}
+
+func (c *cli) delete(ctx context.Context, args []string) error {
+	key, err := c.key(args, 1)
+	if err != nil {
+		return err
+	}
+	return c.db.Delete(ctx, key)
+}
+
+// keyRange selects keys by prefix and a start (inclusive) and end (exclusive) key
+type keyRange struct {
+	prefix, start, end []byte
+}
+
+func (c *cli) rangeFlags(flags *flag.FlagSet) func() (keyRange, error) {
+	prefix := flags.String("prefix", "", "only keys with this prefix")
+	start := flags.String("start", "", "first key (inclusive)")
+	end := flags.String("end", "", "last key (exclusive)")
+	return func() (r keyRange, err error) {
+		if r.prefix, err = c.keyFormat.decode(*prefix); err != nil {
+			return r, err
+		}
+		if r.start, err = c.keyFormat.decode(*start); err != nil {
+			return r, err
+		}
+		if r.end, err = c.keyFormat.decode(*end); err != nil {
+			return r, err
+		}
+		if bytes.Compare(r.prefix, r.start) > 0 {
+			r.start = r.prefix
+		}
+		return r, nil
+	}
+}
+
+// each calls fn for every key/value in r in key order
+func (c *cli) each(ctx context.Context, r keyRange, fn func(k, v []byte) error) error {
+	tx, err := c.db.NewTransaction(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer tx.Discard(ctx)
+
+	it, err := tx.Seek(ctx, r.start)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	for {
+		k, v, err := it.Next(ctx)
+		if err == kv.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(k, r.prefix) || (len(r.end) > 0 && bytes.Compare(k, r.end) >= 0) {
+			return nil
+		}
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+}
+
+type pair struct {
+	key, value []byte
+}
+
+func (c *cli) scan(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("scan", flag.ExitOnError)
+	keyRange := c.rangeFlags(flags)
+	limit := flags.Int("limit", 0, "maximum number of keys, 0 for all")
+	reverse := flags.Bool("reverse", false, "print in descending key order")
+	keysOnly := flags.Bool("keys-only", false, "only print keys")
+	flags.Parse(args)
+	r, err := keyRange()
+	if err != nil {
+		return err
+	}
+
+	print := func(k, v []byte) error {
+		if *keysOnly {
+			_, err := fmt.Fprintln(c.out, c.keyFormat.encode(k))
+			return err
+		}
+		_, err := fmt.Fprintf(c.out, "%s\t%s\n", c.keyFormat.encode(k), c.valueFormat.encode(v))
+		return err
+	}
+
+	if !*reverse {
+		n := 0
+		errLimit := fmt.Errorf("limit reached")
+		err := c.each(ctx, r, func(k, v []byte) error {
+			if *limit > 0 && n >= *limit {
+				return errLimit
+			}
+			n++
+			return print(k, v)
+		})
+		if err == errLimit {
+			err = nil
+		}
+		return err
+	}
+
+	// Iterators only go forward, so reverse scans buffer the range, keeping
+	// only the last limit pairs in a ring.
+	var ring []pair
+	next := 0
+	err = c.each(ctx, r, func(k, v []byte) error {
+		p := pair{append([]byte{}, k...), append([]byte{}, v...)}
+		if *limit <= 0 || len(ring) < *limit {
+			ring = append(ring, p)
+			return nil
+		}
+		ring[next] = p
+		next = (next + 1) % *limit
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(ring) - 1; i >= 0; i-- {
+		p := ring[(next+i)%len(ring)]
+		if err := print(p.key, p.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cli) count(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("count", flag.ExitOnError)
+	keyRange := c.rangeFlags(flags)
+	flags.Parse(args)
+	r, err := keyRange()
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	if err := c.each(ctx, r, func(k, v []byte) error {
+		n++
+		return nil
+	}); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(c.out, n)
+	return err
+}
+
+func (c *cli) export(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	prefix := flags.String("prefix", "", "only keys with this prefix")
+	dumpFormat := flags.String("format", string(kv.DumpJSONL), "dump format: jsonl or binary")
+	checksum := flags.Bool("checksum", true, "add a sha256 checksum to the dump")
+	flags.Parse(args)
+	p, err := c.keyFormat.decode(*prefix)
+	if err != nil {
+		return err
+	}
+
+	tx, err := c.db.NewTransaction(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer tx.Discard(ctx)
+
+	trailer, err := kv.Export(ctx, tx, c.out, kv.ExportOptions{
+		Format:   kv.DumpFormat(*dumpFormat),
+		Prefix:   p,
+		Checksum: *checksum,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d keys\n", trailer.Count)
+	return nil
+}
+
+func (c *cli) importDump(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	from := flags.String("from-prefix", "", "only import keys with this prefix")
+	to := flags.String("to-prefix", "", "replace from-prefix with this prefix")
+	batchSize := flags.Int("batch", kv.DefaultCopyBatchSize, "keys written per transaction")
+	flags.Parse(args)
+	opts := kv.ImportOptions{BatchSize: *batchSize}
+	var err error
+	if opts.FromPrefix, err = c.keyFormat.decode(*from); err != nil {
+		return err
+	}
+	if opts.ToPrefix, err = c.keyFormat.decode(*to); err != nil {
+		return err
+	}
+
+	_, trailer, err := kv.Import(ctx, os.Stdin, c.db, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "imported dump of %d keys\n", trailer.Count)
+	return nil
+}
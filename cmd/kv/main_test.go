@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zatte/kv"
+	"github.com/zatte/kv/subspaced"
+)
+
+func TestParseTuple(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []interface{}
+	}{
+		{"", nil},
+		{"users", []interface{}{"users"}},
+		{"users,42", []interface{}{"users", int64(42)}},
+		{"users,-7,x", []interface{}{"users", int64(-7), "x"}},
+		{`users,"42"`, []interface{}{"users", "42"}},
+		{`""`, []interface{}{""}},
+		{`"`, []interface{}{`"`}},
+		{"a,,b", []interface{}{"a", "", "b"}},
+		{"99999999999999999999", []interface{}{"99999999999999999999"}},
+	} {
+		assert.Equal(t, tc.want, parseTuple(tc.in), tc.in)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	raw := []byte{0, 'k', 0xff}
+	for _, tc := range []struct {
+		name    string
+		encoded string
+	}{
+		{"utf8", string(raw)},
+		{"hex", "006bff"},
+		{"HEX", "006bff"},
+		{"base64", "AGv/"},
+	} {
+		f, err := parseFormat(tc.name)
+		require.NoError(t, err, tc.name)
+		assert.Equal(t, tc.encoded, f.encode(raw), tc.name)
+		b, err := f.decode(tc.encoded)
+		require.NoError(t, err, tc.name)
+		assert.Equal(t, raw, b, tc.name)
+	}
+
+	_, err := parseFormat("binary")
+	assert.Error(t, err)
+	_, err = formatHex.decode("zz")
+	assert.Error(t, err)
+	_, err = formatBase64.decode("!")
+	assert.Error(t, err)
+}
+
+func TestScan(t *testing.T) {
+	ctx := context.Background()
+	db, err := kv.New("badger:///?memory=true")
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, db.Put(ctx, []byte(fmt.Sprintf("k%d", i)), []byte{byte('a' + i)}))
+	}
+	require.NoError(t, db.Put(ctx, []byte("other"), []byte("x")))
+
+	for _, tc := range []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"all", []string{"-prefix", "k"}, "k0\ta\nk1\tb\nk2\tc\nk3\td\nk4\te\n"},
+		{"limit", []string{"-prefix", "k", "-limit", "2"}, "k0\ta\nk1\tb\n"},
+		{"range", []string{"-start", "k1", "-end", "k3", "-keys-only"}, "k1\nk2\n"},
+		{"reverse", []string{"-prefix", "k", "-reverse", "-keys-only"}, "k4\nk3\nk2\nk1\nk0\n"},
+		{"reverse limit", []string{"-prefix", "k", "-reverse", "-limit", "2"}, "k4\te\nk3\td\n"},
+		{"reverse limit wraps the ring", []string{"-prefix", "k", "-reverse", "-limit", "3", "-keys-only"}, "k4\nk3\nk2\n"},
+		{"reverse limit above count", []string{"-prefix", "k", "-reverse", "-limit", "10", "-keys-only"}, "k4\nk3\nk2\nk1\nk0\n"},
+		{"reverse range", []string{"-start", "k1", "-end", "k4", "-reverse", "-limit", "1", "-keys-only"}, "k3\n"},
+		{"empty", []string{"-prefix", "missing", "-reverse"}, ""},
+	} {
+		var out bytes.Buffer
+		c := &cli{db, formatUTF8, formatUTF8, &out}
+		require.NoError(t, c.scan(ctx, tc.args), tc.name)
+		assert.Equal(t, tc.want, out.String(), tc.name)
+	}
+
+	t.Run("hex output", func(t *testing.T) {
+		var out bytes.Buffer
+		c := &cli{db, formatHex, formatBase64, &out}
+		require.NoError(t, c.scan(ctx, []string{"-prefix", "6b", "-reverse", "-limit", "1"}))
+		assert.Equal(t, "6b34\tZQ==\n", out.String())
+	})
+
+	t.Run("count", func(t *testing.T) {
+		var out bytes.Buffer
+		c := &cli{db, formatUTF8, formatUTF8, &out}
+		require.NoError(t, c.count(ctx, []string{"-prefix", "k", "-start", "k2"}))
+		assert.Equal(t, "3\n", out.String())
+	})
+}
+
+func TestRunClosesTheStore(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "kv")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	conn := "badger://" + filepath.Join(dir, "db")
+
+	// badger locks its directory until closed, so every run must close it
+	require.NoError(t, run(ctx, conn, "utf8", "utf8", "users,42", []string{"put", "k", "v1"}))
+	require.NoError(t, run(ctx, conn, "utf8", "hex", "users,42", []string{"put", "k2", "7632"}))
+
+	db, err := kv.New(conn)
+	require.NoError(t, err)
+	defer db.(*kv.BadgerDB).Close()
+	var out bytes.Buffer
+	c := &cli{subspaced.New(db, "users", int64(42)), formatUTF8, formatUTF8, &out}
+	require.NoError(t, c.scan(ctx, nil))
+	assert.Equal(t, "k\tv1\nk2\tv2\n", out.String())
+}
@@ -0,0 +1,108 @@
+// Command kvcopy copies all keys from one kv connection string to another.
+//
+//	kvcopy -src badger:///./old.db -dst "postgres://..." -prefix users/ -verify
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	"github.com/zatte/kv"
+)
+
+func main() {
+	var (
+		src         = flag.String("src", "", "source connection string")
+		dst         = flag.String("dst", "", "destination connection string")
+		prefix      = flag.String("prefix", "", "only copy keys with this prefix")
+		batchSize   = flag.Int("batch", kv.DefaultCopyBatchSize, "keys written per transaction")
+		parallelism = flag.Int("parallel", 1, "batches written concurrently")
+		dryRun      = flag.Bool("dry-run", false, "read the source without writing")
+		verify      = flag.Bool("verify", false, "compare checksums of source and destination after copying")
+		quiet       = flag.Bool("quiet", false, "do not report progress")
+	)
+	flag.Parse()
+	if *src == "" || (*dst == "" && !*dryRun) {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	if err := run(ctx, *src, *dst, kv.CopyOptions{
+		Prefix:      []byte(*prefix),
+		BatchSize:   *batchSize,
+		Parallelism: *parallelism,
+		DryRun:      *dryRun,
+		Verify:      *verify,
+	}, *quiet); err != nil {
+		fmt.Fprintln(os.Stderr, "kvcopy:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, srcStr, dstStr string, opts kv.CopyOptions, quiet bool) (err error) {
+	srcDb, err := kv.NewWithContext(ctx, srcStr)
+	if err != nil {
+		return err
+	}
+	defer closeDb(srcDb, &err)
+	var dst kv.Basic
+	if dstStr != "" {
+		var dstDb kv.OrderedTransactional
+		if dstDb, err = kv.NewWithContext(ctx, dstStr); err != nil {
+			return err
+		}
+		defer closeDb(dstDb, &err)
+		dst = dstDb
+	}
+
+	// A read-only transaction gives a consistent view of the source where supported
+	src, err := srcDb.NewTransaction(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer src.Discard(ctx)
+
+	if !quiet {
+		opts.Progress = func(s kv.CopyStats) {
+			fmt.Fprintf(os.Stderr, "\r%d keys, %d bytes", s.Keys, s.Bytes)
+		}
+	}
+	stats, err := kv.Copy(ctx, src, dst, opts)
+	if !quiet {
+		fmt.Fprintln(os.Stderr)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("copied %d keys (%d bytes)\n", stats.Keys, stats.Bytes)
+	if stats.SourceChecksum != "" {
+		fmt.Printf("checksum %s\n", stats.SourceChecksum)
+	}
+	return nil
+}
+
+// closeDb closes db if its backend holds resources, e.g. badger flushes its
+// writes to disk, and keeps the first error in err
+func closeDb(db kv.OrderedTransactional, err *error) {
+	c, ok := db.(io.Closer)
+	if !ok {
+		return
+	}
+	if cerr := c.Close(); cerr != nil && *err == nil {
+		*err = cerr
+	}
+}
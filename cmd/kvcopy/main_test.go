@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zatte/kv"
+)
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "kvcopy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	srcStr := "badger://" + filepath.Join(dir, "src")
+	dstStr := "badger://" + filepath.Join(dir, "dst")
+
+	src, err := kv.New(srcStr)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, src.Put(ctx, []byte(fmt.Sprintf("users/%d", i)), []byte("x")))
+	}
+	require.NoError(t, src.Put(ctx, []byte("orders/1"), []byte("y")))
+	require.NoError(t, src.(*kv.BadgerDB).Close())
+
+	t.Run("dry run writes nothing", func(t *testing.T) {
+		require.NoError(t, run(ctx, srcStr, "", kv.CopyOptions{DryRun: true}, true))
+	})
+
+	t.Run("copies the prefix and closes both stores", func(t *testing.T) {
+		require.NoError(t, run(ctx, srcStr, dstStr, kv.CopyOptions{
+			Prefix:      []byte("users/"),
+			BatchSize:   3,
+			Parallelism: 2,
+			Verify:      true,
+		}, true))
+
+		// both stores are closed, so they can be opened again
+		dst, err := kv.New(dstStr)
+		require.NoError(t, err)
+		defer dst.(*kv.BadgerDB).Close()
+		v, err := dst.Get(ctx, []byte("users/9"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte("x"), v)
+		_, err = dst.Get(ctx, []byte("orders/1"))
+		assert.Equal(t, kv.ErrNotFound, err)
+	})
+
+	t.Run("invalid destination", func(t *testing.T) {
+		assert.Error(t, run(ctx, srcStr, "nope://", kv.CopyOptions{}, true))
+	})
+}
@@ -0,0 +1,112 @@
+// Command kvserver serves a kv store over HTTP, see package server, and
+// optionally gRPC, see package grpcserver, and the Redis protocol, see package
+// resp.
+//
+//	kvserver -db badger:///./data.db -addr :8080 -grpc-addr :9090 -redis-addr :6379 -token secret
+//
+// Go programs access it through kv.New("remote://host:8080?token=secret&tls=true")
+// or kv.New("grpc://host:9090?token=secret&tls=true"). kvserver itself serves
+// plain HTTP and gRPC, so tls=true needs a TLS terminating proxy in front of
+// it; insecure=true sends the token in the clear, e.g. on localhost.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/zatte/kv"
+	"github.com/zatte/kv/grpcserver"
+	"github.com/zatte/kv/kvpb"
+	"github.com/zatte/kv/readonly"
+	"github.com/zatte/kv/resp"
+	"github.com/zatte/kv/server"
+	"google.golang.org/grpc"
+)
+
+func main() {
+	var (
+		conn      = flag.String("db", os.Getenv("KV_DB"), "connection string, defaults to $KV_DB")
+		addr      = flag.String("addr", ":8080", "HTTP listen address")
+		grpcAddr  = flag.String("grpc-addr", "", "gRPC listen address, disabled if empty")
+		redisAddr = flag.String("redis-addr", "", "Redis protocol listen address, disabled if empty")
+		token     = flag.String("token", os.Getenv("KV_TOKEN"), "token required from clients (AUTH password for Redis), defaults to $KV_TOKEN")
+		readOnly  = flag.Bool("read-only", false, "reject all writes")
+		maxScan   = flag.Int("max-scan", server.DefaultMaxScanLimit, "maximum number of keys per scan page")
+	)
+	flag.Parse()
+	if *conn == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	db, err := kv.New(*conn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *readOnly {
+		db = readonly.New(db)
+	}
+
+	srv := &http.Server{
+		Addr:    *addr,
+		Handler: server.New(db, server.Options{Token: *token, MaxScanLimit: *maxScan}),
+	}
+
+	var gs *grpc.Server
+	if *grpcAddr != "" {
+		gsrv := grpcserver.New(db, grpcserver.Options{Token: *token})
+		gs = grpc.NewServer(gsrv.ServerOptions()...)
+		kvpb.RegisterKVServer(gs, gsrv)
+		lis, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("serving gRPC on %s", *grpcAddr)
+		go func() {
+			if err := gs.Serve(lis); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	var rs *resp.Server
+	if *redisAddr != "" {
+		rs = resp.New(db, resp.Options{Password: *token})
+		lis, err := net.Listen("tcp", *redisAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("serving Redis protocol on %s", *redisAddr)
+		go func() {
+			if err := rs.Serve(lis); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt)
+		<-sig
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if gs != nil {
+			gs.GracefulStop()
+		}
+		if rs != nil {
+			rs.Close()
+		}
+		srv.Shutdown(ctx)
+	}()
+
+	log.Printf("serving %s on %s", *conn, *addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,98 @@
+package compressed
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+
+	"github.com/DataDog/zstd"
+	"github.com/golang/snappy"
+)
+
+// Codec compresses values. The ID is stored after the Magic byte of every
+// compressed value and must be unique and stable; 0 is reserved for
+// uncompressed values.
+type Codec interface {
+	ID() byte
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+// Magic starts every value with a codec header. It can not start UTF-8 text,
+// JSON or a protobuf message, so most values written without the wrapper are
+// told apart from compressed ones.
+const Magic byte = 0xff
+
+// Header bytes of the built in codecs
+const (
+	RawID    byte = 0
+	GzipID   byte = 1
+	ZstdID   byte = 2
+	SnappyID byte = 3
+)
+
+var (
+	Gzip Codec = gzipCodec{gzip.DefaultCompression}
+	// Zstd is backed by github.com/DataDog/zstd and needs cgo
+	Zstd   Codec = zstdCodec{zstd.DefaultCompression}
+	Snappy Codec = snappyCodec{}
+)
+
+// builtinCodecs can always be read, regardless of the codec used for writing
+var builtinCodecs = []Codec{Gzip, Zstd, Snappy}
+
+type gzipCodec struct {
+	level int
+}
+
+func (c gzipCodec) ID() byte { return GzipID }
+
+func (c gzipCodec) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c gzipCodec) Decompress(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+type zstdCodec struct {
+	level int
+}
+
+func (c zstdCodec) ID() byte { return ZstdID }
+
+func (c zstdCodec) Compress(src []byte) ([]byte, error) {
+	return zstd.CompressLevel(nil, src, c.level)
+}
+
+func (c zstdCodec) Decompress(src []byte) ([]byte, error) {
+	return zstd.Decompress(nil, src)
+}
+
+type snappyCodec struct{}
+
+func (c snappyCodec) ID() byte { return SnappyID }
+
+func (c snappyCodec) Compress(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src), nil
+}
+
+func (c snappyCodec) Decompress(src []byte) ([]byte, error) {
+	return snappy.Decode(nil, src)
+}
@@ -0,0 +1,169 @@
+package compressed
+
+import (
+	"context"
+
+	"github.com/zatte/kv"
+)
+
+// DefaultThreshold is the smallest value size that is worth compressing
+const DefaultThreshold = 128
+
+// ErrUnknownCodec is returned when a value has a codec header without a matching codec
+const ErrUnknownCodec kv.KvError = "compressed: unknown codec"
+
+type CompressedDb struct {
+	kv.OrderedTransactional
+	compressor *compressor
+}
+
+type CompressedDbTransaction struct {
+	kv.OrderedTransaction
+	compressor *compressor
+}
+
+type CompressedDbIterator struct {
+	kv.Iterator
+	compressor *compressor
+}
+
+type compressor struct {
+	codec     Codec
+	codecs    map[byte]Codec
+	threshold int
+}
+
+// New creates a DB where values are compressed with codec. Values smaller than
+// threshold, or values that do not shrink, are stored raw. Compressed values
+// are prefixed with a Magic byte and a header byte naming the codec, so values
+// written with any of the built in codecs (or extra codecs passed as
+// readCodecs) read back correctly after the codec changes. Values without the
+// Magic byte, e.g. written before the wrapper was added, are read as is.
+func New(db kv.OrderedTransactional, codec Codec, threshold int, readCodecs ...Codec) *CompressedDb {
+	c := &compressor{
+		codec:     codec,
+		codecs:    map[byte]Codec{},
+		threshold: threshold,
+	}
+	for _, rc := range builtinCodecs {
+		c.codecs[rc.ID()] = rc
+	}
+	for _, rc := range readCodecs {
+		c.codecs[rc.ID()] = rc
+	}
+	if codec != nil {
+		c.codecs[codec.ID()] = codec
+	}
+	return &CompressedDb{db, c}
+}
+
+// NewFromStr creates a compressed DB. Supports all connections strings of kv.New()
+func NewFromStr(connectionString string, codec Codec, threshold int) (*CompressedDb, error) {
+	db, err := kv.New(connectionString)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(db, codec, threshold), nil
+}
+
+func (c *compressor) encode(value []byte) ([]byte, error) {
+	if c.codec != nil && len(value) >= c.threshold {
+		compressed, err := c.codec.Compress(value)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed)+2 < len(value) {
+			return append([]byte{Magic, c.codec.ID()}, compressed...), nil
+		}
+	}
+	// Raw values only need a header when they could be mistaken for one
+	if len(value) > 0 && value[0] == Magic {
+		return append([]byte{Magic, RawID}, value...), nil
+	}
+	return value, nil
+}
+
+func (c *compressor) decode(value []byte) ([]byte, error) {
+	if len(value) == 0 || value[0] != Magic {
+		return value, nil
+	}
+	if len(value) < 2 {
+		return nil, ErrUnknownCodec
+	}
+	if value[1] == RawID {
+		return value[2:], nil
+	}
+	codec, ok := c.codecs[value[1]]
+	if !ok {
+		return nil, ErrUnknownCodec
+	}
+	return codec.Decompress(value[2:])
+}
+
+// Get gets the value of a key within a single query transaction
+func (cdb *CompressedDb) Get(ctx context.Context, key []byte) (res []byte, err error) {
+	res, err = cdb.OrderedTransactional.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return cdb.compressor.decode(res)
+}
+
+// Put sets the value of a key within a single query transaction
+func (cdb *CompressedDb) Put(ctx context.Context, key, value []byte) error {
+	v, err := cdb.compressor.encode(value)
+	if err != nil {
+		return err
+	}
+	return cdb.OrderedTransactional.Put(ctx, key, v)
+}
+
+// NewTransaction for batching multiple values inside a transaction
+func (cdb *CompressedDb) NewTransaction(ctx context.Context, readOnly bool) (kv.OrderedTransaction, error) {
+	ot, err := cdb.OrderedTransactional.NewTransaction(ctx, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return &CompressedDbTransaction{ot, cdb.compressor}, nil
+}
+
+// Seek initializes an iterator at the given key (inclusive)
+func (tx *CompressedDbTransaction) Seek(ctx context.Context, StartKey []byte) (kv.Iterator, error) {
+	it, err := tx.OrderedTransaction.Seek(ctx, StartKey)
+	if err != nil {
+		return nil, err
+	}
+	return &CompressedDbIterator{it, tx.compressor}, nil
+}
+
+// Get gets the value of a key within the transaction
+func (tx *CompressedDbTransaction) Get(ctx context.Context, key []byte) (res []byte, err error) {
+	res, err = tx.OrderedTransaction.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return tx.compressor.decode(res)
+}
+
+// Put sets the value of a key within the transaction
+func (tx *CompressedDbTransaction) Put(ctx context.Context, key, value []byte) error {
+	v, err := tx.compressor.encode(value)
+	if err != nil {
+		return err
+	}
+	return tx.OrderedTransaction.Put(ctx, key, v)
+}
+
+// Next yields the next key-value in iterator with the value decompressed
+func (it *CompressedDbIterator) Next(ctx context.Context) (key, value []byte, err error) {
+	k, v, err := it.Iterator.Next(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	v, err = it.compressor.decode(v)
+	if err != nil {
+		return nil, nil, err
+	}
+	return k, v, nil
+}
@@ -0,0 +1,92 @@
+package compressed
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zatte/kv"
+)
+
+func TestCompressed(t *testing.T) {
+	ctx := context.Background()
+	raw, err := kv.New("badger:///?memory=true")
+	require.NoError(t, err)
+
+	large := bytes.Repeat([]byte(`{"field":"value"}`), 100)
+	small := []byte(`{}`)
+
+	for _, codec := range []Codec{Gzip, Zstd, Snappy} {
+		db := New(raw, codec, DefaultThreshold)
+		require.NoError(t, db.Put(ctx, []byte{'A', codec.ID()}, large))
+
+		stored, err := raw.Get(ctx, []byte{'A', codec.ID()})
+		require.NoError(t, err)
+		assert.Equal(t, []byte{Magic, codec.ID()}, stored[:2])
+		assert.Less(t, len(stored), len(large))
+
+		v, err := db.Get(ctx, []byte{'A', codec.ID()})
+		assert.NoError(t, err)
+		assert.Equal(t, large, v)
+	}
+
+	t.Run("small values are stored raw", func(t *testing.T) {
+		db := New(raw, Gzip, DefaultThreshold)
+		require.NoError(t, db.Put(ctx, []byte("B"), small))
+
+		stored, err := raw.Get(ctx, []byte("B"))
+		require.NoError(t, err)
+		assert.Equal(t, small, stored)
+
+		magic := []byte{Magic, 'x'}
+		require.NoError(t, db.Put(ctx, []byte("B2"), magic))
+		stored, err = raw.Get(ctx, []byte("B2"))
+		require.NoError(t, err)
+		assert.Equal(t, append([]byte{Magic, RawID}, magic...), stored)
+		v, err := db.Get(ctx, []byte("B2"))
+		require.NoError(t, err)
+		assert.Equal(t, magic, v)
+		require.NoError(t, raw.Delete(ctx, []byte("B2")))
+	})
+
+	t.Run("values written without the wrapper", func(t *testing.T) {
+		for _, legacy := range [][]byte{[]byte(`{"legacy":true}`), {RawID, 1}, {GzipID}} {
+			require.NoError(t, raw.Put(ctx, []byte("legacy"), legacy))
+			v, err := New(raw, Gzip, 0).Get(ctx, []byte("legacy"))
+			require.NoError(t, err)
+			assert.Equal(t, legacy, v)
+		}
+		require.NoError(t, raw.Delete(ctx, []byte("legacy")))
+	})
+
+	t.Run("mixed codecs read back after codec change", func(t *testing.T) {
+		db := New(raw, nil, 0)
+		tx, err := db.NewTransaction(ctx, true)
+		require.NoError(t, err)
+		defer tx.Discard(ctx)
+
+		it, err := tx.Seek(ctx, []byte("A"))
+		require.NoError(t, err)
+		defer it.Close()
+
+		values := 0
+		k, v, err := it.Next(ctx)
+		for ; err == nil; k, v, err = it.Next(ctx) {
+			if k[0] == 'A' {
+				assert.Equal(t, large, v)
+			} else {
+				assert.Equal(t, small, v)
+			}
+			values++
+		}
+		assert.Equal(t, 4, values)
+	})
+
+	t.Run("unknown codec", func(t *testing.T) {
+		require.NoError(t, raw.Put(ctx, []byte("C"), []byte{Magic, 0xf0, 1, 2}))
+		_, err := New(raw, Gzip, 0).Get(ctx, []byte("C"))
+		assert.EqualError(t, err, ErrUnknownCodec.Error())
+	})
+}
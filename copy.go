@@ -0,0 +1,247 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"sync"
+)
+
+// DefaultCopyBatchSize is the number of keys written per transaction by Copy
+const DefaultCopyBatchSize = 100
+
+// ErrChecksumMismatch is returned by a verified Copy when the destination does
+// not hold the same keys and values as the source.
+const ErrChecksumMismatch KvError = "checksum mismatch"
+
+// CopyOptions configures Copy. The zero value copies everything one batch at
+// a time without verification.
+type CopyOptions struct {
+	// Prefix limits the copy to keys starting with Prefix
+	Prefix []byte
+	// BatchSize is the number of keys written per transaction
+	BatchSize int
+	// Parallelism is the number of batches written concurrently
+	Parallelism int
+	// Progress is called after every written batch. With a Parallelism above
+	// 1 it is called concurrently from the writing goroutines.
+	Progress func(CopyStats)
+	// DryRun reads the source but writes nothing
+	DryRun bool
+	// Verify reads back every copied key from the destination and compares
+	// checksums of source and destination
+	Verify bool
+}
+
+// CopyStats reports the progress and result of Copy
+type CopyStats struct {
+	Keys  int64
+	Bytes int64
+	// Checksums are set by verified copies
+	SourceChecksum      string
+	DestinationChecksum string
+}
+
+type copyBatch struct {
+	keys   [][]byte
+	values [][]byte
+	bytes  int64
+}
+
+// Copy streams all key/values of src (optionally limited to a prefix) into
+// dst. Writes are batched into transactions when dst is transactional.
+// Batches are written concurrently without ordering guarantees between them.
+func Copy(ctx context.Context, src Ordered, dst Basic, opts CopyOptions) (CopyStats, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultCopyBatchSize
+	}
+	if opts.Parallelism <= 0 {
+		opts.Parallelism = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	batches := make(chan copyBatch)
+	var (
+		mu       sync.Mutex
+		stats    CopyStats
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		cancel()
+	}
+
+	for i := 0; i < opts.Parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range batches {
+				if !opts.DryRun {
+					if err := WriteBatch(ctx, dst, b.keys, b.values); err != nil {
+						fail(err)
+						continue
+					}
+				}
+				mu.Lock()
+				stats.Keys += int64(len(b.keys))
+				stats.Bytes += b.bytes
+				progress := stats
+				mu.Unlock()
+				if opts.Progress != nil {
+					opts.Progress(progress)
+				}
+			}
+		}()
+	}
+
+	err := scanPrefix(ctx, src, opts.Prefix, nil, opts.BatchSize, func(b copyBatch) error {
+		select {
+		case batches <- b:
+			return nil
+		case <-ctx.Done():
+			return contextErr(ctx)
+		}
+	})
+	close(batches)
+	wg.Wait()
+
+	if firstErr != nil {
+		return stats, firstErr
+	}
+	if err != nil {
+		return stats, err
+	}
+
+	if opts.Verify && !opts.DryRun {
+		srcSum, dstSum, err := checksums(ctx, src, dst, opts.Prefix)
+		if err != nil {
+			return stats, err
+		}
+		stats.SourceChecksum, stats.DestinationChecksum = srcSum, dstSum
+		if srcSum != dstSum {
+			return stats, ErrChecksumMismatch
+		}
+	}
+	return stats, nil
+}
+
+// scanPrefix iterates all keys of src starting with prefix and hands them
+// over in batches of batchSize copied key/values. each, if set, is called for
+// every key/value before it is added to a batch; a nil batch only calls each.
+func scanPrefix(ctx context.Context, src Ordered, prefix []byte, each func(key, value []byte) error, batchSize int, batch func(copyBatch) error) error {
+	it, err := src.Seek(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	b := copyBatch{}
+	for {
+		k, v, err := it.Next(ctx)
+		if err == ErrNotFound || (err == nil && !bytes.HasPrefix(k, prefix)) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if each != nil {
+			if err := each(k, v); err != nil {
+				return err
+			}
+		}
+		if batch == nil {
+			continue
+		}
+		b.keys = append(b.keys, append([]byte{}, k...))
+		b.values = append(b.values, append([]byte{}, v...))
+		b.bytes += int64(len(k) + len(v))
+		if len(b.keys) >= batchSize {
+			if err := batch(b); err != nil {
+				return err
+			}
+			b = copyBatch{}
+		}
+	}
+	if batch != nil && len(b.keys) > 0 {
+		return batch(b)
+	}
+	return nil
+}
+
+// WriteBatch puts all keys and values into dst within a single transaction
+// if dst supports transactions, otherwise one by one.
+func WriteBatch(ctx context.Context, dst Basic, keys, values [][]byte) error {
+	var tx BasicTransaction
+	var err error
+	switch d := dst.(type) {
+	case OrderedTransactional:
+		tx, err = d.NewTransaction(ctx, false)
+	case BasicTransactional:
+		tx, err = d.NewTransaction(ctx, false)
+	default:
+		for i, k := range keys {
+			if err := dst.Put(ctx, k, values[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer tx.Discard(ctx)
+
+	for i, k := range keys {
+		if err := tx.Put(ctx, k, values[i]); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// checksums hashes all key/values of src with the prefix and the values read
+// back from dst for the same keys.
+func checksums(ctx context.Context, src Ordered, dst Basic, prefix []byte) (string, string, error) {
+	srcHash, dstHash := sha256.New(), sha256.New()
+	err := scanPrefix(ctx, src, prefix, func(key, value []byte) error {
+		hashKeyValue(srcHash, key, value, true)
+		dv, err := dst.Get(ctx, key)
+		if err == ErrNotFound {
+			hashKeyValue(dstHash, key, nil, false)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		hashKeyValue(dstHash, key, dv, true)
+		return nil
+	}, 0, nil)
+	if err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(srcHash.Sum(nil)), hex.EncodeToString(dstHash.Sum(nil)), nil
+}
+
+// hashKeyValue adds a length prefixed key and value to h. A missing key hashes
+// differently from an empty value.
+func hashKeyValue(h hash.Hash, key, value []byte, found bool) {
+	var l [binary.MaxVarintLen64]byte
+	h.Write(l[:binary.PutUvarint(l[:], uint64(len(key)))])
+	h.Write(key)
+	if !found {
+		h.Write([]byte{0})
+		return
+	}
+	h.Write(l[:binary.PutUvarint(l[:], uint64(len(value))+1)])
+	h.Write(value)
+}
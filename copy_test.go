@@ -0,0 +1,91 @@
+package kv
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+
+	newDbs := func(t *testing.T) (OrderedTransaction, OrderedTransactional) {
+		src, err := New("badger:///?memory=true")
+		require.NoError(t, err)
+		dst, err := New("badger:///?memory=true")
+		require.NoError(t, err)
+		for i := 0; i < 250; i++ {
+			require.NoError(t, src.Put(ctx, []byte(fmt.Sprintf("a%03d", i)), []byte(fmt.Sprintf("v%d", i))))
+		}
+		require.NoError(t, src.Put(ctx, []byte("b"), []byte("other")))
+
+		tx, err := src.NewTransaction(ctx, true)
+		require.NoError(t, err)
+		t.Cleanup(func() { tx.Discard(ctx) })
+		return tx, dst
+	}
+
+	t.Run("prefix parallel verified", func(t *testing.T) {
+		src, dst := newDbs(t)
+
+		var mu sync.Mutex
+		var last CopyStats
+		stats, err := Copy(ctx, src, dst, CopyOptions{
+			Prefix:      []byte("a"),
+			BatchSize:   30,
+			Parallelism: 4,
+			Verify:      true,
+			Progress: func(s CopyStats) {
+				mu.Lock()
+				defer mu.Unlock()
+				if s.Keys > last.Keys {
+					last = s
+				}
+			},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, int64(250), stats.Keys)
+		assert.Equal(t, stats.Keys, last.Keys)
+		assert.NotEmpty(t, stats.SourceChecksum)
+		assert.Equal(t, stats.SourceChecksum, stats.DestinationChecksum)
+
+		v, err := dst.Get(ctx, []byte("a123"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte("v123"), v)
+		_, err = dst.Get(ctx, []byte("b"))
+		assert.Equal(t, ErrNotFound, err)
+	})
+
+	t.Run("dry run writes nothing", func(t *testing.T) {
+		src, dst := newDbs(t)
+
+		stats, err := Copy(ctx, src, dst, CopyOptions{DryRun: true, Verify: true})
+		require.NoError(t, err)
+		assert.Equal(t, int64(251), stats.Keys)
+
+		_, err = dst.Get(ctx, []byte("a000"))
+		assert.Equal(t, ErrNotFound, err)
+	})
+
+	t.Run("verify detects differences", func(t *testing.T) {
+		src, dst := newDbs(t)
+
+		_, err := Copy(ctx, src, dst, CopyOptions{})
+		require.NoError(t, err)
+		require.NoError(t, dst.Put(ctx, []byte("a010"), []byte("changed")))
+
+		_, err = Copy(ctx, src, &skipWrites{dst}, CopyOptions{Verify: true})
+		assert.Equal(t, ErrChecksumMismatch, err)
+	})
+}
+
+// skipWrites is a non-transactional Basic ignoring all writes
+type skipWrites struct {
+	Basic
+}
+
+func (skipWrites) Put(ctx context.Context, key, value []byte) error { return nil }
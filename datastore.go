@@ -2,27 +2,87 @@ package kv
 
 import (
 	"context"
+	"encoding/hex"
 	"net/url"
+	"time"
 
 	"cloud.google.com/go/datastore"
 	"google.golang.org/api/iterator"
 )
 
-const DataStoreKind = "keyvalue"
+// DataStoreKind is the kind of the stored keys. Datastore key names are
+// strings; keys are hex encoded to be able to store any byte sequence. Lower
+// case hex preserves the byte-wise sort order of the keys.
+const DataStoreKind = "keyvalue_hex"
 
+// DataStoreLegacyKind is the kind of entities written before keys were hex
+// encoded, named by the raw key. They live apart from DataStoreKind, where a
+// raw name could be taken for the encoding of another key, and must be moved
+// with MigrateKeys before they are visible again.
+const DataStoreLegacyKind = "keyvalue"
+
+// datastoreMigrateBatch keeps each migration commit below the 500 mutations limit
+const datastoreMigrateBatch = 250
+
+// datastoreDeleteBatch is the most keys a single DeleteMulti accepts
+const datastoreDeleteBatch = 500
+
+// datastoreKeyValue.Version counts the writes of a key, starting at 1 when it
+// is created. Entities written before versions were introduced have version 0
+// and are reported as version 1.
 type datastoreKeyValue struct {
-	Key *datastore.Key `datastore:"__key__"`
-	Val []byte         `datastore:"val,noindex"`
+	Key     *datastore.Key `datastore:"__key__"`
+	Val     []byte         `datastore:"val,noindex"`
+	Version int64          `datastore:"ver,noindex"`
+}
+
+// nextDatastoreKeyValue reads the entity at k within tx and returns the entity
+// replacing it with value and the next version
+func nextDatastoreKeyValue(tx *datastore.Transaction, k *datastore.Key, value []byte) (*datastoreKeyValue, error) {
+	e := &datastoreKeyValue{}
+	var version int64
+	switch err := tx.Get(k, e); err {
+	case nil:
+		version = int64(e.version())
+	case datastore.ErrNoSuchEntity:
+	default:
+		return nil, err
+	}
+	return &datastoreKeyValue{Key: k, Val: value, Version: version + 1}, nil
+}
+
+func (e *datastoreKeyValue) version() uint64 {
+	if e.Version <= 0 {
+		return 1
+	}
+	return uint64(e.Version)
+}
+
+func datastoreKey(key []byte) *datastore.Key {
+	return datastore.NameKey(DataStoreKind, hex.EncodeToString(key), nil)
+}
+
+// datastoreMigratedKey returns the key a legacy entity is migrated to
+func datastoreMigratedKey(legacy *datastore.Key) *datastore.Key {
+	return datastoreKey([]byte(legacy.Name))
+}
+
+func datastoreKeyBytes(k *datastore.Key) ([]byte, error) {
+	return hex.DecodeString(k.Name)
 }
 
 type DatastoreDB struct {
 	*datastore.Client
-	cancel func()
+	cancel  func()
+	history HistoryOptions
 }
 
 type datastoreTransaction struct {
 	*datastore.Transaction
 	*datastore.Client
+	readOnly bool
+	db       *DatastoreDB
+	written  []*datastore.Key // keys with revisions to prune after commit
 }
 
 type datastoreIterator struct {
@@ -30,7 +90,17 @@ type datastoreIterator struct {
 }
 
 func NewDatastoreDbFromUrl(u *url.URL) (*DatastoreDB, error) {
-	ctx, cancel := context.WithCancel(context.Background())
+	return NewDatastoreDbFromUrlWithContext(context.Background(), u)
+}
+
+// NewDatastoreDbFromUrlWithContext creates the datastore client with ctx
+// instead of a background context. The client must not be used once ctx is done.
+func NewDatastoreDbFromUrlWithContext(ctx context.Context, u *url.URL) (*DatastoreDB, error) {
+	history, err := historyOptionsFromUrl(u)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
 
 	// Create a datastore client. In a typical application, you would create
 	// a single client which is reused for every datastore operation.
@@ -40,7 +110,7 @@ func NewDatastoreDbFromUrl(u *url.URL) (*DatastoreDB, error) {
 		return nil, err
 	}
 
-	return &DatastoreDB{dsClient, cancel}, nil
+	return &DatastoreDB{dsClient, cancel, history}, nil
 }
 
 // datastore db
@@ -53,55 +123,318 @@ func (dsDb *DatastoreDB) Close() error {
 
 // Get gets the value of a key within a single query transaction
 func (dsDb *DatastoreDB) Get(ctx context.Context, key []byte) (res []byte, err error) {
-	k := datastore.NameKey(DataStoreKind, string(key), nil)
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	k := datastoreKey(key)
 	e := &datastoreKeyValue{}
 	if err := dsDb.Client.Get(ctx, k, e); err != nil {
 		if err == datastore.ErrNoSuchEntity {
 			err = ErrNotFound
 		}
-		return nil, err
+		return nil, backendErr(ctx, err)
 	}
 	return []byte(e.Val), err
 }
 
 // Put sets the value of a key within a single query transaction
 func (dsDb *DatastoreDB) Put(ctx context.Context, key, value []byte) error {
-	k := datastore.NameKey(DataStoreKind, string(key), nil)
-	e := &datastoreKeyValue{
-		Key: k,
-		Val: value,
+	if err := contextErr(ctx); err != nil {
+		return err
 	}
-	if _, err := dsDb.Client.Put(ctx, k, e); err != nil {
-		if err == datastore.ErrNoSuchEntity {
-			err = ErrNotFound
+	k := datastoreKey(key)
+	// the entity is read to increment its version
+	_, err := dsDb.Client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		e, err := nextDatastoreKeyValue(tx, k, value)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Put(k, e); err != nil {
+			return err
+		}
+		if dsDb.history.Enabled() {
+			rev := newDatastoreRevision(k, value, false, time.Now().UnixNano())
+			_, err = tx.Put(rev.Key, rev)
 		}
 		return err
+	})
+	if err == nil && dsDb.history.Enabled() {
+		err = dsDb.prune(ctx, k)
+	}
+	if err != nil {
+		if err == datastore.ErrConcurrentTransaction {
+			err = ErrConflict
+		}
+		return backendErr(ctx, err)
 	}
 	return nil
 }
 
 // Delete removes a key within a single transaction
 func (dsDb *DatastoreDB) Delete(ctx context.Context, key []byte) error {
-	k := datastore.NameKey(DataStoreKind, string(key), nil)
-	if err := dsDb.Client.Delete(ctx, k); err != nil {
+	if err := contextErr(ctx); err != nil {
+		return err
+	}
+	k := datastoreKey(key)
+	var err error
+	if dsDb.history.Enabled() {
+		rev := newDatastoreRevision(k, nil, true, time.Now().UnixNano())
+		if _, err = dsDb.Client.Mutate(ctx, datastore.NewDelete(k), datastore.NewUpsert(rev.Key, rev)); err == nil {
+			err = dsDb.prune(ctx, k)
+		}
+	} else {
+		err = dsDb.Client.Delete(ctx, k)
+	}
+	if err != nil {
 		if err == datastore.ErrNoSuchEntity {
 			err = ErrNotFound
 		}
-		return err
+		return backendErr(ctx, err)
 	}
 	return nil
 }
 
+// DeleteRange deletes all keys in [start, end) by running key-only queries of
+// datastoreDeleteBatch keys and deleting each page with DeleteMulti
+func (dsDb *DatastoreDB) DeleteRange(ctx context.Context, start, end []byte) (int64, error) {
+	var deleted int64
+	for {
+		if err := contextErr(ctx); err != nil {
+			return deleted, err
+		}
+		query := datastore.NewQuery(DataStoreKind).KeysOnly().Order("__key__").Limit(datastoreDeleteBatch)
+		if len(start) > 0 {
+			query = query.Filter("__key__ >=", datastoreKey(start))
+		}
+		if end != nil {
+			query = query.Filter("__key__ <", datastoreKey(end))
+		}
+		keys, err := dsDb.Client.GetAll(ctx, query, nil)
+		if err != nil {
+			return deleted, backendErr(ctx, err)
+		}
+		if len(keys) == 0 {
+			return deleted, nil
+		}
+		if dsDb.history.Enabled() {
+			// the deletion of every key is recorded in the history
+			now := time.Now().UnixNano()
+			revs := make([]*datastoreRevision, len(keys))
+			revKeys := make([]*datastore.Key, len(keys))
+			for i, k := range keys {
+				revs[i] = newDatastoreRevision(k, nil, true, now)
+				revKeys[i] = revs[i].Key
+			}
+			if _, err := dsDb.Client.PutMulti(ctx, revKeys, revs); err != nil {
+				return deleted, backendErr(ctx, err)
+			}
+		}
+		if err := dsDb.Client.DeleteMulti(ctx, keys); err != nil {
+			return deleted, backendErr(ctx, err)
+		}
+		deleted += int64(len(keys))
+		if len(keys) < datastoreDeleteBatch {
+			return deleted, nil
+		}
+	}
+}
+
+// GetWithVersion returns the value of a key and the number of its writes as
+// version. Versions restart at 1 when a key is deleted and written again.
+func (dsDb *DatastoreDB) GetWithVersion(ctx context.Context, key []byte) ([]byte, uint64, error) {
+	if err := contextErr(ctx); err != nil {
+		return nil, VersionNotExist, err
+	}
+	e := &datastoreKeyValue{}
+	if err := dsDb.Client.Get(ctx, datastoreKey(key), e); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			err = ErrNotFound
+		}
+		return nil, VersionNotExist, backendErr(ctx, err)
+	}
+	return e.Val, e.version(), nil
+}
+
+// PutIfVersion sets the value of a key if its version is expectedVersion,
+// checked in a transaction
+func (dsDb *DatastoreDB) PutIfVersion(ctx context.Context, key, value []byte, expectedVersion uint64) error {
+	if err := contextErr(ctx); err != nil {
+		return err
+	}
+	k := datastoreKey(key)
+	_, err := dsDb.Client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		e, err := nextDatastoreKeyValue(tx, k, value)
+		if err != nil {
+			return err
+		}
+		if uint64(e.Version-1) != expectedVersion {
+			return ErrVersionMismatch
+		}
+		if _, err := tx.Put(k, e); err != nil {
+			return err
+		}
+		if dsDb.history.Enabled() {
+			rev := newDatastoreRevision(k, value, false, time.Now().UnixNano())
+			_, err = tx.Put(rev.Key, rev)
+		}
+		return err
+	})
+	switch err {
+	case ErrVersionMismatch:
+		return err
+	case datastore.ErrConcurrentTransaction:
+		// the key was written since it was read
+		return ErrVersionMismatch
+	case nil:
+		if dsDb.history.Enabled() {
+			err = dsDb.prune(ctx, k)
+		}
+	}
+	return backendErr(ctx, err)
+}
+
+// DeleteIfVersion removes a key if its version is expectedVersion, checked in
+// a transaction
+func (dsDb *DatastoreDB) DeleteIfVersion(ctx context.Context, key []byte, expectedVersion uint64) error {
+	if err := contextErr(ctx); err != nil {
+		return err
+	}
+	k := datastoreKey(key)
+	_, err := dsDb.Client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		version := VersionNotExist
+		e := &datastoreKeyValue{}
+		err := tx.Get(k, e)
+		switch {
+		case err == nil:
+			version = e.version()
+		case err != datastore.ErrNoSuchEntity:
+			return err
+		}
+		if version != expectedVersion {
+			return ErrVersionMismatch
+		}
+		if version == VersionNotExist {
+			return nil
+		}
+		if err := tx.Delete(k); err != nil {
+			return err
+		}
+		if dsDb.history.Enabled() {
+			rev := newDatastoreRevision(k, nil, true, time.Now().UnixNano())
+			_, err = tx.Put(rev.Key, rev)
+		}
+		return err
+	})
+	switch err {
+	case ErrVersionMismatch:
+		return err
+	case datastore.ErrConcurrentTransaction:
+		// the key was written since it was read
+		return ErrVersionMismatch
+	case nil:
+		if dsDb.history.Enabled() {
+			err = dsDb.prune(ctx, k)
+		}
+	}
+	return backendErr(ctx, err)
+}
+
+// MigrateKeys moves entities of DataStoreLegacyKind, named by the raw key, to
+// DataStoreKind with hex encoded key names. It is safe to run multiple times
+// and returns the number of migrated entities.
+func (dsDb *DatastoreDB) MigrateKeys(ctx context.Context) (int, error) {
+	it := dsDb.Client.Run(ctx, datastore.NewQuery(DataStoreLegacyKind))
+	migrated := 0
+	var batch []*datastoreKeyValue
+	for {
+		e := &datastoreKeyValue{}
+		_, err := it.Next(e)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return migrated, err
+		}
+		batch = append(batch, e)
+		if len(batch) >= datastoreMigrateBatch {
+			if err := dsDb.migrateBatch(ctx, batch); err != nil {
+				return migrated, err
+			}
+			migrated += len(batch)
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		if err := dsDb.migrateBatch(ctx, batch); err != nil {
+			return migrated, err
+		}
+		migrated += len(batch)
+	}
+	return migrated, nil
+}
+
+func (dsDb *DatastoreDB) migrateBatch(ctx context.Context, batch []*datastoreKeyValue) error {
+	oldKeys := make([]*datastore.Key, len(batch))
+	newKeys := make([]*datastore.Key, len(batch))
+	entities := make([]*datastoreKeyValue, len(batch))
+	for i, e := range batch {
+		oldKeys[i] = e.Key
+		newKeys[i] = datastoreMigratedKey(e.Key)
+		entities[i] = &datastoreKeyValue{Key: newKeys[i], Val: e.Val, Version: 1}
+	}
+	_, err := dsDb.Client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		// values written with the new encoding after the upgrade take precedence
+		existing := make([]*datastoreKeyValue, len(newKeys))
+		for i := range existing {
+			existing[i] = &datastoreKeyValue{}
+		}
+		var putKeys []*datastore.Key
+		var putEntities []*datastoreKeyValue
+		err := tx.GetMulti(newKeys, existing)
+		merr, isMulti := err.(datastore.MultiError)
+		if err != nil && !isMulti {
+			return err
+		}
+		for i := range newKeys {
+			if err == nil || merr[i] == nil {
+				continue
+			}
+			if merr[i] != datastore.ErrNoSuchEntity {
+				return merr[i]
+			}
+			putKeys = append(putKeys, newKeys[i])
+			putEntities = append(putEntities, entities[i])
+		}
+		if len(putKeys) > 0 {
+			if _, err := tx.PutMulti(putKeys, putEntities); err != nil {
+				return err
+			}
+		}
+		return tx.DeleteMulti(oldKeys)
+	})
+	return err
+}
+
 // NewTransaction for batching multiple values inside a transaction
 func (dsDb *DatastoreDB) NewTransaction(ctx context.Context, readOnly bool) (OrderedTransaction, error) {
-	tx, err := dsDb.Client.NewTransaction(ctx)
-	if err != nil {
+	if err := contextErr(ctx); err != nil {
 		return nil, err
 	}
+	var opts []datastore.TransactionOption
+	if readOnly {
+		opts = append(opts, datastore.ReadOnly)
+	}
+	tx, err := dsDb.Client.NewTransaction(ctx, opts...)
+	if err != nil {
+		return nil, backendErr(ctx, err)
+	}
 
 	return &datastoreTransaction{
 		tx,
 		dsDb.Client, // save for iterators later on
+		readOnly,
+		dsDb,
+		nil,
 	}, nil
 }
 
@@ -115,47 +448,77 @@ func (dsDb *datastoreTransaction) Close() error {
 
 // Get gets the value of a key within a single query transaction
 func (dsDb *datastoreTransaction) Get(ctx context.Context, key []byte) (res []byte, err error) {
-	k := datastore.NameKey(DataStoreKind, string(key), nil)
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	k := datastoreKey(key)
 	e := &datastoreKeyValue{}
 	if err := dsDb.Transaction.Get(k, e); err != nil {
 		if err == datastore.ErrNoSuchEntity {
 			err = ErrNotFound
 		}
-		return nil, err
+		return nil, backendErr(ctx, err)
 	}
 	return []byte(e.Val), err
 }
 
 // Put sets the value of a key within a single query transaction
 func (dsDb *datastoreTransaction) Put(ctx context.Context, key, value []byte) error {
-	k := datastore.NameKey(DataStoreKind, string(key), nil)
-	e := &datastoreKeyValue{
-		Key: k,
-		Val: value,
+	if err := contextErr(ctx); err != nil {
+		return err
+	}
+	if dsDb.readOnly {
+		return ErrReadOnly
+	}
+	k := datastoreKey(key)
+	e, err := nextDatastoreKeyValue(dsDb.Transaction, k, value)
+	if err != nil {
+		return backendErr(ctx, err)
 	}
 	if _, err := dsDb.Transaction.Put(k, e); err != nil {
 		if err == datastore.ErrNoSuchEntity {
 			err = ErrNotFound
 		}
-		return err
+		return backendErr(ctx, err)
+	}
+	return dsDb.record(ctx, newDatastoreRevision(k, value, false, time.Now().UnixNano()))
+}
+
+// record adds a revision to the transaction in history mode
+func (dsDb *datastoreTransaction) record(ctx context.Context, rev *datastoreRevision) error {
+	if !dsDb.db.history.Enabled() {
+		return nil
 	}
+	if _, err := dsDb.Transaction.Put(rev.Key, rev); err != nil {
+		return backendErr(ctx, err)
+	}
+	dsDb.written = append(dsDb.written, rev.Key.Parent)
 	return nil
 }
 
 // Delete removes a key within a single transaction
 func (dsDb *datastoreTransaction) Delete(ctx context.Context, key []byte) error {
-	k := datastore.NameKey(DataStoreKind, string(key), nil)
+	if err := contextErr(ctx); err != nil {
+		return err
+	}
+	if dsDb.readOnly {
+		return ErrReadOnly
+	}
+	k := datastoreKey(key)
 	if err := dsDb.Transaction.Delete(k); err != nil {
 		if err == datastore.ErrNoSuchEntity {
 			err = ErrNotFound
 		}
-		return err
+		return backendErr(ctx, err)
 	}
-	return nil
+	return dsDb.record(ctx, newDatastoreRevision(k, nil, true, time.Now().UnixNano()))
 }
 
 func (dsDb *datastoreTransaction) Seek(ctx context.Context, StartKey []byte) (Iterator, error) {
-	k := datastore.NameKey(DataStoreKind, string(StartKey), nil)
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	k := datastoreKey(StartKey)
 	query := datastore.NewQuery(DataStoreKind).
 		Filter("__key__ >=", k).
 		Order("__key__") //.Transaction(dsDb.Transaction)
@@ -172,23 +535,42 @@ func (dsDb *datastoreTransaction) Discard(ctx context.Context) error {
 
 // Commit persists all side effects of the transaction and returns an error if there are any conflics
 func (dsDb *datastoreTransaction) Commit(ctx context.Context) error {
+	if err := contextErr(ctx); err != nil {
+		return err
+	}
 	_, err := dsDb.Transaction.Commit()
-	return err
+	if err == datastore.ErrConcurrentTransaction {
+		err = ErrConflict
+	}
+	for _, k := range dsDb.written {
+		if err != nil {
+			break
+		}
+		err = dsDb.db.prune(ctx, k)
+	}
+	return backendErr(ctx, err)
 }
 
 // datastoreIterator
 
 // Next yeilds the next key-value in iterator. Key-values can not be re-used between iterations. Make sure top copy the values if you must.
 func (it *datastoreIterator) Next(ctx context.Context) (key, value []byte, err error) {
+	if err := contextErr(ctx); err != nil {
+		return nil, nil, err
+	}
 	kv := &datastoreKeyValue{}
 	_, err = it.Iterator.Next(kv)
 	if err == iterator.Done {
 		return nil, nil, ErrNotFound
 	}
+	if err != nil {
+		return nil, nil, backendErr(ctx, err)
+	}
+	key, err = datastoreKeyBytes(kv.Key)
 	if err != nil {
 		return nil, nil, err
 	}
-	return []byte(kv.Key.String()), kv.Val, nil
+	return key, kv.Val, nil
 }
 
 // Close must always be called to clean up iterators.
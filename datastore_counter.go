@@ -0,0 +1,96 @@
+package kv
+
+import (
+	"context"
+	"encoding/hex"
+	"math/rand"
+	"strconv"
+
+	"cloud.google.com/go/datastore"
+)
+
+// DataStoreCounterKind is the kind of the shards of sharded counters
+const DataStoreCounterKind = "keyvalue_counter"
+
+type datastoreCounterShard struct {
+	N int64 `datastore:"n,noindex"`
+}
+
+// DatastoreShardedCounter spreads the writes of a hot counter over several
+// entities. Datastore sustains roughly one write per second to a single
+// entity; a counter with n shards sustains about n. Adding only touches one
+// random shard, reading the value sums all of them.
+//
+// Shards are stored under their own kind and are not visible through Get or
+// Seek of the store.
+type DatastoreShardedCounter struct {
+	client *datastore.Client
+	keys   []*datastore.Key
+}
+
+// ShardedCounter returns the counter at key with the given number of shards.
+// The number of shards of a counter may be increased later but never
+// decreased, as the value of the dropped shards would be lost.
+func (dsDb *DatastoreDB) ShardedCounter(key []byte, shards int) *DatastoreShardedCounter {
+	if shards < 1 {
+		shards = 1
+	}
+	keys := make([]*datastore.Key, shards)
+	for i := range keys {
+		keys[i] = datastore.NameKey(DataStoreCounterKind, hex.EncodeToString(key)+"/"+strconv.Itoa(i), nil)
+	}
+	return &DatastoreShardedCounter{dsDb.Client, keys}
+}
+
+// Add adds delta to a random shard of the counter
+func (c *DatastoreShardedCounter) Add(ctx context.Context, delta int64) error {
+	if err := contextErr(ctx); err != nil {
+		return err
+	}
+	k := c.keys[rand.Intn(len(c.keys))]
+	_, err := c.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		shard := &datastoreCounterShard{}
+		if err := tx.Get(k, shard); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		shard.N += delta
+		_, err := tx.Put(k, shard)
+		return err
+	})
+	if err == datastore.ErrConcurrentTransaction {
+		err = ErrConflict
+	}
+	return backendErr(ctx, err)
+}
+
+// Value returns the sum of all shards of the counter
+func (c *DatastoreShardedCounter) Value(ctx context.Context) (int64, error) {
+	if err := contextErr(ctx); err != nil {
+		return 0, err
+	}
+	shards := make([]datastoreCounterShard, len(c.keys))
+	if err := c.client.GetMulti(ctx, c.keys, shards); err != nil {
+		merr, ok := err.(datastore.MultiError)
+		if !ok {
+			return 0, backendErr(ctx, err)
+		}
+		for _, err := range merr {
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return 0, backendErr(ctx, err)
+			}
+		}
+	}
+	var n int64
+	for _, s := range shards {
+		n += s.N
+	}
+	return n, nil
+}
+
+// Reset deletes all shards, setting the counter to 0
+func (c *DatastoreShardedCounter) Reset(ctx context.Context) error {
+	if err := contextErr(ctx); err != nil {
+		return err
+	}
+	return backendErr(ctx, c.client.DeleteMulti(ctx, c.keys))
+}
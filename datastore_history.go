@@ -0,0 +1,97 @@
+package kv
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// DataStoreHistoryKind is the kind of the revisions recorded in history mode.
+// Revisions are children of the entity of their key, with the time of the
+// write in unix nanoseconds as ID.
+const DataStoreHistoryKind = "keyvalue_history"
+
+type datastoreRevision struct {
+	Key     *datastore.Key `datastore:"__key__"`
+	Val     []byte         `datastore:"val,noindex"`
+	Deleted bool           `datastore:"deleted,noindex"`
+}
+
+func newDatastoreRevision(k *datastore.Key, value []byte, deleted bool, ts int64) *datastoreRevision {
+	return &datastoreRevision{
+		Key:     datastore.IDKey(DataStoreHistoryKind, ts, k),
+		Val:     value,
+		Deleted: deleted,
+	}
+}
+
+// revisionKeys returns the keys of the revisions of k, oldest first
+func (dsDb *DatastoreDB) revisionKeys(ctx context.Context, k *datastore.Key) ([]*datastore.Key, error) {
+	query := datastore.NewQuery(DataStoreHistoryKind).Ancestor(k).KeysOnly()
+	return dsDb.Client.GetAll(ctx, query, nil)
+}
+
+// prune deletes the revisions of k no longer retained
+func (dsDb *DatastoreDB) prune(ctx context.Context, k *datastore.Key) error {
+	keys, err := dsDb.revisionKeys(ctx, k)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var drop []*datastore.Key
+	for i := range keys {
+		rk := keys[len(keys)-1-i]
+		if !dsDb.history.keep(i, time.Unix(0, rk.ID), now) {
+			drop = append(drop, rk)
+		}
+	}
+	if len(drop) == 0 {
+		return nil
+	}
+	return dsDb.Client.DeleteMulti(ctx, drop)
+}
+
+// revisions loads the retained revisions of key, newest first
+func (dsDb *DatastoreDB) revisions(ctx context.Context, key []byte) ([]Revision, error) {
+	var rows []datastoreRevision
+	query := datastore.NewQuery(DataStoreHistoryKind).Ancestor(datastoreKey(key))
+	if _, err := dsDb.Client.GetAll(ctx, query, &rows); err != nil {
+		return nil, backendErr(ctx, err)
+	}
+	revs := make([]Revision, len(rows))
+	for i, r := range rows {
+		revs[len(rows)-1-i] = Revision{Value: r.Val, Time: time.Unix(0, r.Key.ID), Deleted: r.Deleted}
+	}
+	return revs, nil
+}
+
+// GetAt returns the value key had at ts from the recorded revisions
+func (dsDb *DatastoreDB) GetAt(ctx context.Context, key []byte, ts time.Time) ([]byte, error) {
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	if !dsDb.history.Enabled() {
+		return nil, ErrHistoryDisabled
+	}
+	revs, err := dsDb.revisions(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return revisionAt(revs, ts)
+}
+
+// History iterates the recorded revisions of key
+func (dsDb *DatastoreDB) History(ctx context.Context, key []byte) (HistoryIterator, error) {
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	if !dsDb.history.Enabled() {
+		return nil, ErrHistoryDisabled
+	}
+	revs, err := dsDb.revisions(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &revisionIterator{revs}, nil
+}
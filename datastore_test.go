@@ -0,0 +1,56 @@
+package kv
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatastoreKeyEncoding(t *testing.T) {
+	keys := [][]byte{
+		[]byte("A0"),
+		[]byte("A01"),
+		{0xff, 0xfe, 0x00},
+		{0x00},
+		{0x00, 0x00},
+		[]byte("B"),
+		{0xc3, 0x28}, // invalid utf-8
+	}
+
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		dk := datastoreKey(k)
+		assert.Equal(t, DataStoreKind, dk.Kind)
+		names[i] = dk.Name
+
+		decoded, err := datastoreKeyBytes(dk)
+		require.NoError(t, err)
+		assert.Equal(t, k, decoded)
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	sort.Strings(names)
+	for i, k := range keys {
+		assert.Equal(t, datastoreKey(k).Name, names[i], "encoding must preserve sort order")
+	}
+}
+
+func TestDatastoreLegacyKeys(t *testing.T) {
+	// a legacy raw name that is valid hex must not be taken for the encoding
+	// of another key
+	legacy := datastore.NameKey(DataStoreLegacyKind, "4130", nil)
+	encoded := datastoreKey([]byte("A0"))
+	assert.Equal(t, "4130", encoded.Name)
+	assert.False(t, legacy.Equal(encoded))
+
+	migrated := datastoreMigratedKey(legacy)
+	assert.False(t, migrated.Equal(legacy), "migration must not write the key it deletes")
+	assert.False(t, migrated.Equal(encoded))
+	decoded, err := datastoreKeyBytes(migrated)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("4130"), decoded)
+}
@@ -0,0 +1,382 @@
+package kv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// A dump starts with a header, continues with one record per key/value in key
+// order and ends with a trailer holding the number of records and optionally
+// their sha256 checksum. A dump without trailer is truncated.
+//
+// JSONL dumps have one JSON object per line: the header, then records as
+// {"k":"<base64 key>","v":"<base64 value>"} and finally {"trailer":{...}}.
+//
+// Binary dumps start with the magic "KVDUMP\n" followed by the header as a
+// length prefixed JSON object. Records are uvarint(len(key)+1), key,
+// uvarint(len(value)), value. A single 0 byte ends the records and is followed
+// by the length prefixed JSON trailer. All lengths are uvarints.
+
+// DumpVersion is the version of the dump format written by Export
+const DumpVersion = 1
+
+// DumpFormat is the encoding of the records of a dump
+type DumpFormat string
+
+const (
+	DumpJSONL  DumpFormat = "jsonl"
+	DumpBinary DumpFormat = "binary"
+)
+
+// ErrInvalidDump is returned when a dump can not be read
+const ErrInvalidDump KvError = "invalid dump"
+
+var dumpMagic = []byte("KVDUMP\n")
+
+// maxDumpField is the largest key, value or metadata length accepted by Import
+const maxDumpField = 1 << 30
+
+// DumpHeader describes a dump
+type DumpHeader struct {
+	Version  int               `json:"version"`
+	Format   DumpFormat        `json:"format"`
+	Created  time.Time         `json:"created"`
+	Prefix   []byte            `json:"prefix,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// DumpTrailer ends a dump
+type DumpTrailer struct {
+	Count  int64  `json:"count"`
+	Sha256 string `json:"sha256,omitempty"`
+}
+
+// ExportOptions configures Export. The zero value writes all keys as JSONL
+// without checksum.
+type ExportOptions struct {
+	Format DumpFormat
+	// Prefix limits the dump to keys starting with Prefix
+	Prefix []byte
+	// Checksum adds a sha256 of all records to the trailer
+	Checksum bool
+	// Metadata is stored in the header
+	Metadata map[string]string
+}
+
+// ImportOptions configures Import
+type ImportOptions struct {
+	// BatchSize is the number of keys written per transaction
+	BatchSize int
+	// FromPrefix and ToPrefix remap keys: only records starting with FromPrefix
+	// are imported, with FromPrefix replaced by ToPrefix.
+	FromPrefix []byte
+	ToPrefix   []byte
+}
+
+type dumpRecord struct {
+	Key     []byte       `json:"k,omitempty"`
+	Value   []byte       `json:"v,omitempty"`
+	Trailer *DumpTrailer `json:"trailer,omitempty"`
+}
+
+// Export writes all key/values of src (optionally limited to a prefix) to w as
+// a dump. The writes to w are buffered.
+func Export(ctx context.Context, src Ordered, w io.Writer, opts ExportOptions) (DumpTrailer, error) {
+	if opts.Format == "" {
+		opts.Format = DumpJSONL
+	}
+	bw := bufio.NewWriter(w)
+	var enc dumpEncoder
+	switch opts.Format {
+	case DumpJSONL:
+		enc = &jsonlEncoder{json.NewEncoder(bw)}
+	case DumpBinary:
+		enc = &binaryEncoder{bw}
+	default:
+		return DumpTrailer{}, fmt.Errorf("%w: unknown format %q", ErrInvalidDump, opts.Format)
+	}
+
+	header := DumpHeader{DumpVersion, opts.Format, time.Now().UTC(), opts.Prefix, opts.Metadata}
+	if err := enc.header(header); err != nil {
+		return DumpTrailer{}, err
+	}
+
+	trailer := DumpTrailer{}
+	h := sha256.New()
+	err := scanPrefix(ctx, src, opts.Prefix, func(key, value []byte) error {
+		trailer.Count++
+		if opts.Checksum {
+			hashKeyValue(h, key, value, true)
+		}
+		return enc.record(key, value)
+	}, 0, nil)
+	if err != nil {
+		return trailer, err
+	}
+
+	if opts.Checksum {
+		trailer.Sha256 = hex.EncodeToString(h.Sum(nil))
+	}
+	if err := enc.trailer(trailer); err != nil {
+		return trailer, err
+	}
+	return trailer, bw.Flush()
+}
+
+// Import reads a dump of any format from r and writes its records to dst in
+// batches. The checksum is verified once all records are read, so a corrupt
+// dump may have been partially imported when ErrChecksumMismatch is returned.
+func Import(ctx context.Context, r io.Reader, dst Basic, opts ImportOptions) (DumpHeader, DumpTrailer, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultCopyBatchSize
+	}
+
+	br := bufio.NewReader(r)
+	var dec dumpDecoder
+	if magic, _ := br.Peek(len(dumpMagic)); bytes.Equal(magic, dumpMagic) {
+		br.Discard(len(dumpMagic))
+		dec = &binaryDecoder{br}
+	} else {
+		dec = &jsonlDecoder{json.NewDecoder(br)}
+	}
+
+	header, err := dec.header()
+	if err != nil {
+		return header, DumpTrailer{}, err
+	}
+	if header.Version < 1 || header.Version > DumpVersion {
+		return header, DumpTrailer{}, fmt.Errorf("%w: unsupported version %d", ErrInvalidDump, header.Version)
+	}
+
+	var keys, values [][]byte
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		if err := WriteBatch(ctx, dst, keys, values); err != nil {
+			return err
+		}
+		keys, values = nil, nil
+		return nil
+	}
+
+	h := sha256.New()
+	count := int64(0)
+	for {
+		if err := contextErr(ctx); err != nil {
+			return header, DumpTrailer{}, err
+		}
+		rec, err := dec.next()
+		if err == io.EOF {
+			return header, DumpTrailer{}, fmt.Errorf("%w: truncated after %d records", ErrInvalidDump, count)
+		}
+		if err != nil {
+			return header, DumpTrailer{}, err
+		}
+		if rec.Trailer != nil {
+			if err := flush(); err != nil {
+				return header, *rec.Trailer, err
+			}
+			if rec.Trailer.Count != count {
+				return header, *rec.Trailer, fmt.Errorf("%w: expected %d records, read %d", ErrInvalidDump, rec.Trailer.Count, count)
+			}
+			if rec.Trailer.Sha256 != "" && rec.Trailer.Sha256 != hex.EncodeToString(h.Sum(nil)) {
+				return header, *rec.Trailer, ErrChecksumMismatch
+			}
+			return header, *rec.Trailer, nil
+		}
+
+		count++
+		hashKeyValue(h, rec.Key, rec.Value, true)
+		if !bytes.HasPrefix(rec.Key, opts.FromPrefix) {
+			continue
+		}
+		key := append(append([]byte{}, opts.ToPrefix...), rec.Key[len(opts.FromPrefix):]...)
+		value := rec.Value
+		if value == nil {
+			value = []byte{}
+		}
+		keys, values = append(keys, key), append(values, value)
+		if len(keys) >= opts.BatchSize {
+			if err := flush(); err != nil {
+				return header, DumpTrailer{}, err
+			}
+		}
+	}
+}
+
+type dumpEncoder interface {
+	header(DumpHeader) error
+	record(key, value []byte) error
+	trailer(DumpTrailer) error
+}
+
+type dumpDecoder interface {
+	header() (DumpHeader, error)
+	// next returns a record or the trailer, io.EOF if the dump ends early
+	next() (dumpRecord, error)
+}
+
+type jsonlEncoder struct {
+	enc *json.Encoder
+}
+
+func (e *jsonlEncoder) header(h DumpHeader) error {
+	return e.enc.Encode(h)
+}
+
+func (e *jsonlEncoder) record(key, value []byte) error {
+	return e.enc.Encode(dumpRecord{Key: key, Value: value})
+}
+
+func (e *jsonlEncoder) trailer(t DumpTrailer) error {
+	return e.enc.Encode(dumpRecord{Trailer: &t})
+}
+
+type jsonlDecoder struct {
+	dec *json.Decoder
+}
+
+func (d *jsonlDecoder) header() (h DumpHeader, err error) {
+	if err := d.dec.Decode(&h); err != nil {
+		return h, fmt.Errorf("%w: %v", ErrInvalidDump, err)
+	}
+	return h, nil
+}
+
+func (d *jsonlDecoder) next() (rec dumpRecord, err error) {
+	err = d.dec.Decode(&rec)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return rec, io.EOF
+	}
+	if err != nil {
+		return rec, fmt.Errorf("%w: %v", ErrInvalidDump, err)
+	}
+	return rec, nil
+}
+
+type binaryEncoder struct {
+	w *bufio.Writer
+}
+
+func (e *binaryEncoder) uvarint(n uint64) error {
+	var l [binary.MaxVarintLen64]byte
+	_, err := e.w.Write(l[:binary.PutUvarint(l[:], n)])
+	return err
+}
+
+func (e *binaryEncoder) bytes(b []byte) error {
+	if err := e.uvarint(uint64(len(b))); err != nil {
+		return err
+	}
+	_, err := e.w.Write(b)
+	return err
+}
+
+func (e *binaryEncoder) json(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return e.bytes(b)
+}
+
+func (e *binaryEncoder) header(h DumpHeader) error {
+	if _, err := e.w.Write(dumpMagic); err != nil {
+		return err
+	}
+	return e.json(h)
+}
+
+func (e *binaryEncoder) record(key, value []byte) error {
+	if err := e.uvarint(uint64(len(key)) + 1); err != nil {
+		return err
+	}
+	if _, err := e.w.Write(key); err != nil {
+		return err
+	}
+	return e.bytes(value)
+}
+
+func (e *binaryEncoder) trailer(t DumpTrailer) error {
+	if err := e.uvarint(0); err != nil {
+		return err
+	}
+	return e.json(t)
+}
+
+type binaryDecoder struct {
+	r *bufio.Reader
+}
+
+func (d *binaryDecoder) uvarint() (uint64, error) {
+	n, err := binary.ReadUvarint(d.r)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, io.EOF
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidDump, err)
+	}
+	return n, nil
+}
+
+func (d *binaryDecoder) read(n uint64) ([]byte, error) {
+	if n > maxDumpField {
+		return nil, fmt.Errorf("%w: field of %d bytes", ErrInvalidDump, n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		return nil, io.EOF
+	}
+	return b, nil
+}
+
+func (d *binaryDecoder) json(v interface{}) error {
+	n, err := d.uvarint()
+	if err != nil {
+		return err
+	}
+	b, err := d.read(n)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidDump, err)
+	}
+	return nil
+}
+
+func (d *binaryDecoder) header() (h DumpHeader, err error) {
+	err = d.json(&h)
+	if err == io.EOF {
+		err = fmt.Errorf("%w: truncated header", ErrInvalidDump)
+	}
+	return h, err
+}
+
+func (d *binaryDecoder) next() (rec dumpRecord, err error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return rec, err
+	}
+	if n == 0 {
+		rec.Trailer = &DumpTrailer{}
+		return rec, d.json(rec.Trailer)
+	}
+	if rec.Key, err = d.read(n - 1); err != nil {
+		return rec, err
+	}
+	if n, err = d.uvarint(); err != nil {
+		return rec, err
+	}
+	rec.Value, err = d.read(n)
+	return rec, err
+}
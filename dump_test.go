@@ -0,0 +1,91 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDump(t *testing.T) {
+	ctx := context.Background()
+
+	src, err := New("badger:///?memory=true")
+	require.NoError(t, err)
+	for i := 0; i < 120; i++ {
+		require.NoError(t, src.Put(ctx, []byte(fmt.Sprintf("users/%03d", i)), []byte{byte(i), 0, 0xff}))
+	}
+	require.NoError(t, src.Put(ctx, []byte("users/empty"), []byte{}))
+	require.NoError(t, src.Put(ctx, []byte("other"), []byte("x")))
+
+	export := func(t *testing.T, opts ExportOptions) []byte {
+		tx, err := src.NewTransaction(ctx, true)
+		require.NoError(t, err)
+		defer tx.Discard(ctx)
+
+		buf := &bytes.Buffer{}
+		trailer, err := Export(ctx, tx, buf, opts)
+		require.NoError(t, err)
+		assert.Equal(t, int64(121), trailer.Count)
+		return buf.Bytes()
+	}
+
+	for _, format := range []DumpFormat{DumpJSONL, DumpBinary} {
+		t.Run(string(format)+": round trip with remapped prefix", func(t *testing.T) {
+			dump := export(t, ExportOptions{
+				Format:   format,
+				Prefix:   []byte("users/"),
+				Checksum: true,
+				Metadata: map[string]string{"source": "test"},
+			})
+
+			dst, err := New("badger:///?memory=true")
+			require.NoError(t, err)
+			header, trailer, err := Import(ctx, bytes.NewReader(dump), dst, ImportOptions{
+				BatchSize:  7,
+				FromPrefix: []byte("users/"),
+				ToPrefix:   []byte("people/"),
+			})
+			require.NoError(t, err)
+			assert.Equal(t, DumpVersion, header.Version)
+			assert.Equal(t, format, header.Format)
+			assert.Equal(t, "test", header.Metadata["source"])
+			assert.NotEmpty(t, trailer.Sha256)
+
+			v, err := dst.Get(ctx, []byte("people/042"))
+			require.NoError(t, err)
+			assert.Equal(t, []byte{42, 0, 0xff}, v)
+			v, err = dst.Get(ctx, []byte("people/empty"))
+			require.NoError(t, err)
+			assert.Empty(t, v)
+			_, err = dst.Get(ctx, []byte("users/042"))
+			assert.Equal(t, ErrNotFound, err)
+		})
+
+		t.Run(string(format)+": truncated dump", func(t *testing.T) {
+			dump := export(t, ExportOptions{Format: format, Prefix: []byte("users/")})
+
+			dst, err := New("badger:///?memory=true")
+			require.NoError(t, err)
+			_, _, err = Import(ctx, bytes.NewReader(dump[:len(dump)-20]), dst, ImportOptions{})
+			assert.True(t, errors.Is(err, ErrInvalidDump), err)
+		})
+	}
+
+	t.Run("checksum mismatch", func(t *testing.T) {
+		dump := string(export(t, ExportOptions{Prefix: []byte("users/"), Checksum: true}))
+		// the value of users/001 is 01 00 ff
+		tampered := strings.Replace(dump, `"v":"AQD/"`, `"v":"AgD/"`, 1)
+		require.NotEqual(t, dump, tampered)
+
+		dst, err := New("badger:///?memory=true")
+		require.NoError(t, err)
+		_, _, err = Import(ctx, strings.NewReader(tampered), dst, ImportOptions{})
+		assert.Equal(t, ErrChecksumMismatch, err)
+	})
+}
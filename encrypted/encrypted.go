@@ -0,0 +1,258 @@
+package encrypted
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+
+	"github.com/zatte/kv"
+)
+
+// reencryptBatch is the number of values rewritten per transaction by Reencrypt
+const reencryptBatch = 100
+
+type EncryptedDb struct {
+	kv.OrderedTransactional
+	encrypter *encrypter
+}
+
+type EncryptedDbTransaction struct {
+	kv.OrderedTransaction
+	encrypter *encrypter
+}
+
+type EncryptedDbIterator struct {
+	kv.Iterator
+	encrypter *encrypter
+}
+
+type encrypter struct {
+	keyring *Keyring
+	keys    *keyCipher // nil unless keys are encrypted
+}
+
+// New creates a DB where all values are encrypted with AES-GCM using the active
+// key of the keyring and a random nonce per value. The (plaintext) key is bound
+// as associated data so values can not be moved between keys.
+func New(db kv.OrderedTransactional, keyring *Keyring) *EncryptedDb {
+	return &EncryptedDb{db, &encrypter{keyring, nil}}
+}
+
+// NewWithKeyEncryption creates a DB like New but also deterministically
+// encrypts the keys with a key derived from keySecret. Lookups by key keep
+// working but keys are no longer stored in order; Seek is therefore only
+// supported from an empty start key and yields keys in an arbitrary order.
+// The keySecret can not be rotated without rewriting the whole store.
+func NewWithKeyEncryption(db kv.OrderedTransactional, keyring *Keyring, keySecret []byte) (*EncryptedDb, error) {
+	kc, err := newKeyCipher(keySecret)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedDb{db, &encrypter{keyring, kc}}, nil
+}
+
+func (e *encrypter) storedKey(key []byte) []byte {
+	if e.keys == nil {
+		return key
+	}
+	return e.keys.encrypt(key)
+}
+
+func (e *encrypter) plainKey(stored []byte) ([]byte, error) {
+	if e.keys == nil {
+		return stored, nil
+	}
+	return e.keys.decrypt(stored)
+}
+
+func (e *encrypter) seal(key, value []byte) ([]byte, error) {
+	nonce := make([]byte, e.keyring.nonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return e.keyring.seal(value, key, nonce), nil
+}
+
+func (e *encrypter) open(key, value []byte) ([]byte, error) {
+	return e.keyring.open(value, key)
+}
+
+// Get gets the value of a key within a single query transaction
+func (edb *EncryptedDb) Get(ctx context.Context, key []byte) (res []byte, err error) {
+	res, err = edb.OrderedTransactional.Get(ctx, edb.encrypter.storedKey(key))
+	if err != nil {
+		return nil, err
+	}
+	return edb.encrypter.open(key, res)
+}
+
+// Put sets the value of a key within a single query transaction
+func (edb *EncryptedDb) Put(ctx context.Context, key, value []byte) error {
+	v, err := edb.encrypter.seal(key, value)
+	if err != nil {
+		return err
+	}
+	return edb.OrderedTransactional.Put(ctx, edb.encrypter.storedKey(key), v)
+}
+
+// Delete removes a key within a single transaction
+func (edb *EncryptedDb) Delete(ctx context.Context, key []byte) error {
+	return edb.OrderedTransactional.Delete(ctx, edb.encrypter.storedKey(key))
+}
+
+// DeleteRange deletes all keys in [start, end). With encrypted keys only the
+// whole key space, an empty start and nil end, can be deleted.
+func (edb *EncryptedDb) DeleteRange(ctx context.Context, start, end []byte) (int64, error) {
+	if edb.encrypter.keys != nil && (len(start) > 0 || end != nil) {
+		return 0, ErrUnsupportedRange
+	}
+	return edb.OrderedTransactional.DeleteRange(ctx, start, end)
+}
+
+// NewTransaction for batching multiple values inside a transaction
+func (edb *EncryptedDb) NewTransaction(ctx context.Context, readOnly bool) (kv.OrderedTransaction, error) {
+	ot, err := edb.OrderedTransactional.NewTransaction(ctx, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedDbTransaction{ot, edb.encrypter}, nil
+}
+
+// Reencrypt rewrites every value that is not encrypted with the active key of
+// the keyring, after which old keys can be removed from the keyring. It
+// returns the number of rewritten values.
+func (edb *EncryptedDb) Reencrypt(ctx context.Context) (int, error) {
+	rewritten := 0
+	var start []byte
+	for {
+		keys, next, err := edb.staleKeys(ctx, start)
+		if err != nil {
+			return rewritten, err
+		}
+		if len(keys) > 0 {
+			if err := edb.rewrite(ctx, keys); err != nil {
+				return rewritten, err
+			}
+			rewritten += len(keys)
+		}
+		if next == nil {
+			return rewritten, nil
+		}
+		start = next
+	}
+}
+
+// staleKeys collects up to reencryptBatch stored keys, starting at start, that
+// are not encrypted with the active key. next is the stored key to continue
+// from or nil when the whole store has been scanned.
+func (edb *EncryptedDb) staleKeys(ctx context.Context, start []byte) (keys [][]byte, next []byte, err error) {
+	tx, err := edb.OrderedTransactional.NewTransaction(ctx, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Discard(ctx)
+
+	it, err := tx.Seek(ctx, start)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer it.Close()
+
+	for {
+		k, v, err := it.Next(ctx)
+		if err == kv.ErrNotFound {
+			return keys, nil, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(keys) == reencryptBatch {
+			return keys, append([]byte{}, k...), nil
+		}
+		if id, ok := keyID(v); ok && id != edb.encrypter.keyring.ActiveID() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+	}
+}
+
+func (edb *EncryptedDb) rewrite(ctx context.Context, storedKeys [][]byte) error {
+	tx, err := edb.NewTransaction(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer tx.Discard(ctx)
+
+	for _, sk := range storedKeys {
+		key, err := edb.encrypter.plainKey(sk)
+		if err != nil {
+			return err
+		}
+		v, err := tx.Get(ctx, key)
+		if err == kv.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.Put(ctx, key, v); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// encryptedDbTransaction
+
+// Seek initializes an iterator at the given key (inclusive)
+func (tx *EncryptedDbTransaction) Seek(ctx context.Context, StartKey []byte) (kv.Iterator, error) {
+	if tx.encrypter.keys != nil && len(StartKey) > 0 {
+		return nil, ErrUnsupportedSeek
+	}
+	it, err := tx.OrderedTransaction.Seek(ctx, StartKey)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedDbIterator{it, tx.encrypter}, nil
+}
+
+// Get gets the value of a key within the transaction
+func (tx *EncryptedDbTransaction) Get(ctx context.Context, key []byte) (res []byte, err error) {
+	res, err = tx.OrderedTransaction.Get(ctx, tx.encrypter.storedKey(key))
+	if err != nil {
+		return nil, err
+	}
+	return tx.encrypter.open(key, res)
+}
+
+// Put sets the value of a key within the transaction
+func (tx *EncryptedDbTransaction) Put(ctx context.Context, key, value []byte) error {
+	v, err := tx.encrypter.seal(key, value)
+	if err != nil {
+		return err
+	}
+	return tx.OrderedTransaction.Put(ctx, tx.encrypter.storedKey(key), v)
+}
+
+// Delete removes a key within the transaction
+func (tx *EncryptedDbTransaction) Delete(ctx context.Context, key []byte) error {
+	return tx.OrderedTransaction.Delete(ctx, tx.encrypter.storedKey(key))
+}
+
+// encryptedDbIterator
+
+// Next yields the next key-value in iterator with the key and value decrypted
+func (it *EncryptedDbIterator) Next(ctx context.Context) (key, value []byte, err error) {
+	k, v, err := it.Iterator.Next(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err = it.encrypter.plainKey(k)
+	if err != nil {
+		return nil, nil, err
+	}
+	value, err = it.encrypter.open(key, v)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, value, nil
+}
@@ -0,0 +1,101 @@
+package encrypted
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zatte/kv"
+)
+
+var (
+	key1 = bytes.Repeat([]byte{1}, 32)
+	key2 = bytes.Repeat([]byte{2}, 16)
+)
+
+func TestEncrypted(t *testing.T) {
+	ctx := context.Background()
+	raw, err := kv.New("badger:///?memory=true")
+	require.NoError(t, err)
+
+	kr1, err := NewKeyring(1, map[uint32][]byte{1: key1})
+	require.NoError(t, err)
+	db := New(raw, kr1)
+
+	t.Run("values are encrypted with random nonces", func(t *testing.T) {
+		require.NoError(t, db.Put(ctx, []byte("A"), []byte("secret")))
+		require.NoError(t, db.Put(ctx, []byte("B"), []byte("secret")))
+
+		a, err := raw.Get(ctx, []byte("A"))
+		require.NoError(t, err)
+		b, err := raw.Get(ctx, []byte("B"))
+		require.NoError(t, err)
+		assert.False(t, bytes.Contains(a, []byte("secret")))
+		assert.NotEqual(t, a[4:], b[4:])
+
+		v, err := db.Get(ctx, []byte("A"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("secret"), v)
+	})
+
+	t.Run("swapped values fail authentication", func(t *testing.T) {
+		a, err := raw.Get(ctx, []byte("A"))
+		require.NoError(t, err)
+		require.NoError(t, raw.Put(ctx, []byte("C"), a))
+
+		_, err = db.Get(ctx, []byte("C"))
+		assert.EqualError(t, err, ErrDecrypt.Error())
+		require.NoError(t, raw.Delete(ctx, []byte("C")))
+	})
+
+	t.Run("key rotation", func(t *testing.T) {
+		kr2, err := NewKeyring(2, map[uint32][]byte{1: key1, 2: key2})
+		require.NoError(t, err)
+		db2 := New(raw, kr2)
+
+		v, err := db2.Get(ctx, []byte("A"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("secret"), v)
+
+		n, err := db2.Reencrypt(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, n)
+
+		kr3, err := NewKeyring(2, map[uint32][]byte{2: key2})
+		require.NoError(t, err)
+		v, err = New(raw, kr3).Get(ctx, []byte("B"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("secret"), v)
+
+		_, err = db.Get(ctx, []byte("B"))
+		assert.EqualError(t, err, ErrUnknownKey.Error())
+	})
+
+	t.Run("deterministic key encryption", func(t *testing.T) {
+		edb, err := NewWithKeyEncryption(raw, kr1, []byte("key secret"))
+		require.NoError(t, err)
+
+		require.NoError(t, edb.Put(ctx, []byte("user/1"), []byte("1")))
+		require.NoError(t, edb.Put(ctx, []byte("user/1"), []byte("2")))
+
+		_, err = raw.Get(ctx, []byte("user/1"))
+		assert.EqualError(t, err, kv.ErrNotFound.Error())
+
+		v, err := edb.Get(ctx, []byte("user/1"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("2"), v)
+
+		tx, err := edb.NewTransaction(ctx, true)
+		require.NoError(t, err)
+		defer tx.Discard(ctx)
+
+		_, err = tx.Seek(ctx, []byte("user/"))
+		assert.EqualError(t, err, ErrUnsupportedSeek.Error())
+
+		require.NoError(t, edb.Delete(ctx, []byte("user/1")))
+		_, err = edb.Get(ctx, []byte("user/1"))
+		assert.EqualError(t, err, kv.ErrNotFound.Error())
+	})
+}
@@ -0,0 +1,150 @@
+package encrypted
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+
+	"github.com/zatte/kv"
+)
+
+const (
+	ErrUnknownKey      kv.KvError = "encrypted: unknown key id"
+	ErrInvalidKey      kv.KvError = "encrypted: keys must be 16, 24 or 32 bytes"
+	ErrDecrypt         kv.KvError = "encrypted: message authentication failed"
+	ErrUnsupportedSeek kv.KvError = "encrypted: seek from a start key is not supported with encrypted keys"
+	// ErrUnsupportedRange is returned for range deletes other than the whole key space with encrypted keys
+	ErrUnsupportedRange kv.KvError = "encrypted: range deletes are not supported with encrypted keys"
+)
+
+// Keyring holds all value encryption keys by id. New values are always
+// encrypted with the active key; older keys are kept around to read values
+// written before a rotation.
+type Keyring struct {
+	active uint32
+	aeads  map[uint32]cipher.AEAD
+}
+
+// NewKeyring creates a keyring from AES keys (16, 24 or 32 bytes) by id where
+// activeID must be one of the ids.
+func NewKeyring(activeID uint32, keys map[uint32][]byte) (*Keyring, error) {
+	kr := &Keyring{
+		active: activeID,
+		aeads:  map[uint32]cipher.AEAD{},
+	}
+	for id, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, ErrInvalidKey
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		kr.aeads[id] = aead
+	}
+	if _, ok := kr.aeads[activeID]; !ok {
+		return nil, ErrUnknownKey
+	}
+	return kr, nil
+}
+
+// ActiveID is the id of the key used to encrypt new values
+func (kr *Keyring) ActiveID() uint32 {
+	return kr.active
+}
+
+// keyID reads the id of the key used to encrypt a stored value
+func keyID(value []byte) (uint32, bool) {
+	if len(value) < 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(value), true
+}
+
+// seal encrypts value with the active key and a random nonce. The layout is
+// key id (4 bytes big endian) | nonce | ciphertext and tag.
+func (kr *Keyring) seal(value, additionalData []byte, nonce []byte) []byte {
+	aead := kr.aeads[kr.active]
+	out := make([]byte, 4, 4+len(nonce)+len(value)+aead.Overhead())
+	binary.BigEndian.PutUint32(out, kr.active)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, value, additionalData)
+}
+
+func (kr *Keyring) open(value, additionalData []byte) ([]byte, error) {
+	id, ok := keyID(value)
+	if !ok {
+		return nil, ErrDecrypt
+	}
+	aead, ok := kr.aeads[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	value = value[4:]
+	if len(value) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	res, err := aead.Open(nil, value[:aead.NonceSize()], value[aead.NonceSize():], additionalData)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return res, nil
+}
+
+func (kr *Keyring) nonceSize() int {
+	return kr.aeads[kr.active].NonceSize()
+}
+
+// keyCipher deterministically encrypts keys (SIV construction: the IV is a MAC
+// of the plaintext) so that equal keys always map to the same stored key and
+// Get/Put/Delete keep working. The sort order of the keys is not preserved.
+type keyCipher struct {
+	block  cipher.Block
+	macKey []byte
+}
+
+func newKeyCipher(secret []byte) (*keyCipher, error) {
+	encKey := derive(secret, "kv/encrypted/key-enc")
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	return &keyCipher{block, derive(secret, "kv/encrypted/key-mac")}, nil
+}
+
+func derive(secret []byte, label string) []byte {
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(label))
+	return m.Sum(nil)
+}
+
+func (kc *keyCipher) siv(key []byte) []byte {
+	m := hmac.New(sha256.New, kc.macKey)
+	m.Write(key)
+	return m.Sum(nil)[:aes.BlockSize]
+}
+
+func (kc *keyCipher) encrypt(key []byte) []byte {
+	iv := kc.siv(key)
+	out := make([]byte, len(iv)+len(key))
+	copy(out, iv)
+	cipher.NewCTR(kc.block, iv).XORKeyStream(out[len(iv):], key)
+	return out
+}
+
+func (kc *keyCipher) decrypt(stored []byte) ([]byte, error) {
+	if len(stored) < aes.BlockSize {
+		return nil, ErrDecrypt
+	}
+	iv := stored[:aes.BlockSize]
+	key := make([]byte, len(stored)-aes.BlockSize)
+	cipher.NewCTR(kc.block, iv).XORKeyStream(key, stored[aes.BlockSize:])
+	if subtle.ConstantTimeCompare(iv, kc.siv(key)) != 1 {
+		return nil, ErrDecrypt
+	}
+	return key, nil
+}
@@ -1,5 +1,10 @@
 package kv
 
+import (
+	"context"
+	"fmt"
+)
+
 type KvError string
 
 func (e KvError) Error() string {
@@ -9,4 +14,33 @@ func (e KvError) Error() string {
 const (
 	ErrInvalidDb KvError = "no supported database type"
 	ErrNotFound  KvError = "record not found"
+	ErrConflict  KvError = "transaction conflict"
+	ErrReadOnly  KvError = "write in a read-only transaction"
+	// ErrTxnExpired is returned by remote transactions whose handle expired
+	// on the server; the transaction is gone and retrying it will not help
+	ErrTxnExpired KvError = "transaction expired"
+	// ErrInsecureToken is returned by the remote:// and grpc:// clients when a
+	// token would be sent without TLS and insecure=true is not set
+	ErrInsecureToken KvError = "token requires tls=true or insecure=true"
 )
+
+// contextErr returns an error wrapping ctx.Err() once the context is canceled
+// or past its deadline; errors.Is(err, context.Canceled) holds for the result.
+func contextErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("kv: %w", err)
+	}
+	return nil
+}
+
+// backendErr prefers the context error over the error of a backend call that
+// failed because the context was done.
+func backendErr(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if cerr := contextErr(ctx); cerr != nil {
+		return cerr
+	}
+	return err
+}
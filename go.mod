@@ -4,13 +4,23 @@ go 1.14
 
 require (
 	cloud.google.com/go/datastore v1.2.0
+	github.com/DataDog/zstd v1.4.1
 	github.com/dgraph-io/badger/v2 v2.0.3
 	github.com/dgraph-io/ristretto v0.0.2 // indirect
+	github.com/golang/protobuf v1.4.2
+	github.com/golang/snappy v0.0.1
 	github.com/kr/pretty v0.2.0 // indirect
 	github.com/mattn/go-sqlite3 v1.14.6 // indirect
-	github.com/stretchr/testify v1.6.1
+	github.com/prometheus/client_golang v1.7.1
+	github.com/stretchr/testify v1.7.0
+	github.com/vmihailenco/msgpack/v5 v5.3.5
 	github.com/zatte/fdbtuple v0.0.0-20200805194734-f167c1b0559e
+	go.opentelemetry.io/otel v0.20.0
+	go.opentelemetry.io/otel/oteltest v0.20.0
+	go.opentelemetry.io/otel/trace v0.20.0
 	google.golang.org/api v0.26.0
+	google.golang.org/grpc v1.29.1
+	google.golang.org/protobuf v1.24.0
 	gorm.io/driver/mysql v1.0.4
 	gorm.io/driver/postgres v1.0.8
 	gorm.io/driver/sqlite v1.1.4
@@ -6,26 +6,44 @@ import (
 	"fmt"
 	"net/url"
 	"strings"
+	"time"
 
 	"gorm.io/driver/mysql"
 	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/driver/sqlserver"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type GromKeyValue struct {
 	gorm.Model
-	Key []byte `gorm:"primary_key" sql:"key"`
+	// Key is unique on its own, so concurrent first writes of a key can not
+	// both insert a row
+	Key []byte `gorm:"primary_key;uniqueIndex" sql:"key"`
 	Val []byte `sql:"val"`
+	// Version is incremented on every write, rows written before the column
+	// existed start at 1
+	Version uint64 `gorm:"not null;default:1" sql:"version"`
+}
+
+// GromKeyValueHistory is a revision of a key, recorded in history mode
+type GromKeyValueHistory struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	Key       []byte `sql:"key"`
+	Val       []byte `sql:"val"`
+	Deleted   bool   `sql:"deleted"`
 }
 
 type GormDB struct {
 	*gorm.DB
+	history HistoryOptions
 }
 
 type gormTransaction struct {
 	*GormDB
+	readOnly bool
 }
 
 type gormIterator struct {
@@ -36,6 +54,10 @@ func NewGormDbFromUrl(u *url.URL) (*GormDB, error) {
 	var db *gorm.DB
 	var err error
 	passw, _ := u.User.Password()
+	history, err := historyOptionsFromUrl(u)
+	if err != nil {
+		return nil, err
+	}
 	switch u.Scheme {
 	case "postgres":
 		dsn := fmt.Sprintf("host=%s port=%s user=%s dbname=%s password=%s", u.Host, u.Port(), u.User.Username(), u.Path, passw)
@@ -65,16 +87,85 @@ func NewGormDbFromUrl(u *url.URL) (*GormDB, error) {
 		return nil, err
 	}
 
-	return NewGormFromDB(db)
+	return newGormDb(db, history)
 }
 
 func NewGormFromDB(db *gorm.DB) (*GormDB, error) {
-	db.AutoMigrate(&GromKeyValue{})
+	return newGormDb(db, HistoryOptions{})
+}
+
+// newGormDb migrates the tables. Migrations of existing tables, e.g. adding
+// the version column or the unique index on the key, can fail on some
+// databases and are reported instead of surfacing as errors of later queries.
+func newGormDb(db *gorm.DB, history HistoryOptions) (*GormDB, error) {
+	if err := db.AutoMigrate(&GromKeyValue{}); err != nil {
+		return nil, err
+	}
+	if history.Enabled() {
+		if err := db.AutoMigrate(&GromKeyValueHistory{}); err != nil {
+			return nil, err
+		}
+	}
 	return &GormDB{
 		db,
+		history,
 	}, nil
 }
 
+// write runs fn, which returns the number of changed rows, and in history mode
+// records the revision of key if it changed, both within one transaction
+func (gdb *GormDB) write(ctx context.Context, key, value []byte, deleted bool, fn func(db *gorm.DB) (int64, error)) error {
+	db := gdb.DB.WithContext(ctx)
+	if !gdb.history.Enabled() {
+		_, err := fn(db)
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		n, err := fn(tx)
+		if err != nil || n == 0 {
+			return err
+		}
+		return gdb.record(tx, key, value, deleted)
+	})
+}
+
+// record appends a revision of key to the history and drops the revisions
+// no longer retained
+func (gdb *GormDB) record(tx *gorm.DB, key, value []byte, deleted bool) error {
+	now := time.Now()
+	rev := &GromKeyValueHistory{CreatedAt: now, Key: key, Val: value, Deleted: deleted}
+	if err := tx.Create(rev).Error; err != nil {
+		return err
+	}
+	var revs []GromKeyValueHistory
+	if err := tx.Select("id, created_at").Where("key = ?", key).Order("id desc").Find(&revs).Error; err != nil {
+		return err
+	}
+	var drop []uint
+	for i, r := range revs {
+		if !gdb.history.keep(i, r.CreatedAt, now) {
+			drop = append(drop, r.ID)
+		}
+	}
+	if len(drop) == 0 {
+		return nil
+	}
+	return tx.Delete(&GromKeyValueHistory{}, drop).Error
+}
+
+// revisions loads the retained revisions of key, newest first
+func (gdb *GormDB) revisions(ctx context.Context, key []byte) ([]Revision, error) {
+	var rows []GromKeyValueHistory
+	if err := gdb.DB.WithContext(ctx).Where("key = ?", key).Order("id desc").Find(&rows).Error; err != nil {
+		return nil, backendErr(ctx, err)
+	}
+	revs := make([]Revision, len(rows))
+	for i, r := range rows {
+		revs[i] = Revision{Value: r.Val, Time: r.CreatedAt, Deleted: r.Deleted}
+	}
+	return revs, nil
+}
+
 // gorm db
 
 func (gdb *GormDB) Close() error {
@@ -87,28 +178,42 @@ func (gdb *GormDB) Close() error {
 
 // Get gets the value of a key within a single query transaction
 func (gdb *GormDB) Get(ctx context.Context, key []byte) ([]byte, error) {
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
 	kv := &GromKeyValue{}
-	if result := gdb.DB.Where("key = ?", key).First(&kv); result.Error != nil {
+	if result := gdb.DB.WithContext(ctx).Where("key = ?", key).First(&kv); result.Error != nil {
 		if result.Error == gorm.ErrRecordNotFound {
 			return nil, ErrNotFound
 		}
-		return nil, result.Error
+		return nil, backendErr(ctx, result.Error)
 	}
 
 	return kv.Val, nil
 }
 
-// Put sets the value of a key within a single query transaction
+// Put sets the value of a key with a single upsert, so concurrent first
+// writes of a key both succeed
 func (gdb *GormDB) Put(ctx context.Context, key, value []byte) error {
-	kv := &GromKeyValue{
-		Key: key,
-		Val: value,
+	if err := contextErr(ctx); err != nil {
+		return err
 	}
-	if result := gdb.DB.Save(&kv); result.Error != nil {
-		if result.Error == gorm.ErrRecordNotFound {
+	err := gdb.write(ctx, key, value, false, func(db *gorm.DB) (int64, error) {
+		result := db.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "key"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"val":        value,
+				"version":    gorm.Expr("? + 1", clause.Column{Table: clause.CurrentTable, Name: "version"}),
+				"updated_at": time.Now(),
+			}),
+		}).Create(&GromKeyValue{Key: key, Val: value, Version: 1})
+		return result.RowsAffected, result.Error
+	})
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
 			return ErrNotFound
 		}
-		return result.Error
+		return backendErr(ctx, err)
 	}
 
 	return nil
@@ -116,25 +221,298 @@ func (gdb *GormDB) Put(ctx context.Context, key, value []byte) error {
 
 // Delete removes a key within a single transaction
 func (gdb *GormDB) Delete(ctx context.Context, key []byte) error {
-	kv := &GromKeyValue{
-		Key: key,
+	if err := contextErr(ctx); err != nil {
+		return err
 	}
-	if result := gdb.DB.Where("key = ?", key).Delete(&kv); result.Error != nil {
-		if result.Error == gorm.ErrRecordNotFound {
+	// rows are removed for good; soft deleted rows would collide with keys
+	// written again later
+	err := gdb.write(ctx, key, nil, true, func(db *gorm.DB) (int64, error) {
+		result := db.Unscoped().Where("key = ?", key).Delete(&GromKeyValue{})
+		return result.RowsAffected, result.Error
+	})
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
 			return ErrNotFound
 		}
+		return backendErr(ctx, err)
+	}
+
+	return nil
+}
+
+// DeleteRange deletes all keys in [start, end) with a single DELETE statement
+func (gdb *GormDB) DeleteRange(ctx context.Context, start, end []byte) (int64, error) {
+	if err := contextErr(ctx); err != nil {
+		return 0, err
+	}
+	if start == nil {
+		start = []byte{} // NULL would not compare
+	}
+	inRange := func(db *gorm.DB) *gorm.DB {
+		db = db.Unscoped().Where("key >= ?", start)
+		if end != nil {
+			db = db.Where("key < ?", end)
+		}
+		return db
+	}
+	if !gdb.history.Enabled() {
+		result := inRange(gdb.DB.WithContext(ctx)).Delete(&GromKeyValue{})
+		if result.Error != nil {
+			return 0, backendErr(ctx, result.Error)
+		}
+		return result.RowsAffected, nil
+	}
+
+	// the deletion of every key is recorded in the history
+	var deleted int64
+	err := gdb.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var keys [][]byte
+		if err := inRange(tx.Model(&GromKeyValue{})).Pluck("key", &keys).Error; err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := gdb.record(tx, k, nil, true); err != nil {
+				return err
+			}
+		}
+		result := inRange(tx).Delete(&GromKeyValue{})
+		deleted = result.RowsAffected
 		return result.Error
+	})
+	if err != nil {
+		return 0, backendErr(ctx, err)
+	}
+	return deleted, nil
+}
+
+// GetAt returns the value key had at ts from the history table
+func (gdb *GormDB) GetAt(ctx context.Context, key []byte, ts time.Time) ([]byte, error) {
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	if !gdb.history.Enabled() {
+		return nil, ErrHistoryDisabled
+	}
+	revs, err := gdb.revisions(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return revisionAt(revs, ts)
+}
+
+// History iterates the revisions of key in the history table
+func (gdb *GormDB) History(ctx context.Context, key []byte) (HistoryIterator, error) {
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	if !gdb.history.Enabled() {
+		return nil, ErrHistoryDisabled
+	}
+	revs, err := gdb.revisions(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &revisionIterator{revs}, nil
+}
+
+// GetWithVersion returns the value of a key and its version column
+func (gdb *GormDB) GetWithVersion(ctx context.Context, key []byte) ([]byte, uint64, error) {
+	if err := contextErr(ctx); err != nil {
+		return nil, VersionNotExist, err
+	}
+	kv := &GromKeyValue{}
+	if result := gdb.DB.WithContext(ctx).Where("key = ?", key).First(&kv); result.Error != nil {
+		if result.Error == gorm.ErrRecordNotFound {
+			return nil, VersionNotExist, ErrNotFound
+		}
+		return nil, VersionNotExist, backendErr(ctx, result.Error)
+	}
+	return kv.Val, kv.Version, nil
+}
+
+// PutIfVersion sets the value of a key if its version is expectedVersion.
+// Existing rows are updated with a single conditional UPDATE and missing ones
+// inserted, with the unique key deciding between concurrent inserts. Versions
+// restart at 1 when a key is deleted and written again.
+func (gdb *GormDB) PutIfVersion(ctx context.Context, key, value []byte, expectedVersion uint64) error {
+	if err := contextErr(ctx); err != nil {
+		return err
+	}
+	if expectedVersion != VersionNotExist {
+		var updated bool
+		err := gdb.write(ctx, key, value, false, func(db *gorm.DB) (int64, error) {
+			result := db.Model(&GromKeyValue{}).Where("key = ? AND version = ?", key, expectedVersion).Updates(map[string]interface{}{
+				"val":     value,
+				"version": gorm.Expr("version + 1"),
+			})
+			updated = result.RowsAffected > 0
+			return result.RowsAffected, result.Error
+		})
+		if err != nil {
+			return backendErr(ctx, err)
+		}
+		if !updated {
+			return ErrVersionMismatch
+		}
+		return nil
+	}
+	err := gdb.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var n int64
+		if result := tx.Model(&GromKeyValue{}).Where("key = ?", key).Count(&n); result.Error != nil {
+			return result.Error
+		}
+		if n > 0 {
+			return ErrVersionMismatch
+		}
+		err := tx.Transaction(func(tx *gorm.DB) error {
+			return tx.Create(&GromKeyValue{Key: key, Val: value, Version: 1}).Error
+		})
+		if err != nil {
+			// a concurrent create of the key took the unique key first
+			if result := tx.Model(&GromKeyValue{}).Where("key = ?", key).Count(&n); result.Error == nil && n > 0 {
+				return ErrVersionMismatch
+			}
+			return err
+		}
+		if gdb.history.Enabled() {
+			return gdb.record(tx, key, value, false)
+		}
+		return nil
+	})
+	if err == ErrVersionMismatch {
+		return err
 	}
+	return backendErr(ctx, err)
+}
 
+// DeleteIfVersion removes a key if its version is expectedVersion with a
+// single conditional DELETE
+func (gdb *GormDB) DeleteIfVersion(ctx context.Context, key []byte, expectedVersion uint64) error {
+	if err := contextErr(ctx); err != nil {
+		return err
+	}
+	if expectedVersion == VersionNotExist {
+		_, _, err := gdb.GetWithVersion(ctx, key)
+		switch err {
+		case ErrNotFound:
+			return nil
+		case nil:
+			return ErrVersionMismatch
+		}
+		return err
+	}
+	var deleted bool
+	err := gdb.write(ctx, key, nil, true, func(db *gorm.DB) (int64, error) {
+		result := db.Unscoped().Where("key = ? AND version = ?", key, expectedVersion).Delete(&GromKeyValue{})
+		deleted = result.RowsAffected > 0
+		return result.RowsAffected, result.Error
+	})
+	if err != nil {
+		return backendErr(ctx, err)
+	}
+	if !deleted {
+		return ErrVersionMismatch
+	}
 	return nil
 }
 
+// Mutate applies an atomic mutation to the counter at key, see kv.Mutate.
+// Values are blobs so the arithmetic can not be done by the database; the row
+// is instead locked for the read-modify-write with SELECT ... FOR UPDATE, or
+// by the database lock sqlite takes for write transactions. As a missing row
+// can not be locked, a placeholder row with version 0 is inserted first if the
+// key is missing: concurrent first mutations of a key wait for each other on
+// the unique key instead of both inserting.
+func (gdb *GormDB) Mutate(ctx context.Context, key []byte, op MutationType, operand int64) (int64, error) {
+	if err := contextErr(ctx); err != nil {
+		return 0, err
+	}
+	var n int64
+	err := gdb.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).Model(&GromKeyValue{}).Create(map[string]interface{}{
+			"key":        key,
+			"version":    0,
+			"created_at": now,
+			"updated_at": now,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		query := tx
+		switch tx.Dialector.Name() {
+		case "postgres", "mysql":
+			query = query.Clauses(clause.Locking{Strength: "UPDATE"})
+		}
+		row := &GromKeyValue{}
+		if err := query.Where("key = ?", key).First(row).Error; err != nil {
+			return err
+		}
+
+		n = operand
+		if row.Version > 0 {
+			cur, err := DecodeCounter(row.Val)
+			if err != nil {
+				return err
+			}
+			n = op.Apply(cur, operand)
+		}
+		return (&GormDB{tx, gdb.history}).Put(ctx, key, EncodeCounter(n))
+	})
+	if err != nil {
+		return 0, backendErr(ctx, err)
+	}
+	return n, nil
+}
+
 // NewTransaction for batching multiple values inside a transaction
+// The transaction is rolled back if ctx is done before it is committed.
 func (gdb *GormDB) NewTransaction(ctx context.Context, readOnly bool) (OrderedTransaction, error) {
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	tx := gdb.DB.WithContext(ctx).Begin(&sql.TxOptions{ReadOnly: readOnly})
+	if tx.Error != nil {
+		return nil, backendErr(ctx, tx.Error)
+	}
 	return &gormTransaction{
 		&GormDB{
-			gdb.DB.Begin(&sql.TxOptions{ReadOnly: readOnly}),
+			tx,
+			gdb.history,
 		},
+		readOnly,
+	}, nil
+}
+
+// NewSnapshot starts a read-only transaction with an isolation level that
+// keeps one view of the data for all its queries; REPEATABLE READ on postgres
+// and mysql, SERIALIZABLE on sqlserver. sqlite transactions are serializable.
+// Only the current time is supported as readTs.
+func (gdb *GormDB) NewSnapshot(ctx context.Context, readTs time.Time) (OrderedTransaction, error) {
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	if !readTs.IsZero() {
+		return nil, ErrSnapshotUnsupported
+	}
+	opts := &sql.TxOptions{ReadOnly: true}
+	switch gdb.DB.Dialector.Name() {
+	case "postgres", "mysql":
+		opts.Isolation = sql.LevelRepeatableRead
+	case "sqlserver":
+		opts.Isolation = sql.LevelSerializable
+	}
+	tx := gdb.DB.WithContext(ctx).Begin(opts)
+	if tx.Error != nil {
+		return nil, backendErr(ctx, tx.Error)
+	}
+	return &gormTransaction{
+		&GormDB{
+			tx,
+			gdb.history,
+		},
+		true,
 	}, nil
 }
 
@@ -142,8 +520,65 @@ func (gdb *GormDB) NewTransaction(ctx context.Context, readOnly bool) (OrderedTr
 
 // Seeks initializes an iterator at the given key (inclusive)
 func (gdb *gormTransaction) Seek(ctx context.Context, StartKey []byte) (Iterator, error) {
-	rows, err := gdb.DB.Model(&GromKeyValue{}).Select("key, val").Order("key").Where("key >= ?", StartKey).Rows()
-	return &gormIterator{rows}, err
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	rows, err := gdb.DB.WithContext(ctx).Model(&GromKeyValue{}).Select("key, val").Order("key").Where("key >= ?", StartKey).Rows()
+	if err != nil {
+		return nil, backendErr(ctx, err)
+	}
+	return &gormIterator{rows}, nil
+}
+
+// Put sets the value of a key within the transaction
+func (gdb *gormTransaction) Put(ctx context.Context, key, value []byte) error {
+	if gdb.readOnly {
+		return ErrReadOnly
+	}
+	return gdb.GormDB.Put(ctx, key, value)
+}
+
+// Delete removes a key within the transaction
+func (gdb *gormTransaction) Delete(ctx context.Context, key []byte) error {
+	if gdb.readOnly {
+		return ErrReadOnly
+	}
+	return gdb.GormDB.Delete(ctx, key)
+}
+
+// DeleteRange deletes all keys in [start, end) within the transaction
+func (gdb *gormTransaction) DeleteRange(ctx context.Context, start, end []byte) (int64, error) {
+	if gdb.readOnly {
+		return 0, ErrReadOnly
+	}
+	return gdb.GormDB.DeleteRange(ctx, start, end)
+}
+
+// PutIfVersion sets the value of a key within the transaction if its version
+// is expectedVersion
+func (gdb *gormTransaction) PutIfVersion(ctx context.Context, key, value []byte, expectedVersion uint64) error {
+	if gdb.readOnly {
+		return ErrReadOnly
+	}
+	return gdb.GormDB.PutIfVersion(ctx, key, value, expectedVersion)
+}
+
+// DeleteIfVersion removes a key within the transaction if its version is
+// expectedVersion
+func (gdb *gormTransaction) DeleteIfVersion(ctx context.Context, key []byte, expectedVersion uint64) error {
+	if gdb.readOnly {
+		return ErrReadOnly
+	}
+	return gdb.GormDB.DeleteIfVersion(ctx, key, expectedVersion)
+}
+
+// Mutate applies an atomic mutation to the counter at key within the
+// transaction
+func (gdb *gormTransaction) Mutate(ctx context.Context, key []byte, op MutationType, operand int64) (int64, error) {
+	if gdb.readOnly {
+		return 0, ErrReadOnly
+	}
+	return gdb.GormDB.Mutate(ctx, key, op, operand)
 }
 
 // Discard removes all sides effects of the transaction
@@ -154,21 +589,30 @@ func (gdb *gormTransaction) Discard(ctx context.Context) error {
 
 // Commit persists all side effects of the transaction and returns an error if there are any conflics
 func (gdb *gormTransaction) Commit(ctx context.Context) error {
+	if err := contextErr(ctx); err != nil {
+		return err
+	}
 	e := gdb.DB.Commit()
-	return e.Error
+	return backendErr(ctx, e.Error)
 }
 
 // gormIterator
 
 // Next yeilds the next key-value in iterator. Key-values can not be re-used between iterations. Make sure top copy the values if you must.
 func (it *gormIterator) Next(ctx context.Context) (key, value []byte, err error) {
+	if err := contextErr(ctx); err != nil {
+		return nil, nil, err
+	}
 	if !it.Rows.Next() {
+		if err := it.Rows.Err(); err != nil {
+			return nil, nil, backendErr(ctx, err)
+		}
 		return nil, nil, ErrNotFound
 	}
 
 	var k, v []byte
 	if err := it.Rows.Scan(&k, &v); err != nil {
-		return nil, nil, err
+		return nil, nil, backendErr(ctx, err)
 	}
 
 	if k == nil {
@@ -180,5 +624,5 @@ func (it *gormIterator) Next(ctx context.Context) (key, value []byte, err error)
 
 // Close must always be called to clean up iterators.
 func (gdb *gormIterator) Close() error {
-	return nil
+	return gdb.Rows.Close()
 }
@@ -0,0 +1,285 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/zatte/kv/kvpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// grpcLease is the lease requested for transactions; they are kept alive at a
+// third of the granted lease until committed or discarded.
+const grpcLease = 30 * time.Second
+
+// GrpcDB is a client for a store served by the grpcserver package
+type GrpcDB struct {
+	client kvpb.KVClient
+	conn   *grpc.ClientConn
+}
+
+// grpcTransaction is a transaction held by the server, kept alive by a
+// background goroutine.
+type grpcTransaction struct {
+	*GrpcDB
+	id   string
+	stop func()
+}
+
+type grpcIterator struct {
+	stream kvpb.KV_SeekClient
+	cancel func()
+	items  []*kvpb.KeyValue
+	done   bool
+}
+
+// tokenCredentials sends a bearer token with every call
+type tokenCredentials struct {
+	token string
+	// insecure allows sending the token without transport security
+	insecure bool
+}
+
+func (t tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + t.token}, nil
+}
+
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return !t.insecure
+}
+
+// NewGrpcDbFromUrl connects to a kv gRPC server, e.g.
+// grpc://host:9090?token=secret&tls=true. Tokens are only sent over TLS
+// unless insecure=true is set, e.g. for a server on localhost.
+func NewGrpcDbFromUrl(u *url.URL) (*GrpcDB, error) {
+	q := u.Query()
+	useTLS, insecure := q.Get("tls") == "true", q.Get("insecure") == "true"
+	opts := []grpc.DialOption{grpc.WithInsecure()}
+	if useTLS {
+		opts = []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{}))}
+	}
+	if token := q.Get("token"); token != "" {
+		if !useTLS && !insecure {
+			return nil, ErrInsecureToken
+		}
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenCredentials{token, insecure}))
+	}
+	conn, err := grpc.Dial(u.Host, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewGrpcDb(conn), nil
+}
+
+// NewGrpcDb creates a client on an existing connection
+func NewGrpcDb(conn *grpc.ClientConn) *GrpcDB {
+	return &GrpcDB{kvpb.NewKVClient(conn), conn}
+}
+
+// Close closes the connection
+func (gdb *GrpcDB) Close() error {
+	return gdb.conn.Close()
+}
+
+// grpcErr maps gRPC status errors to kv errors
+func grpcErr(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if cerr := contextErr(ctx); cerr != nil {
+		return cerr
+	}
+	switch status.Code(err) {
+	case codes.NotFound:
+		return ErrNotFound
+	case codes.Aborted:
+		return ErrConflict
+	case codes.FailedPrecondition:
+		return ErrTxnExpired
+	case codes.PermissionDenied:
+		return ErrReadOnly
+	}
+	return err
+}
+
+// Get gets the value of a key
+func (gdb *GrpcDB) Get(ctx context.Context, key []byte) ([]byte, error) {
+	return gdb.get(ctx, "", key)
+}
+
+func (gdb *GrpcDB) get(ctx context.Context, txn string, key []byte) ([]byte, error) {
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	res, err := gdb.client.Get(ctx, &kvpb.GetRequest{Txn: txn, Key: key})
+	if err != nil {
+		return nil, grpcErr(ctx, err)
+	}
+	if res.Value == nil {
+		return []byte{}, nil
+	}
+	return res.Value, nil
+}
+
+// Put sets the value of a key
+func (gdb *GrpcDB) Put(ctx context.Context, key, value []byte) error {
+	return gdb.put(ctx, "", key, value)
+}
+
+func (gdb *GrpcDB) put(ctx context.Context, txn string, key, value []byte) error {
+	if err := contextErr(ctx); err != nil {
+		return err
+	}
+	_, err := gdb.client.Put(ctx, &kvpb.PutRequest{Txn: txn, Key: key, Value: value})
+	return grpcErr(ctx, err)
+}
+
+// Delete removes a key
+func (gdb *GrpcDB) Delete(ctx context.Context, key []byte) error {
+	return gdb.delete(ctx, "", key)
+}
+
+func (gdb *GrpcDB) delete(ctx context.Context, txn string, key []byte) error {
+	if err := contextErr(ctx); err != nil {
+		return err
+	}
+	_, err := gdb.client.Delete(ctx, &kvpb.DeleteRequest{Txn: txn, Key: key})
+	return grpcErr(ctx, err)
+}
+
+// DeleteRange deletes all keys in [start, end) on the server
+func (gdb *GrpcDB) DeleteRange(ctx context.Context, start, end []byte) (int64, error) {
+	if err := contextErr(ctx); err != nil {
+		return 0, err
+	}
+	// an empty end is sent as the end of the key space
+	if end != nil && bytes.Compare(start, end) >= 0 {
+		return 0, nil
+	}
+	res, err := gdb.client.DeleteRange(ctx, &kvpb.DeleteRangeRequest{Start: start, End: end})
+	if err != nil {
+		return 0, grpcErr(ctx, err)
+	}
+	return res.Deleted, nil
+}
+
+// NewTransaction starts a transaction on the server and keeps its lease alive
+// until Commit or Discard.
+func (gdb *GrpcDB) NewTransaction(ctx context.Context, readOnly bool) (OrderedTransaction, error) {
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	res, err := gdb.client.Begin(ctx, &kvpb.BeginRequest{ReadOnly: readOnly, LeaseMs: grpcLease.Milliseconds()})
+	if err != nil {
+		return nil, grpcErr(ctx, err)
+	}
+
+	kaCtx, stop := context.WithCancel(context.Background())
+	go func() {
+		ticker := time.NewTicker(time.Duration(res.LeaseMs) * time.Millisecond / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := gdb.client.KeepAlive(kaCtx, &kvpb.KeepAliveRequest{Txn: res.Txn}); err != nil && status.Code(err) == codes.FailedPrecondition {
+					return
+				}
+			case <-kaCtx.Done():
+				return
+			}
+		}
+	}()
+	return &grpcTransaction{gdb, res.Txn, stop}, nil
+}
+
+// grpcTransaction
+
+// Seek initializes an iterator at the given key (inclusive). Key/values are
+// streamed from the server in chunks.
+func (tx *grpcTransaction) Seek(ctx context.Context, StartKey []byte) (Iterator, error) {
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	// The stream outlives this call, so it gets its own context canceled on Close
+	sctx, cancel := context.WithCancel(context.Background())
+	stream, err := tx.client.Seek(sctx, &kvpb.SeekRequest{Txn: tx.id, Start: StartKey})
+	if err != nil {
+		cancel()
+		return nil, grpcErr(ctx, err)
+	}
+	return &grpcIterator{stream: stream, cancel: cancel}, nil
+}
+
+// Get gets the value of a key within the transaction
+func (tx *grpcTransaction) Get(ctx context.Context, key []byte) ([]byte, error) {
+	return tx.get(ctx, tx.id, key)
+}
+
+// Put sets the value of a key within the transaction
+func (tx *grpcTransaction) Put(ctx context.Context, key, value []byte) error {
+	return tx.put(ctx, tx.id, key, value)
+}
+
+// Delete removes a key within the transaction
+func (tx *grpcTransaction) Delete(ctx context.Context, key []byte) error {
+	return tx.delete(ctx, tx.id, key)
+}
+
+// Discard removes all sides effects of the transaction
+func (tx *grpcTransaction) Discard(ctx context.Context) error {
+	tx.stop()
+	_, err := tx.client.Discard(ctx, &kvpb.DiscardRequest{Txn: tx.id})
+	return grpcErr(ctx, err)
+}
+
+// Commit persists all side effects of the transaction
+func (tx *grpcTransaction) Commit(ctx context.Context) error {
+	if err := contextErr(ctx); err != nil {
+		return err
+	}
+	tx.stop()
+	_, err := tx.client.Commit(ctx, &kvpb.CommitRequest{Txn: tx.id})
+	return grpcErr(ctx, err)
+}
+
+// grpcIterator
+
+// Next yields the next key-value in iterator
+func (it *grpcIterator) Next(ctx context.Context) (key, value []byte, err error) {
+	if err := contextErr(ctx); err != nil {
+		return nil, nil, err
+	}
+	for len(it.items) == 0 {
+		if it.done {
+			return nil, nil, ErrNotFound
+		}
+		res, err := it.stream.Recv()
+		if err == io.EOF {
+			it.done = true
+			continue
+		}
+		if err != nil {
+			return nil, nil, grpcErr(ctx, err)
+		}
+		it.items = res.Items
+	}
+	kv := it.items[0]
+	it.items = it.items[1:]
+	if kv.Value == nil {
+		kv.Value = []byte{}
+	}
+	return kv.Key, kv.Value, nil
+}
+
+// Close ends the stream
+func (it *grpcIterator) Close() error {
+	it.cancel()
+	return nil
+}
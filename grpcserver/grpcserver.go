@@ -0,0 +1,442 @@
+// Package grpcserver implements the kvpb.KV gRPC service for any kv store.
+package grpcserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/zatte/kv"
+	"github.com/zatte/kv/kvpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Defaults for Options
+const (
+	DefaultLease       = 30 * time.Second
+	DefaultMaxLease    = 5 * time.Minute
+	DefaultMaxDuration = 10 * time.Minute
+	// seekChunk is the number of key/values per Seek response
+	seekChunk = 100
+)
+
+// Options configures a Server. The zero value uses the defaults and requires
+// no authentication.
+type Options struct {
+	// Token, when set, is required as "authorization: Bearer <token>" metadata
+	Token string
+	// DefaultLease is used for transactions that do not request a lease
+	DefaultLease time.Duration
+	// MaxLease caps the lease requested by clients
+	MaxLease time.Duration
+	// MaxDuration discards transactions that are older, regardless of leases
+	MaxDuration time.Duration
+}
+
+// Server implements kvpb.KVServer
+type Server struct {
+	db   kv.OrderedTransactional
+	opts Options
+
+	mu   sync.Mutex
+	txns map[string]*txn
+}
+
+// txn is a transaction held on behalf of a client. Backend transactions are
+// not safe for concurrent use, so all operations hold mu.
+type txn struct {
+	mu       sync.Mutex
+	tx       kv.OrderedTransaction
+	lease    time.Duration
+	timer    *time.Timer
+	deadline time.Time
+	cancel   func()
+}
+
+var (
+	// Expired handles use their own code; Aborted means a conflict that is
+	// worth retrying, which a dead handle is not
+	errUnknownTxn = status.Error(codes.FailedPrecondition, "unknown or expired transaction")
+	errTxnTimeout = status.Error(codes.FailedPrecondition, "transaction exceeded the maximum duration")
+)
+
+// New creates a server for db
+func New(db kv.OrderedTransactional, opts Options) *Server {
+	if opts.DefaultLease <= 0 {
+		opts.DefaultLease = DefaultLease
+	}
+	if opts.MaxLease <= 0 {
+		opts.MaxLease = DefaultMaxLease
+	}
+	if opts.MaxDuration <= 0 {
+		opts.MaxDuration = DefaultMaxDuration
+	}
+	return &Server{db: db, opts: opts, txns: map[string]*txn{}}
+}
+
+// ServerOptions returns the grpc.ServerOptions enforcing the token of s:
+//
+//	srv := grpcserver.New(db, grpcserver.Options{Token: "secret"})
+//	gs := grpc.NewServer(srv.ServerOptions()...)
+//	kvpb.RegisterKVServer(gs, srv)
+func (s *Server) ServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := s.authorize(ctx); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := s.authorize(ss.Context()); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	}
+}
+
+func (s *Server) authorize(ctx context.Context) error {
+	if s.opts.Token == "" {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, auth := range md.Get("authorization") {
+		if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+s.opts.Token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "unauthorized")
+}
+
+// toStatus maps kv errors to gRPC status errors
+func toStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	code := codes.Unknown
+	switch {
+	case errors.Is(err, kv.ErrNotFound):
+		code = codes.NotFound
+	case errors.Is(err, kv.ErrConflict):
+		code = codes.Aborted
+	case errors.Is(err, kv.ErrReadOnly):
+		code = codes.PermissionDenied
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	}
+	return status.Error(code, err.Error())
+}
+
+// lookup returns a transaction by handle, renews its lease and locks it. The
+// caller unlocks it.
+func (s *Server) lookup(id string) (*txn, error) {
+	s.mu.Lock()
+	t, ok := s.txns[id]
+	s.mu.Unlock()
+	if !ok {
+		return nil, errUnknownTxn
+	}
+	t.mu.Lock()
+	if t.tx == nil {
+		t.mu.Unlock()
+		return nil, errUnknownTxn
+	}
+	if time.Now().After(t.deadline) {
+		t.mu.Unlock()
+		s.end(id)
+		return nil, errTxnTimeout
+	}
+	t.timer.Reset(t.lease)
+	return t, nil
+}
+
+// end discards a transaction and forgets its handle
+func (s *Server) end(id string) {
+	s.mu.Lock()
+	t, ok := s.txns[id]
+	delete(s.txns, id)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tx != nil {
+		t.timer.Stop()
+		t.tx.Discard(context.Background())
+		t.tx = nil
+		t.cancel()
+	}
+}
+
+// Transactions returns the number of open transactions
+func (s *Server) Transactions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.txns)
+}
+
+// do runs fn in the transaction id, or in a new transaction committed
+// afterwards when id is empty.
+func (s *Server) do(ctx context.Context, id string, readOnly bool, fn func(tx kv.OrderedTransaction) error) error {
+	if id != "" {
+		t, err := s.lookup(id)
+		if err != nil {
+			return err
+		}
+		defer t.mu.Unlock()
+		return toStatus(fn(t.tx))
+	}
+
+	tx, err := s.db.NewTransaction(ctx, readOnly)
+	if err != nil {
+		return toStatus(err)
+	}
+	defer tx.Discard(ctx)
+	if err := fn(tx); err != nil {
+		return toStatus(err)
+	}
+	if readOnly {
+		return nil
+	}
+	return toStatus(tx.Commit(ctx))
+}
+
+// Get gets the value of a key
+func (s *Server) Get(ctx context.Context, req *kvpb.GetRequest) (*kvpb.GetResponse, error) {
+	res := &kvpb.GetResponse{}
+	err := s.do(ctx, req.Txn, true, func(tx kv.OrderedTransaction) (err error) {
+		res.Value, err = tx.Get(ctx, req.Key)
+		return err
+	})
+	return res, err
+}
+
+// Put sets the value of a key
+func (s *Server) Put(ctx context.Context, req *kvpb.PutRequest) (*kvpb.PutResponse, error) {
+	if req.Value == nil {
+		req.Value = []byte{}
+	}
+	return &kvpb.PutResponse{}, s.do(ctx, req.Txn, false, func(tx kv.OrderedTransaction) error {
+		return tx.Put(ctx, req.Key, req.Value)
+	})
+}
+
+// Delete removes a key
+func (s *Server) Delete(ctx context.Context, req *kvpb.DeleteRequest) (*kvpb.DeleteResponse, error) {
+	return &kvpb.DeleteResponse{}, s.do(ctx, req.Txn, false, func(tx kv.OrderedTransaction) error {
+		return tx.Delete(ctx, req.Key)
+	})
+}
+
+// Batch executes all ops in one transaction. Deleting a missing key is not an
+// error in a batch.
+func (s *Server) Batch(ctx context.Context, req *kvpb.BatchRequest) (*kvpb.BatchResponse, error) {
+	readOnly := true
+	for _, op := range req.Ops {
+		if op.Type != kvpb.Op_GET {
+			readOnly = false
+		}
+	}
+
+	res := &kvpb.BatchResponse{Results: make([]*kvpb.Result, len(req.Ops))}
+	err := s.do(ctx, req.Txn, readOnly, func(tx kv.OrderedTransaction) error {
+		for i, op := range req.Ops {
+			r := &kvpb.Result{}
+			switch op.Type {
+			case kvpb.Op_GET:
+				v, err := tx.Get(ctx, op.Key)
+				if err != nil && err != kv.ErrNotFound {
+					return err
+				}
+				r.Found, r.Value = err == nil, v
+			case kvpb.Op_PUT:
+				if op.Value == nil {
+					op.Value = []byte{}
+				}
+				if err := tx.Put(ctx, op.Key, op.Value); err != nil {
+					return err
+				}
+				r.Found = true
+			case kvpb.Op_DELETE:
+				if err := tx.Delete(ctx, op.Key); err != nil && err != kv.ErrNotFound {
+					return err
+				}
+			default:
+				return status.Errorf(codes.InvalidArgument, "unknown op %v", op.Type)
+			}
+			res.Results[i] = r
+		}
+		return nil
+	})
+	return res, err
+}
+
+// Seek streams key/values in chunks. Within a transaction, every chunk is read
+// under the transaction lock with a fresh iterator so other operations on the
+// transaction can run between chunks. Without one, all chunks are read from a
+// single read-only transaction.
+func (s *Server) Seek(req *kvpb.SeekRequest, stream kvpb.KV_SeekServer) error {
+	ctx := stream.Context()
+	read := func(fn func(tx kv.OrderedTransaction) error) error {
+		return s.do(ctx, req.Txn, true, fn)
+	}
+	if req.Txn == "" {
+		tx, err := s.db.NewTransaction(ctx, true)
+		if err != nil {
+			return toStatus(err)
+		}
+		defer tx.Discard(ctx)
+		read = func(fn func(tx kv.OrderedTransaction) error) error {
+			return toStatus(fn(tx))
+		}
+	}
+
+	start := req.Start
+	sent := int64(0)
+	for {
+		n := int64(seekChunk)
+		if req.Limit > 0 && req.Limit-sent < n {
+			n = req.Limit - sent
+		}
+		if n == 0 {
+			return nil
+		}
+
+		var items []*kvpb.KeyValue
+		err := read(func(tx kv.OrderedTransaction) (err error) {
+			items, err = readChunk(ctx, tx, start, req.End, n)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if len(items) == 0 {
+			return nil
+		}
+		if err := stream.Send(&kvpb.SeekResponse{Items: items}); err != nil {
+			return err
+		}
+		sent += int64(len(items))
+		if int64(len(items)) < n {
+			return nil
+		}
+		start = append(append([]byte{}, items[len(items)-1].Key...), 0)
+	}
+}
+
+func readChunk(ctx context.Context, tx kv.OrderedTransaction, start, end []byte, n int64) ([]*kvpb.KeyValue, error) {
+	it, err := tx.Seek(ctx, start)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	var items []*kvpb.KeyValue
+	for int64(len(items)) < n {
+		k, v, err := it.Next(ctx)
+		if err == kv.ErrNotFound {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(end) > 0 && string(k) >= string(end) {
+			break
+		}
+		items = append(items, &kvpb.KeyValue{Key: append([]byte{}, k...), Value: append([]byte{}, v...)})
+	}
+	return items, nil
+}
+
+// DeleteRange deletes all keys from start to end, or to the end of the key
+// space for an empty end
+func (s *Server) DeleteRange(ctx context.Context, req *kvpb.DeleteRangeRequest) (*kvpb.DeleteRangeResponse, error) {
+	end := req.End
+	if len(end) == 0 {
+		end = nil
+	}
+	n, err := s.db.DeleteRange(ctx, req.Start, end)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &kvpb.DeleteRangeResponse{Deleted: n}, nil
+}
+
+// Begin starts a transaction. The backend transaction is bound to a server
+// side context, not to the request, so it outlives the call.
+func (s *Server) Begin(ctx context.Context, req *kvpb.BeginRequest) (*kvpb.BeginResponse, error) {
+	lease := time.Duration(req.LeaseMs) * time.Millisecond
+	if lease <= 0 {
+		lease = s.opts.DefaultLease
+	}
+	if lease > s.opts.MaxLease {
+		lease = s.opts.MaxLease
+	}
+
+	txCtx, cancel := context.WithTimeout(context.Background(), s.opts.MaxDuration)
+	tx, err := s.db.NewTransaction(txCtx, req.ReadOnly)
+	if err != nil {
+		cancel()
+		return nil, toStatus(err)
+	}
+
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		tx.Discard(txCtx)
+		cancel()
+		return nil, toStatus(err)
+	}
+	id := hex.EncodeToString(b[:])
+
+	t := &txn{tx: tx, lease: lease, deadline: time.Now().Add(s.opts.MaxDuration), cancel: cancel}
+	t.timer = time.AfterFunc(lease, func() { s.end(id) })
+	s.mu.Lock()
+	s.txns[id] = t
+	s.mu.Unlock()
+
+	return &kvpb.BeginResponse{Txn: id, LeaseMs: lease.Milliseconds()}, nil
+}
+
+// KeepAlive renews the lease of a transaction
+func (s *Server) KeepAlive(ctx context.Context, req *kvpb.KeepAliveRequest) (*kvpb.KeepAliveResponse, error) {
+	t, err := s.lookup(req.Txn)
+	if err != nil {
+		return nil, err
+	}
+	defer t.mu.Unlock()
+	return &kvpb.KeepAliveResponse{LeaseMs: t.lease.Milliseconds()}, nil
+}
+
+// Commit persists a transaction and releases its handle
+func (s *Server) Commit(ctx context.Context, req *kvpb.CommitRequest) (*kvpb.CommitResponse, error) {
+	t, err := s.lookup(req.Txn)
+	if err != nil {
+		return nil, err
+	}
+	err = t.tx.Commit(ctx)
+	t.mu.Unlock()
+	s.end(req.Txn)
+	return &kvpb.CommitResponse{}, toStatus(err)
+}
+
+// Discard drops a transaction and releases its handle. Unknown handles are
+// ignored, as they most likely expired.
+func (s *Server) Discard(ctx context.Context, req *kvpb.DiscardRequest) (*kvpb.DiscardResponse, error) {
+	s.end(req.Txn)
+	return &kvpb.DiscardResponse{}, nil
+}
@@ -0,0 +1,224 @@
+package grpcserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zatte/kv"
+	"github.com/zatte/kv/kvpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func serve(t *testing.T, opts Options) (*Server, *grpc.ClientConn) {
+	backend, err := kv.New("badger:///?memory=true")
+	require.NoError(t, err)
+
+	srv := New(backend, opts)
+	gs := grpc.NewServer(srv.ServerOptions()...)
+	kvpb.RegisterKVServer(gs, srv)
+	lis := bufconn.Listen(1 << 20)
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithInsecure(),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return srv, conn
+}
+
+func TestGrpc(t *testing.T) {
+	ctx := context.Background()
+	srv, conn := serve(t, Options{})
+	db := kv.NewGrpcDb(conn)
+
+	t.Run("get put delete", func(t *testing.T) {
+		key := []byte{0, 0xff, 'k'}
+		require.NoError(t, db.Put(ctx, key, []byte("value")))
+		v, err := db.Get(ctx, key)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("value"), v)
+
+		require.NoError(t, db.Put(ctx, []byte("empty"), nil))
+		v, err = db.Get(ctx, []byte("empty"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte{}, v)
+
+		require.NoError(t, db.Delete(ctx, key))
+		_, err = db.Get(ctx, key)
+		assert.Equal(t, kv.ErrNotFound, err)
+	})
+
+	t.Run("delete range", func(t *testing.T) {
+		for _, k := range []string{"range/a", "range/b", "range/c"} {
+			require.NoError(t, db.Put(ctx, []byte(k), []byte("v")))
+		}
+		n, err := db.DeleteRange(ctx, []byte("range/b"), []byte("range/z"))
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), n)
+		_, err = db.Get(ctx, []byte("range/a"))
+		assert.NoError(t, err)
+		_, err = db.Get(ctx, []byte("range/c"))
+		assert.Equal(t, kv.ErrNotFound, err)
+
+		n, err = db.DeleteRange(ctx, []byte("range/a"), []byte{})
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), n)
+		require.NoError(t, db.Delete(ctx, []byte("range/a")))
+	})
+
+	t.Run("transactions with streaming seek", func(t *testing.T) {
+		for i := 0; i < 250; i++ {
+			require.NoError(t, db.Put(ctx, []byte(fmt.Sprintf("seek/%03d", i)), []byte{byte(i)}))
+		}
+
+		tx, err := db.NewTransaction(ctx, false)
+		require.NoError(t, err)
+		require.NoError(t, tx.Put(ctx, []byte("seek/100a"), []byte("new")))
+		require.NoError(t, tx.Delete(ctx, []byte("seek/000")))
+
+		it, err := tx.Seek(ctx, []byte("seek/"))
+		require.NoError(t, err)
+		var keys []string
+		for {
+			k, _, err := it.Next(ctx)
+			if err == kv.ErrNotFound {
+				break
+			}
+			require.NoError(t, err)
+			keys = append(keys, string(k))
+			if len(keys) == 120 {
+				// other operations on the transaction work mid scan
+				_, err := tx.Get(ctx, []byte("seek/100a"))
+				require.NoError(t, err)
+			}
+		}
+		it.Close()
+		assert.Len(t, keys, 250)
+		assert.Equal(t, "seek/001", keys[0])
+		assert.Equal(t, "seek/100a", keys[100])
+
+		_, err = db.Get(ctx, []byte("seek/100a"))
+		assert.Equal(t, kv.ErrNotFound, err)
+		require.NoError(t, tx.Commit(ctx))
+		_, err = db.Get(ctx, []byte("seek/100a"))
+		assert.NoError(t, err)
+		assert.Equal(t, 0, srv.Transactions())
+	})
+
+	t.Run("conflicts", func(t *testing.T) {
+		t1, err := db.NewTransaction(ctx, false)
+		require.NoError(t, err)
+		t2, err := db.NewTransaction(ctx, false)
+		require.NoError(t, err)
+
+		_, err = t1.Get(ctx, []byte("conflict"))
+		assert.Equal(t, kv.ErrNotFound, err)
+		require.NoError(t, t1.Put(ctx, []byte("conflict"), []byte("1")))
+		_, err = t2.Get(ctx, []byte("conflict"))
+		assert.Equal(t, kv.ErrNotFound, err)
+		require.NoError(t, t2.Put(ctx, []byte("conflict"), []byte("2")))
+
+		require.NoError(t, t1.Commit(ctx))
+		assert.Equal(t, kv.ErrConflict, t2.Commit(ctx))
+	})
+
+	t.Run("read-only transactions", func(t *testing.T) {
+		tx, err := db.NewTransaction(ctx, true)
+		require.NoError(t, err)
+		defer tx.Discard(ctx)
+		assert.Equal(t, kv.ErrReadOnly, tx.Put(ctx, []byte("k"), []byte("v")))
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		client := kvpb.NewKVClient(conn)
+		res, err := client.Batch(ctx, &kvpb.BatchRequest{Ops: []*kvpb.Op{
+			{Type: kvpb.Op_PUT, Key: []byte("b1"), Value: []byte("1")},
+			{Type: kvpb.Op_GET, Key: []byte("b1")},
+			{Type: kvpb.Op_DELETE, Key: []byte("missing")},
+			{Type: kvpb.Op_GET, Key: []byte("missing")},
+		}})
+		require.NoError(t, err)
+		assert.Equal(t, []byte("1"), res.Results[1].Value)
+		assert.False(t, res.Results[3].Found)
+	})
+}
+
+func TestGrpcLeases(t *testing.T) {
+	ctx := context.Background()
+	srv, conn := serve(t, Options{MaxLease: 60 * time.Millisecond, MaxDuration: 400 * time.Millisecond})
+	client := kvpb.NewKVClient(conn)
+
+	t.Run("expired lease fails", func(t *testing.T) {
+		res, err := client.Begin(ctx, &kvpb.BeginRequest{LeaseMs: 10000})
+		require.NoError(t, err)
+		assert.Equal(t, int64(60), res.LeaseMs)
+
+		time.Sleep(150 * time.Millisecond)
+		_, err = client.Get(ctx, &kvpb.GetRequest{Txn: res.Txn, Key: []byte("k")})
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+		assert.Equal(t, 0, srv.Transactions())
+	})
+
+	t.Run("client keeps lease alive", func(t *testing.T) {
+		db := kv.NewGrpcDb(conn)
+		tx, err := db.NewTransaction(ctx, false)
+		require.NoError(t, err)
+		time.Sleep(200 * time.Millisecond)
+		require.NoError(t, tx.Put(ctx, []byte("k"), []byte("v")))
+		require.NoError(t, tx.Commit(ctx))
+	})
+
+	t.Run("maximum duration", func(t *testing.T) {
+		db := kv.NewGrpcDb(conn)
+		tx, err := db.NewTransaction(ctx, false)
+		require.NoError(t, err)
+		time.Sleep(450 * time.Millisecond)
+		assert.Equal(t, kv.ErrTxnExpired, tx.Put(ctx, []byte("k"), []byte("v")))
+		tx.Discard(ctx)
+	})
+}
+
+func TestGrpcToken(t *testing.T) {
+	ctx := context.Background()
+	_, conn := serve(t, Options{Token: "secret"})
+	client := kvpb.NewKVClient(conn)
+
+	_, err := client.Get(ctx, &kvpb.GetRequest{Key: []byte("k")})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	authCtx := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+	_, err = client.Get(authCtx, &kvpb.GetRequest{Key: []byte("k")})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	t.Run("token requires tls unless insecure", func(t *testing.T) {
+		backend, err := kv.New("badger:///?memory=true")
+		require.NoError(t, err)
+		srv := New(backend, Options{Token: "secret"})
+		gs := grpc.NewServer(srv.ServerOptions()...)
+		kvpb.RegisterKVServer(gs, srv)
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		go gs.Serve(lis)
+		defer gs.Stop()
+
+		_, err = kv.New("grpc://" + lis.Addr().String() + "?token=secret")
+		assert.Equal(t, kv.ErrInsecureToken, err)
+
+		db, err := kv.New("grpc://" + lis.Addr().String() + "?token=secret&insecure=true")
+		require.NoError(t, err)
+		_, err = db.Get(ctx, []byte("k"))
+		assert.Equal(t, kv.ErrNotFound, err)
+	})
+}
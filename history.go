@@ -0,0 +1,142 @@
+package kv
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ErrHistoryDisabled is returned by GetAt and History for stores opened
+// without history mode
+const ErrHistoryDisabled KvError = "history is not enabled"
+
+// HistoryOptions configures the history mode of a store, which retains
+// earlier values of keys. A revision is kept while it is among the Versions
+// newest revisions of its key or younger than Retention. Stores enable it with
+// the history and historyRetention connection string parameters, e.g.
+// badger:///./db?history=10&historyRetention=720h
+type HistoryOptions struct {
+	// Versions is the number of revisions kept per key, including the current
+	// value
+	Versions int
+	// Retention is how long revisions are kept regardless of Versions
+	Retention time.Duration
+}
+
+// Enabled reports whether history mode is on
+func (o HistoryOptions) Enabled() bool {
+	return o.Versions > 0 || o.Retention > 0
+}
+
+// historyOptionsFromUrl parses the history parameters of a connection string
+// and removes them from its query, leaving the parameters of the backend
+func historyOptionsFromUrl(u *url.URL) (HistoryOptions, error) {
+	var opts HistoryOptions
+	q := u.Query()
+	if v := q.Get("history"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return opts, ErrInvalidDb
+		}
+		opts.Versions = n
+	}
+	if v := q.Get("historyRetention"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return opts, ErrInvalidDb
+		}
+		opts.Retention = d
+	}
+	if opts.Enabled() {
+		q.Del("history")
+		q.Del("historyRetention")
+		u.RawQuery = q.Encode()
+	}
+	return opts, nil
+}
+
+// keep reports whether the revision at index i, counted from the newest, of
+// a key is retained at time now
+func (o HistoryOptions) keep(i int, t, now time.Time) bool {
+	return i < o.Versions || (o.Retention > 0 && now.Sub(t) < o.Retention)
+}
+
+// Revision is a value a key had from Time on. Deleted revisions record the
+// deletion of the key and have no value.
+type Revision struct {
+	Value   []byte
+	Time    time.Time
+	Deleted bool
+}
+
+// HistoryIterator yields the revisions of a key, newest first
+type HistoryIterator interface {
+	Next(ctx context.Context) (Revision, error)
+	Close() error
+}
+
+// Historian is implemented by stores with a history mode
+type Historian interface {
+	// GetAt returns the value key had at ts
+	GetAt(ctx context.Context, key []byte, ts time.Time) ([]byte, error)
+	// History iterates the retained revisions of key
+	History(ctx context.Context, key []byte) (HistoryIterator, error)
+}
+
+// GetAt returns the value key had at ts, or ErrNotFound if it did not exist
+// then or its revision is no longer retained. Returns ErrHistoryDisabled if db
+// does not retain history.
+func GetAt(ctx context.Context, db OrderedTransactional, key []byte, ts time.Time) ([]byte, error) {
+	if h, ok := db.(Historian); ok {
+		return h.GetAt(ctx, key, ts)
+	}
+	return nil, ErrHistoryDisabled
+}
+
+// History iterates the retained revisions of key, newest first. The iterator
+// returns ErrNotFound when exhausted and ErrHistoryDisabled is returned if db
+// does not retain history.
+func History(ctx context.Context, db OrderedTransactional, key []byte) (HistoryIterator, error) {
+	if h, ok := db.(Historian); ok {
+		return h.History(ctx, key)
+	}
+	return nil, ErrHistoryDisabled
+}
+
+// revisionIterator iterates revisions loaded up front, for backends emulating
+// history where the number of retained revisions per key is small
+type revisionIterator struct {
+	revisions []Revision
+}
+
+func (it *revisionIterator) Next(ctx context.Context) (Revision, error) {
+	if err := contextErr(ctx); err != nil {
+		return Revision{}, err
+	}
+	if len(it.revisions) == 0 {
+		return Revision{}, ErrNotFound
+	}
+	r := it.revisions[0]
+	it.revisions = it.revisions[1:]
+	return r, nil
+}
+
+func (it *revisionIterator) Close() error {
+	return nil
+}
+
+// revisionAt returns the revision current at ts from revisions sorted newest
+// first
+func revisionAt(revisions []Revision, ts time.Time) ([]byte, error) {
+	for _, r := range revisions {
+		if r.Time.After(ts) {
+			continue
+		}
+		if r.Deleted {
+			return nil, ErrNotFound
+		}
+		return r.Value, nil
+	}
+	return nil, ErrNotFound
+}
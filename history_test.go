@@ -0,0 +1,177 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory(t *testing.T) {
+	badger, err := New("badger:///?memory=true&history=10")
+	require.NoError(t, err)
+	sqlite, err := New("sqlite3:///file%3Ahistory%3Fmode%3Dmemory%26cache%3Dshared?history=10")
+	require.NoError(t, err)
+
+	testHistory(t, badger, "badger")
+	testHistory(t, sqlite, "gorm")
+	// history mode runs badger with managed transactions
+	testStores(t, badger, "badger history")
+
+	t.Run("disabled", func(t *testing.T) {
+		db, err := New("badger:///?memory=true")
+		require.NoError(t, err)
+		_, err = NewSnapshot(context.Background(), db, time.Now())
+		assert.Equal(t, ErrSnapshotUnsupported, err)
+		_, err = GetAt(context.Background(), db, []byte("a"), time.Now())
+		assert.Equal(t, ErrHistoryDisabled, err)
+		_, err = History(context.Background(), db, []byte("a"))
+		assert.Equal(t, ErrHistoryDisabled, err)
+	})
+
+	t.Run("retention", func(t *testing.T) {
+		ctx := context.Background()
+		db, err := New("sqlite3:///file%3Aretention%3Fmode%3Dmemory%26cache%3Dshared?history=2")
+		require.NoError(t, err)
+		for _, v := range []string{"1", "2", "3"} {
+			require.NoError(t, db.Put(ctx, []byte("a"), []byte(v)))
+		}
+		revs := revisions(t, db, []byte("a"))
+		require.Len(t, revs, 2)
+		assert.Equal(t, []byte("3"), revs[0].Value)
+		assert.Equal(t, []byte("2"), revs[1].Value)
+	})
+
+	t.Run("concurrent increments", func(t *testing.T) {
+		ctx := context.Background()
+		db, err := New("badger:///?memory=true&history=10")
+		require.NoError(t, err)
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 25; j++ {
+					_, err := Add(ctx, db, []byte("counter"), 1)
+					assert.NoError(t, err)
+					_, err = Add(ctx, struct{ OrderedTransactional }{db}, []byte("fallback"), 1)
+					assert.NoError(t, err)
+				}
+			}()
+		}
+		wg.Wait()
+		for _, key := range []string{"counter", "fallback"} {
+			v, err := db.Get(ctx, []byte(key))
+			require.NoError(t, err)
+			n, err := DecodeCounter(v)
+			require.NoError(t, err)
+			assert.Equal(t, int64(200), n, key)
+		}
+	})
+
+	t.Run("invalid options", func(t *testing.T) {
+		_, err := New("badger:///?memory=true&history=x")
+		assert.Equal(t, ErrInvalidDb, err)
+	})
+}
+
+func testHistory(t *testing.T, db OrderedTransactional, name string) {
+	ctx := context.Background()
+	// shared in-memory sqlite databases outlive a test run
+	run := fmt.Sprintf("%d/", time.Now().UnixNano())
+	key := []byte(run + "history")
+
+	t.Run(name+": revisions", func(t *testing.T) {
+		require.NoError(t, db.Put(ctx, key, []byte("1")))
+		t1 := time.Now()
+		tx, err := db.NewTransaction(ctx, false)
+		require.NoError(t, err)
+		require.NoError(t, tx.Put(ctx, key, []byte("2")))
+		require.NoError(t, tx.Commit(ctx))
+		t2 := time.Now()
+		require.NoError(t, db.Delete(ctx, key))
+		t3 := time.Now()
+		require.NoError(t, db.Put(ctx, key, []byte("3")))
+
+		v, err := GetAt(ctx, db, key, t1)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("1"), v)
+		v, err = GetAt(ctx, db, key, t2)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("2"), v)
+		_, err = GetAt(ctx, db, key, t3)
+		assert.Equal(t, ErrNotFound, err)
+		_, err = GetAt(ctx, db, key, t1.Add(-time.Hour))
+		assert.Equal(t, ErrNotFound, err)
+		v, err = GetAt(ctx, db, key, time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, []byte("3"), v)
+
+		revs := revisions(t, db, key)
+		require.Len(t, revs, 4)
+		assert.Equal(t, []byte("3"), revs[0].Value)
+		assert.True(t, revs[1].Deleted)
+		assert.Equal(t, []byte("2"), revs[2].Value)
+		assert.Equal(t, []byte("1"), revs[3].Value)
+		assert.True(t, revs[3].Time.Before(t1) || revs[3].Time.Equal(t1))
+		assert.True(t, revs[0].Time.After(t3))
+	})
+
+	t.Run(name+": snapshot", func(t *testing.T) {
+		if _, ok := db.(*BadgerDB); !ok {
+			_, err := NewSnapshot(ctx, db, time.Now())
+			assert.Equal(t, ErrSnapshotUnsupported, err)
+			return
+		}
+		require.NoError(t, db.Put(ctx, []byte(run+"snap/a"), []byte("1")))
+		require.NoError(t, db.Put(ctx, []byte(run+"snap/b"), []byte("1")))
+		ts := time.Now()
+		require.NoError(t, db.Put(ctx, []byte(run+"snap/a"), []byte("2")))
+		require.NoError(t, db.Delete(ctx, []byte(run+"snap/b")))
+		require.NoError(t, db.Put(ctx, []byte(run+"snap/c"), []byte("2")))
+
+		snap, err := NewSnapshot(ctx, db, ts)
+		require.NoError(t, err)
+		defer snap.Discard(ctx)
+		it, err := snap.Seek(ctx, []byte(run+"snap/"))
+		require.NoError(t, err)
+		defer it.Close()
+		var keys, values []string
+		for k, v, err := it.Next(ctx); err == nil && bytes.HasPrefix(k, []byte(run+"snap/")); k, v, err = it.Next(ctx) {
+			keys = append(keys, string(k))
+			values = append(values, string(v))
+		}
+		assert.Equal(t, []string{run + "snap/a", run + "snap/b"}, keys)
+		assert.Equal(t, []string{"1", "1"}, values)
+
+		_, err = snap.Get(ctx, []byte(run+"snap/c"))
+		assert.Equal(t, ErrNotFound, err)
+	})
+
+	t.Run(name+": delete range records deletions", func(t *testing.T) {
+		require.NoError(t, db.Put(ctx, []byte(run+"range/a"), []byte("a")))
+		_, err := db.DeleteRange(ctx, []byte(run+"range/"), PrefixEnd([]byte(run+"range/")))
+		require.NoError(t, err)
+		revs := revisions(t, db, []byte(run+"range/a"))
+		require.Len(t, revs, 2)
+		assert.True(t, revs[0].Deleted)
+	})
+}
+
+func revisions(t *testing.T, db OrderedTransactional, key []byte) []Revision {
+	ctx := context.Background()
+	it, err := History(ctx, db, key)
+	require.NoError(t, err)
+	defer it.Close()
+	var revs []Revision
+	for r, err := it.Next(ctx); err != ErrNotFound; r, err = it.Next(ctx) {
+		require.NoError(t, err)
+		revs = append(revs, r)
+	}
+	return revs
+}
@@ -0,0 +1,171 @@
+package instrumented
+
+import (
+	"context"
+	"time"
+
+	"github.com/zatte/kv"
+)
+
+type InstrumentedDb struct {
+	kv.OrderedTransactional
+	metrics *metrics
+}
+
+type InstrumentedDbTransaction struct {
+	kv.OrderedTransaction
+	metrics *metrics
+	done    bool
+}
+
+type InstrumentedDbIterator struct {
+	kv.Iterator
+	metrics *metrics
+}
+
+type metrics struct {
+	sink  Sink
+	store string
+}
+
+// New creates a DB that records operation counts, latencies, bytes and
+// transaction outcomes of db into sink, labeled with the store name.
+func New(db kv.OrderedTransactional, store string, sink Sink) *InstrumentedDb {
+	return &InstrumentedDb{db, &metrics{sink, store}}
+}
+
+func (m *metrics) record(op string, start time.Time, err error) {
+	result := ResultOk
+	switch err {
+	case nil:
+	case kv.ErrNotFound:
+		result = ResultNotFound
+	default:
+		result = ResultError
+	}
+	m.sink.Count(MetricOperations, Labels{LabelStore: m.store, LabelOp: op, LabelResult: result}, 1)
+	m.sink.Observe(MetricLatency, Labels{LabelStore: m.store, LabelOp: op}, time.Since(start).Seconds())
+}
+
+func (m *metrics) read(n int) {
+	m.sink.Count(MetricBytesRead, Labels{LabelStore: m.store}, float64(n))
+}
+
+func (m *metrics) written(n int) {
+	m.sink.Count(MetricBytesWritten, Labels{LabelStore: m.store}, float64(n))
+}
+
+func (m *metrics) transaction(result string) {
+	m.sink.Count(MetricTransactions, Labels{LabelStore: m.store, LabelResult: result}, 1)
+}
+
+// Get gets the value of a key within a single query transaction
+func (idb *InstrumentedDb) Get(ctx context.Context, key []byte) (res []byte, err error) {
+	defer func(start time.Time) { idb.metrics.record("get", start, err) }(time.Now())
+	res, err = idb.OrderedTransactional.Get(ctx, key)
+	idb.metrics.read(len(res))
+	return res, err
+}
+
+// Put sets the value of a key within a single query transaction
+func (idb *InstrumentedDb) Put(ctx context.Context, key, value []byte) (err error) {
+	defer func(start time.Time) { idb.metrics.record("put", start, err) }(time.Now())
+	idb.metrics.written(len(key) + len(value))
+	return idb.OrderedTransactional.Put(ctx, key, value)
+}
+
+// Delete removes a key within a single transaction
+func (idb *InstrumentedDb) Delete(ctx context.Context, key []byte) (err error) {
+	defer func(start time.Time) { idb.metrics.record("delete", start, err) }(time.Now())
+	return idb.OrderedTransactional.Delete(ctx, key)
+}
+
+// DeleteRange deletes all keys in [start, end)
+func (idb *InstrumentedDb) DeleteRange(ctx context.Context, start, end []byte) (n int64, err error) {
+	defer func(start time.Time) { idb.metrics.record("delete_range", start, err) }(time.Now())
+	return idb.OrderedTransactional.DeleteRange(ctx, start, end)
+}
+
+// NewTransaction for batching multiple values inside a transaction
+func (idb *InstrumentedDb) NewTransaction(ctx context.Context, readOnly bool) (tx kv.OrderedTransaction, err error) {
+	defer func(start time.Time) { idb.metrics.record("new_transaction", start, err) }(time.Now())
+	ot, err := idb.OrderedTransactional.NewTransaction(ctx, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return &InstrumentedDbTransaction{ot, idb.metrics, false}, nil
+}
+
+// instrumentedDbTransaction
+
+// Seek initializes an iterator at the given key (inclusive)
+func (tx *InstrumentedDbTransaction) Seek(ctx context.Context, StartKey []byte) (it kv.Iterator, err error) {
+	defer func(start time.Time) { tx.metrics.record("seek", start, err) }(time.Now())
+	it, err = tx.OrderedTransaction.Seek(ctx, StartKey)
+	if err != nil {
+		return nil, err
+	}
+	return &InstrumentedDbIterator{it, tx.metrics}, nil
+}
+
+// Get gets the value of a key within the transaction
+func (tx *InstrumentedDbTransaction) Get(ctx context.Context, key []byte) (res []byte, err error) {
+	defer func(start time.Time) { tx.metrics.record("get", start, err) }(time.Now())
+	res, err = tx.OrderedTransaction.Get(ctx, key)
+	tx.metrics.read(len(res))
+	return res, err
+}
+
+// Put sets the value of a key within the transaction
+func (tx *InstrumentedDbTransaction) Put(ctx context.Context, key, value []byte) (err error) {
+	defer func(start time.Time) { tx.metrics.record("put", start, err) }(time.Now())
+	tx.metrics.written(len(key) + len(value))
+	return tx.OrderedTransaction.Put(ctx, key, value)
+}
+
+// Delete removes a key within the transaction
+func (tx *InstrumentedDbTransaction) Delete(ctx context.Context, key []byte) (err error) {
+	defer func(start time.Time) { tx.metrics.record("delete", start, err) }(time.Now())
+	return tx.OrderedTransaction.Delete(ctx, key)
+}
+
+// Discard removes all sides effects of the transaction. Only the first call
+// to Discard or Commit is counted.
+func (tx *InstrumentedDbTransaction) Discard(ctx context.Context) (err error) {
+	defer func(start time.Time) { tx.metrics.record("discard", start, err) }(time.Now())
+	if !tx.done {
+		tx.done = true
+		tx.metrics.transaction(ResultDiscard)
+	}
+	return tx.OrderedTransaction.Discard(ctx)
+}
+
+// Commit persists all side effects of the transaction and counts the outcome
+func (tx *InstrumentedDbTransaction) Commit(ctx context.Context) (err error) {
+	defer func(start time.Time) { tx.metrics.record("commit", start, err) }(time.Now())
+	err = tx.OrderedTransaction.Commit(ctx)
+	if !tx.done {
+		tx.done = true
+		switch err {
+		case nil:
+			tx.metrics.transaction(ResultCommit)
+		case kv.ErrConflict:
+			tx.metrics.transaction(ResultConflict)
+		default:
+			tx.metrics.transaction(ResultError)
+		}
+	}
+	return err
+}
+
+// instrumentedDbIterator
+
+// Next yields the next key-value in iterator and counts the scanned row
+func (it *InstrumentedDbIterator) Next(ctx context.Context) (key, value []byte, err error) {
+	key, value, err = it.Iterator.Next(ctx)
+	if err == nil {
+		it.metrics.sink.Count(MetricRowsScanned, Labels{LabelStore: it.metrics.store}, 1)
+		it.metrics.read(len(key) + len(value))
+	}
+	return key, value, err
+}
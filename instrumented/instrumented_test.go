@@ -0,0 +1,106 @@
+package instrumented
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zatte/kv"
+)
+
+type memSink struct {
+	mu       sync.Mutex
+	counters map[string]float64
+	samples  map[string]int
+}
+
+func newMemSink() *memSink {
+	return &memSink{counters: map[string]float64{}, samples: map[string]int{}}
+}
+
+func series(name string, labels Labels) string {
+	parts := []string{}
+	for k, v := range labels {
+		parts = append(parts, k+"="+v)
+	}
+	sort.Strings(parts)
+	return name + "{" + strings.Join(parts, ",") + "}"
+}
+
+func (s *memSink) Count(name string, labels Labels, delta float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters[series(name, labels)] += delta
+}
+
+func (s *memSink) Observe(name string, labels Labels, value float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samples[series(name, labels)]++
+}
+
+func TestInstrumented(t *testing.T) {
+	ctx := context.Background()
+	raw, err := kv.New("badger:///?memory=true")
+	require.NoError(t, err)
+	sink := newMemSink()
+	db := New(raw, "test", sink)
+
+	require.NoError(t, db.Put(ctx, []byte("A"), []byte("12")))
+	require.NoError(t, db.Put(ctx, []byte("B"), []byte("3")))
+	_, err = db.Get(ctx, []byte("A"))
+	require.NoError(t, err)
+	_, err = db.Get(ctx, []byte("C"))
+	require.EqualError(t, err, kv.ErrNotFound.Error())
+
+	tx, err := db.NewTransaction(ctx, false)
+	require.NoError(t, err)
+	it, err := tx.Seek(ctx, []byte("A"))
+	require.NoError(t, err)
+	for _, _, err := it.Next(ctx); err == nil; _, _, err = it.Next(ctx) {
+	}
+	it.Close()
+	require.NoError(t, tx.Commit(ctx))
+	require.NoError(t, tx.Discard(ctx))
+
+	tx, err = db.NewTransaction(ctx, false)
+	require.NoError(t, err)
+	require.NoError(t, tx.Discard(ctx))
+
+	assert.Equal(t, float64(2), sink.counters[`kv_operations_total{op=put,result=ok,store=test}`])
+	assert.Equal(t, float64(1), sink.counters[`kv_operations_total{op=get,result=ok,store=test}`])
+	assert.Equal(t, float64(1), sink.counters[`kv_operations_total{op=get,result=not_found,store=test}`])
+	assert.Equal(t, 2, sink.samples[`kv_operation_duration_seconds{op=put,store=test}`])
+	assert.Equal(t, float64(5), sink.counters[`kv_bytes_written_total{store=test}`])
+	assert.Equal(t, float64(2+5), sink.counters[`kv_bytes_read_total{store=test}`])
+	assert.Equal(t, float64(2), sink.counters[`kv_iterator_rows_scanned_total{store=test}`])
+	assert.Equal(t, float64(1), sink.counters[`kv_transactions_total{result=commit,store=test}`])
+	assert.Equal(t, float64(1), sink.counters[`kv_transactions_total{result=discard,store=test}`])
+}
+
+func TestInstrumentedConflicts(t *testing.T) {
+	ctx := context.Background()
+	raw, err := kv.New("badger:///?memory=true")
+	require.NoError(t, err)
+	sink := newMemSink()
+	db := New(raw, "test", sink)
+
+	t1, err := db.NewTransaction(ctx, false)
+	require.NoError(t, err)
+	t2, err := db.NewTransaction(ctx, false)
+	require.NoError(t, err)
+
+	t1.Get(ctx, []byte("A"))
+	t2.Get(ctx, []byte("A"))
+	require.NoError(t, t1.Put(ctx, []byte("A"), []byte("1")))
+	require.NoError(t, t2.Put(ctx, []byte("A"), []byte("2")))
+	require.NoError(t, t1.Commit(ctx))
+	assert.EqualError(t, t2.Commit(ctx), kv.ErrConflict.Error())
+
+	assert.Equal(t, float64(1), sink.counters[`kv_transactions_total{result=commit,store=test}`])
+	assert.Equal(t, float64(1), sink.counters[`kv_transactions_total{result=conflict,store=test}`])
+}
@@ -0,0 +1,119 @@
+// Package promsink exposes the metrics of instrumented DBs through Prometheus.
+package promsink
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/zatte/kv/instrumented"
+)
+
+type metric struct {
+	help      string
+	labels    []string
+	histogram bool
+}
+
+// metrics recorded by instrumented DBs with their label names
+var metrics = map[string]metric{
+	instrumented.MetricOperations: {
+		"Number of kv operations by store, operation and result.",
+		[]string{instrumented.LabelStore, instrumented.LabelOp, instrumented.LabelResult}, false},
+	instrumented.MetricLatency: {
+		"Latency of kv operations in seconds by store and operation.",
+		[]string{instrumented.LabelStore, instrumented.LabelOp}, true},
+	instrumented.MetricBytesRead: {
+		"Number of key and value bytes read from a kv store.",
+		[]string{instrumented.LabelStore}, false},
+	instrumented.MetricBytesWritten: {
+		"Number of key and value bytes written to a kv store.",
+		[]string{instrumented.LabelStore}, false},
+	instrumented.MetricRowsScanned: {
+		"Number of rows returned by kv iterators.",
+		[]string{instrumented.LabelStore}, false},
+	instrumented.MetricTransactions: {
+		"Number of finished kv transactions by store and result.",
+		[]string{instrumented.LabelStore, instrumented.LabelResult}, false},
+}
+
+// Sink implements instrumented.Sink with a counter or histogram vector per
+// metric of package instrumented. Samples of other metrics are dropped.
+type Sink struct {
+	counters   map[string]*prometheus.CounterVec
+	histograms map[string]*prometheus.HistogramVec
+}
+
+// New creates a sink registering its metrics in reg. Histograms use the
+// default prometheus buckets.
+func New(reg prometheus.Registerer) (*Sink, error) {
+	return NewWithBuckets(reg, prometheus.DefBuckets)
+}
+
+// NewWithBuckets creates a sink where histograms use the given buckets. All
+// metrics are registered up front; metrics already registered by another sink
+// are shared, so multiple stores can use the same registry.
+func NewWithBuckets(reg prometheus.Registerer, buckets []float64) (*Sink, error) {
+	s := &Sink{
+		counters:   map[string]*prometheus.CounterVec{},
+		histograms: map[string]*prometheus.HistogramVec{},
+	}
+	for name, m := range metrics {
+		var (
+			c   prometheus.Collector
+			err error
+			ok  bool
+		)
+		if m.histogram {
+			c, err = register(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: m.help, Buckets: buckets}, m.labels))
+			if err == nil {
+				s.histograms[name], ok = c.(*prometheus.HistogramVec)
+			}
+		} else {
+			c, err = register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: m.help}, m.labels))
+			if err == nil {
+				s.counters[name], ok = c.(*prometheus.CounterVec)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("promsink: %s is already registered as %T", name, c)
+		}
+	}
+	return s, nil
+}
+
+// Count adds delta to a counter
+func (s *Sink) Count(name string, labels instrumented.Labels, delta float64) {
+	c, ok := s.counters[name]
+	if !ok {
+		return
+	}
+	if m, err := c.GetMetricWith(prometheus.Labels(labels)); err == nil {
+		m.Add(delta)
+	}
+}
+
+// Observe adds a sample to a histogram
+func (s *Sink) Observe(name string, labels instrumented.Labels, value float64) {
+	h, ok := s.histograms[name]
+	if !ok {
+		return
+	}
+	if m, err := h.GetMetricWith(prometheus.Labels(labels)); err == nil {
+		m.Observe(value)
+	}
+}
+
+// register returns the already registered collector if another sink
+// registered the same metric
+func register(reg prometheus.Registerer, c prometheus.Collector) (prometheus.Collector, error) {
+	if err := reg.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector, nil
+		}
+		return nil, err
+	}
+	return c, nil
+}
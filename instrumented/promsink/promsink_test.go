@@ -0,0 +1,41 @@
+package promsink
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zatte/kv/instrumented"
+)
+
+func TestSink(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	s1, err := New(reg)
+	require.NoError(t, err)
+	s2, err := New(reg)
+	require.NoError(t, err)
+
+	labels := instrumented.Labels{instrumented.LabelStore: "a", instrumented.LabelOp: "get", instrumented.LabelResult: "ok"}
+	s1.Count(instrumented.MetricOperations, labels, 1)
+	s2.Count(instrumented.MetricOperations, labels, 2)
+	s1.Observe(instrumented.MetricLatency, instrumented.Labels{instrumented.LabelStore: "a", instrumented.LabelOp: "get"}, 0.1)
+
+	assert.Equal(t, float64(3), testutil.ToFloat64(s1.counters[instrumented.MetricOperations].With(prometheus.Labels(labels))))
+	n, err := testutil.GatherAndCount(reg, instrumented.MetricLatency)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// Mismatched labels and unknown metrics are dropped instead of panicking
+	s1.Count(instrumented.MetricOperations, instrumented.Labels{"other": "x"}, 1)
+	s1.Count("unknown_total", labels, 1)
+}
+
+func TestSinkRegistrationError(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: instrumented.MetricBytesRead, Help: "conflicting"}))
+
+	_, err := New(reg)
+	assert.Error(t, err)
+}
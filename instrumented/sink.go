@@ -0,0 +1,48 @@
+package instrumented
+
+// Metric names recorded by an instrumented DB
+const (
+	// MetricOperations counts operations by store, op and result
+	MetricOperations = "kv_operations_total"
+	// MetricLatency observes the duration of operations in seconds by store and op
+	MetricLatency = "kv_operation_duration_seconds"
+	// MetricBytesRead counts value bytes returned by Get and key and value bytes
+	// returned by iterators by store
+	MetricBytesRead = "kv_bytes_read_total"
+	// MetricBytesWritten counts key and value bytes passed to Put by store
+	MetricBytesWritten = "kv_bytes_written_total"
+	// MetricRowsScanned counts rows returned by iterators by store
+	MetricRowsScanned = "kv_iterator_rows_scanned_total"
+	// MetricTransactions counts finished transactions by store and result.
+	// Result conflict is only counted for commits failing with kv.ErrConflict
+	// (badger, datastore, remote stores); gorm never returns it, so its
+	// conflicts are counted as error.
+	MetricTransactions = "kv_transactions_total"
+)
+
+// Label names and values
+const (
+	LabelStore  = "store"
+	LabelOp     = "op"
+	LabelResult = "result"
+
+	ResultOk       = "ok"
+	ResultNotFound = "not_found"
+	ResultError    = "error"
+	ResultCommit   = "commit"
+	ResultConflict = "conflict"
+	ResultDiscard  = "discard"
+)
+
+// Labels of a single metric sample. A metric is always recorded with the same
+// set of label names.
+type Labels map[string]string
+
+// Sink receives the metrics of an instrumented DB. Implementations must be
+// safe for concurrent use.
+type Sink interface {
+	// Count adds delta to a counter
+	Count(name string, labels Labels, delta float64)
+	// Observe adds a sample to a histogram
+	Observe(name string, labels Labels, value float64)
+}
@@ -48,7 +48,30 @@ type OrderedTransaction interface {
 	Commit(ctx context.Context) error
 }
 
+// RangeDeleter deletes all keys from start (inclusive) to end (exclusive), or
+// to the end of the key space for a nil end. Large ranges are deleted in
+// several batches, so the deletion is not atomic. The number of deleted keys
+// is returned, or -1 when the backend can not tell.
+type RangeDeleter interface {
+	DeleteRange(ctx context.Context, start, end []byte) (int64, error)
+}
+
 type OrderedTransactional interface {
 	Basic
+	RangeDeleter
 	NewTransaction(ctx context.Context, ReadOnly bool) (OrderedTransaction, error)
 }
+
+// PrefixEnd returns the first key after all keys starting with prefix, for use
+// as the exclusive end of a range. It returns nil, the end of the key space,
+// if there is none.
+func PrefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
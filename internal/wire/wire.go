@@ -0,0 +1,74 @@
+// Package wire holds the JSON types shared by the kv HTTP server and the
+// remote:// client. It must not import kv so both sides can use it.
+package wire
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Operations of a batch request
+const (
+	OpGet    = "get"
+	OpPut    = "put"
+	OpDelete = "delete"
+	// OpCheck only evaluates the preconditions of the op
+	OpCheck = "check"
+)
+
+// Item is a key/value returned by a scan
+type Item struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// ScanResponse is a page of a scan. Cursor is set when more items follow and
+// is passed as the cursor query parameter to fetch the next page.
+type ScanResponse struct {
+	Items  []Item `json:"items"`
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// Op is a single operation of a batch. IfMatch requires the key to exist with
+// the given ETag ("*" for any value), IfNoneMatch "*" requires it to be missing.
+type Op struct {
+	Op          string `json:"op"`
+	Key         []byte `json:"key"`
+	Value       []byte `json:"value,omitempty"`
+	IfMatch     string `json:"if_match,omitempty"`
+	IfNoneMatch string `json:"if_none_match,omitempty"`
+}
+
+// BatchRequest is executed in a single transaction
+type BatchRequest struct {
+	Ops []Op `json:"ops"`
+}
+
+// Result of an op in a batch. Get results carry the value when found.
+type Result struct {
+	Found bool   `json:"found"`
+	Value []byte `json:"value,omitempty"`
+	ETag  string `json:"etag,omitempty"`
+}
+
+// BatchResponse has one result per op of the request
+type BatchResponse struct {
+	Results []Result `json:"results"`
+}
+
+// DeleteRangeResponse reports the number of keys deleted by a range delete,
+// -1 if the store can not tell
+type DeleteRangeResponse struct {
+	Deleted int64 `json:"deleted"`
+}
+
+// Error is the body of all error responses
+type Error struct {
+	Error string `json:"error"`
+}
+
+// ETag returns the quoted strong ETag of a value
+func ETag(value []byte) string {
+	sum := sha256.Sum256(value)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
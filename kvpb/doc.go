@@ -0,0 +1,6 @@
+// Package kvpb holds the protobuf messages and gRPC service of a kv store
+// served over gRPC, see package grpcserver for the server and kv.New with a
+// grpc:// connection string for the client.
+package kvpb
+
+//go:generate protoc --go_out=plugins=grpc,paths=source_relative:. kv.proto
@@ -0,0 +1,171 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/zatte/kv"
+)
+
+// DefaultBatchSize is the number of keys copied per transaction by Backfill
+const DefaultBatchSize = 100
+
+// Checkpointer persists how far a backfill has come so it can be resumed
+type Checkpointer interface {
+	// Load returns the last copied key or nil if nothing was copied yet
+	Load(ctx context.Context) ([]byte, error)
+	// Save stores the last copied key
+	Save(ctx context.Context, key []byte) error
+}
+
+// KvCheckpoint stores the checkpoint under a single key of a kv store. Make
+// sure the key is outside of the key range that is copied.
+type KvCheckpoint struct {
+	DB  kv.Basic
+	Key []byte
+}
+
+// Load returns the last copied key or nil if nothing was copied yet
+func (c KvCheckpoint) Load(ctx context.Context) ([]byte, error) {
+	v, err := c.DB.Get(ctx, c.Key)
+	if err == kv.ErrNotFound {
+		return nil, nil
+	}
+	return v, err
+}
+
+// Save stores the last copied key
+func (c KvCheckpoint) Save(ctx context.Context, key []byte) error {
+	return c.DB.Put(ctx, c.Key, key)
+}
+
+// Backfill copies every key of src to dst in batches of batchSize keys read
+// from src, saving a checkpoint after each batch so an interrupted backfill
+// resumes where it stopped. Keys are created one by one with kv.PutIfVersion;
+// keys that already exist in dst are left untouched, as they are expected to
+// have been written by a mirrored DB and be newer; start mirroring writes
+// before the backfill. A nil checkpointer always starts from
+// the beginning. Returns the number of copied keys.
+//
+// A key deleted through the mirror between reading a batch from src and
+// writing it to dst would come back on dst, so the copied keys are looked up
+// in src again once written and removed from dst if they are gone.
+func Backfill(ctx context.Context, src, dst kv.OrderedTransactional, cp Checkpointer, batchSize int) (int, error) {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	var start []byte
+	if cp != nil {
+		last, err := cp.Load(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if last != nil {
+			start = append(append([]byte{}, last...), 0) // first key after the last copied
+		}
+	}
+
+	copied := 0
+	for {
+		keys, values, err := readBatch(ctx, src, start, batchSize)
+		if err != nil {
+			return copied, err
+		}
+		if len(keys) == 0 {
+			return copied, nil
+		}
+
+		written, err := writeBatch(ctx, dst, keys, values)
+		if err != nil {
+			return copied, err
+		}
+		if err := dropDeleted(ctx, src, dst, written); err != nil {
+			return copied, err
+		}
+		copied += len(written)
+
+		last := keys[len(keys)-1]
+		if cp != nil {
+			if err := cp.Save(ctx, last); err != nil {
+				return copied, err
+			}
+		}
+		start = append(append([]byte{}, last...), 0)
+	}
+}
+
+func readBatch(ctx context.Context, src kv.OrderedTransactional, start []byte, n int) (keys, values [][]byte, err error) {
+	tx, err := src.NewTransaction(ctx, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Discard(ctx)
+
+	it, err := tx.Seek(ctx, start)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer it.Close()
+
+	for len(keys) < n {
+		k, v, err := it.Next(ctx)
+		if err == kv.ErrNotFound {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, append([]byte{}, k...))
+		values = append(values, append([]byte{}, v...))
+	}
+	return keys, values, nil
+}
+
+// writeBatch creates the keys missing in dst and returns the written pairs.
+// Every key is created with kv.PutIfVersion, so a mirrored write landing after
+// the key was found missing is never overwritten by the older source value,
+// even on stores whose transactions do not detect such conflicts.
+func writeBatch(ctx context.Context, dst kv.OrderedTransactional, keys, values [][]byte) (map[string][]byte, error) {
+	written := map[string][]byte{}
+	for i, k := range keys {
+		err := kv.PutIfVersion(ctx, dst, k, values[i], kv.VersionNotExist)
+		if err == kv.ErrVersionMismatch {
+			continue // already written through the mirror
+		}
+		if err != nil {
+			return nil, err
+		}
+		written[string(k)] = values[i]
+	}
+	return written, nil
+}
+
+// dropDeleted deletes the written keys that no longer exist in src from dst,
+// unless dst has been written since
+func dropDeleted(ctx context.Context, src, dst kv.OrderedTransactional, written map[string][]byte) error {
+	for k := range written {
+		_, err := src.Get(ctx, []byte(k))
+		if err == nil {
+			continue
+		}
+		if err != kv.ErrNotFound {
+			return err
+		}
+		v, version, err := kv.GetWithVersion(ctx, dst, []byte(k))
+		if err == kv.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(v, written[k]) {
+			continue
+		}
+		err = kv.DeleteIfVersion(ctx, dst, []byte(k), version)
+		if err != nil && err != kv.ErrVersionMismatch {
+			return err
+		}
+	}
+	return nil
+}
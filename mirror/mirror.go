@@ -0,0 +1,228 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/zatte/kv"
+)
+
+// Side selects one of the two mirrored DBs
+type Side int
+
+const (
+	Primary Side = iota
+	Secondary
+)
+
+// Divergence describes a key where a shadow read found different results on
+// the primary and the secondary.
+type Divergence struct {
+	Key            []byte
+	PrimaryValue   []byte
+	PrimaryErr     error
+	SecondaryValue []byte
+	SecondaryErr   error
+}
+
+// Options configures a mirrored DB. The zero value reads from the primary,
+// does no shadow reads and fails writes when the secondary fails.
+type Options struct {
+	// ReadFrom is the side serving Get and Seek
+	ReadFrom Side
+	// OnDivergence enables shadow reads when set: every Get is also served by
+	// the other side and differences are reported.
+	OnDivergence func(ctx context.Context, d Divergence)
+	// OnSecondaryError, when set, is called for failed writes and commits on
+	// the secondary instead of returning the error to the caller.
+	OnSecondaryError func(ctx context.Context, err error)
+}
+
+// SecondaryError is returned for a write or commit that failed on the
+// secondary after it succeeded on the primary. The write has landed on the
+// primary and must not be retried as a whole, so the error of the secondary
+// is deliberately not unwrapped: a conflict on the secondary never matches
+// kv.ErrConflict.
+type SecondaryError struct {
+	Err error
+}
+
+func (e *SecondaryError) Error() string {
+	return "secondary: " + e.Err.Error()
+}
+
+// MirrorDb writes to a primary and a secondary DB. The primary is written
+// first; if it fails the secondary is not written at all.
+type MirrorDb struct {
+	primary   kv.OrderedTransactional
+	secondary kv.OrderedTransactional
+	opts      Options
+}
+
+// MirrorDbTransaction holds a transaction on each side. Commit commits the
+// primary first and only then the secondary; the two commits are not atomic.
+type MirrorDbTransaction struct {
+	primary   kv.OrderedTransaction
+	secondary kv.OrderedTransaction
+	opts      Options
+}
+
+// New creates a DB mirroring all writes to primary and secondary
+func New(primary, secondary kv.OrderedTransactional, opts Options) *MirrorDb {
+	return &MirrorDb{primary, secondary, opts}
+}
+
+// NewFromStr creates a mirrored DB. Supports all connections strings of kv.New()
+func NewFromStr(primary, secondary string, opts Options) (*MirrorDb, error) {
+	p, err := kv.New(primary)
+	if err != nil {
+		return nil, err
+	}
+	s, err := kv.New(secondary)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(p, s, opts), nil
+}
+
+// secondaryErr reports err through OnSecondaryError if set, otherwise returns
+// it as a *SecondaryError
+func (o Options) secondaryErr(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if o.OnSecondaryError != nil {
+		o.OnSecondaryError(ctx, err)
+		return nil
+	}
+	return &SecondaryError{err}
+}
+
+// read serves a read from the configured side and compares it with the other
+// side when shadow reads are enabled.
+func (o Options) read(ctx context.Context, key []byte, primary, secondary kv.Basic) ([]byte, error) {
+	main, shadow := primary, secondary
+	if o.ReadFrom == Secondary {
+		main, shadow = secondary, primary
+	}
+	v, err := main.Get(ctx, key)
+	if o.OnDivergence == nil {
+		return v, err
+	}
+
+	sv, serr := shadow.Get(ctx, key)
+	if err != serr || !bytes.Equal(v, sv) {
+		d := Divergence{Key: key, PrimaryValue: v, PrimaryErr: err, SecondaryValue: sv, SecondaryErr: serr}
+		if o.ReadFrom == Secondary {
+			d.PrimaryValue, d.PrimaryErr, d.SecondaryValue, d.SecondaryErr = sv, serr, v, err
+		}
+		o.OnDivergence(ctx, d)
+	}
+	return v, err
+}
+
+// Get gets the value of a key from the configured side
+func (mdb *MirrorDb) Get(ctx context.Context, key []byte) ([]byte, error) {
+	return mdb.opts.read(ctx, key, mdb.primary, mdb.secondary)
+}
+
+// Put sets the value of a key on the primary and then on the secondary
+func (mdb *MirrorDb) Put(ctx context.Context, key, value []byte) error {
+	if err := mdb.primary.Put(ctx, key, value); err != nil {
+		return err
+	}
+	return mdb.opts.secondaryErr(ctx, mdb.secondary.Put(ctx, key, value))
+}
+
+// Delete removes a key on the primary and then on the secondary. A key missing
+// on the secondary only is not an error.
+func (mdb *MirrorDb) Delete(ctx context.Context, key []byte) error {
+	if err := mdb.primary.Delete(ctx, key); err != nil {
+		return err
+	}
+	err := mdb.secondary.Delete(ctx, key)
+	if err == kv.ErrNotFound {
+		err = nil
+	}
+	return mdb.opts.secondaryErr(ctx, err)
+}
+
+// DeleteRange deletes all keys in [start, end) on the primary and then on the
+// secondary. The number of keys deleted on the primary is returned.
+func (mdb *MirrorDb) DeleteRange(ctx context.Context, start, end []byte) (int64, error) {
+	n, err := mdb.primary.DeleteRange(ctx, start, end)
+	if err != nil {
+		return n, err
+	}
+	_, err = mdb.secondary.DeleteRange(ctx, start, end)
+	return n, mdb.opts.secondaryErr(ctx, err)
+}
+
+// NewTransaction opens a transaction on both sides
+func (mdb *MirrorDb) NewTransaction(ctx context.Context, readOnly bool) (kv.OrderedTransaction, error) {
+	p, err := mdb.primary.NewTransaction(ctx, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	s, err := mdb.secondary.NewTransaction(ctx, readOnly)
+	if err != nil {
+		p.Discard(ctx)
+		return nil, err
+	}
+	return &MirrorDbTransaction{p, s, mdb.opts}, nil
+}
+
+// mirrorDbTransaction
+
+// Seek initializes an iterator at the given key (inclusive) on the configured side
+func (tx *MirrorDbTransaction) Seek(ctx context.Context, StartKey []byte) (kv.Iterator, error) {
+	if tx.opts.ReadFrom == Secondary {
+		return tx.secondary.Seek(ctx, StartKey)
+	}
+	return tx.primary.Seek(ctx, StartKey)
+}
+
+// Get gets the value of a key within the transaction from the configured side
+func (tx *MirrorDbTransaction) Get(ctx context.Context, key []byte) ([]byte, error) {
+	return tx.opts.read(ctx, key, tx.primary, tx.secondary)
+}
+
+// Put sets the value of a key in both transactions
+func (tx *MirrorDbTransaction) Put(ctx context.Context, key, value []byte) error {
+	if err := tx.primary.Put(ctx, key, value); err != nil {
+		return err
+	}
+	return tx.opts.secondaryErr(ctx, tx.secondary.Put(ctx, key, value))
+}
+
+// Delete removes a key in both transactions
+func (tx *MirrorDbTransaction) Delete(ctx context.Context, key []byte) error {
+	if err := tx.primary.Delete(ctx, key); err != nil {
+		return err
+	}
+	err := tx.secondary.Delete(ctx, key)
+	if err == kv.ErrNotFound {
+		err = nil
+	}
+	return tx.opts.secondaryErr(ctx, err)
+}
+
+// Discard removes all sides effects of both transactions
+func (tx *MirrorDbTransaction) Discard(ctx context.Context) error {
+	serr := tx.secondary.Discard(ctx)
+	if err := tx.primary.Discard(ctx); err != nil {
+		return err
+	}
+	return serr
+}
+
+// Commit commits the primary and, if that succeeds, the secondary transaction.
+// A failed secondary commit is returned as a *SecondaryError.
+func (tx *MirrorDbTransaction) Commit(ctx context.Context) error {
+	if err := tx.primary.Commit(ctx); err != nil {
+		tx.secondary.Discard(ctx)
+		return err
+	}
+	return tx.opts.secondaryErr(ctx, tx.secondary.Commit(ctx))
+}
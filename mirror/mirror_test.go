@@ -0,0 +1,174 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zatte/kv"
+)
+
+func TestMirror(t *testing.T) {
+	ctx := context.Background()
+	primary, err := kv.New("badger:///?memory=true")
+	require.NoError(t, err)
+	secondary, err := kv.New("badger:///?memory=true")
+	require.NoError(t, err)
+
+	var divergences []Divergence
+	db := New(primary, secondary, Options{
+		ReadFrom: Secondary,
+		OnDivergence: func(ctx context.Context, d Divergence) {
+			divergences = append(divergences, d)
+		},
+	})
+
+	t.Run("writes go to both sides", func(t *testing.T) {
+		require.NoError(t, db.Put(ctx, []byte("A"), []byte("1")))
+
+		tx, err := db.NewTransaction(ctx, false)
+		require.NoError(t, err)
+		require.NoError(t, tx.Put(ctx, []byte("B"), []byte("2")))
+		require.NoError(t, tx.Commit(ctx))
+
+		for _, side := range []kv.OrderedTransactional{primary, secondary} {
+			v, err := side.Get(ctx, []byte("A"))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("1"), v)
+			v, err = side.Get(ctx, []byte("B"))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("2"), v)
+		}
+		assert.Empty(t, divergences)
+	})
+
+	t.Run("shadow reads report divergences", func(t *testing.T) {
+		require.NoError(t, primary.Put(ctx, []byte("C"), []byte("3")))
+
+		_, err := db.Get(ctx, []byte("C"))
+		assert.EqualError(t, err, kv.ErrNotFound.Error(), "served from the secondary")
+
+		require.Len(t, divergences, 1)
+		assert.Equal(t, []byte("C"), divergences[0].Key)
+		assert.Equal(t, []byte("3"), divergences[0].PrimaryValue)
+		assert.Equal(t, kv.ErrNotFound, divergences[0].SecondaryErr)
+	})
+
+	t.Run("secondary errors can be reported instead of returned", func(t *testing.T) {
+		var reported []error
+		db := New(primary, secondary, Options{OnSecondaryError: func(ctx context.Context, err error) {
+			reported = append(reported, err)
+		}})
+		tx, err := db.NewTransaction(ctx, true)
+		require.NoError(t, err)
+		defer tx.Discard(ctx)
+		assert.EqualError(t, tx.Put(ctx, []byte("D"), []byte("4")), kv.ErrReadOnly.Error())
+		assert.Empty(t, reported, "primary errors are always returned")
+	})
+
+	t.Run("secondary conflicts after the primary committed are not conflicts", func(t *testing.T) {
+		require.NoError(t, db.Put(ctx, []byte("E"), []byte("1")))
+		tx, err := db.NewTransaction(ctx, false)
+		require.NoError(t, err)
+		_, err = tx.Get(ctx, []byte("E")) // read from the secondary
+		require.NoError(t, err)
+		require.NoError(t, tx.Put(ctx, []byte("E"), []byte("2")))
+		require.NoError(t, secondary.Put(ctx, []byte("E"), []byte("3")))
+
+		err = tx.Commit(ctx)
+		var serr *SecondaryError
+		require.True(t, errors.As(err, &serr))
+		assert.Equal(t, kv.ErrConflict, serr.Err)
+		assert.False(t, errors.Is(err, kv.ErrConflict))
+		v, err := primary.Get(ctx, []byte("E"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte("2"), v)
+	})
+}
+
+func TestBackfill(t *testing.T) {
+	ctx := context.Background()
+	src, err := kv.New("badger:///?memory=true")
+	require.NoError(t, err)
+	dst, err := kv.New("badger:///?memory=true")
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, src.Put(ctx, []byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%d", i))))
+	}
+	require.NoError(t, dst.Put(ctx, []byte("k1"), []byte("newer")))
+
+	cp := KvCheckpoint{dst, []byte("\xffbackfill")}
+	n, err := Backfill(ctx, src, dst, cp, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 4, n)
+
+	v, err := dst.Get(ctx, []byte("k1"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("newer"), v, "existing keys are not overwritten")
+	v, err = dst.Get(ctx, []byte("k4"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v4"), v)
+
+	last, err := cp.Load(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("k4"), last)
+
+	require.NoError(t, src.Put(ctx, []byte("k0"), []byte("not copied again")))
+	require.NoError(t, src.Put(ctx, []byte("k5"), []byte("v5")))
+	n, err = Backfill(ctx, src, dst, cp, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n, "resumes after the checkpoint")
+}
+
+func TestBackfillDropsKeysDeletedWhileCopying(t *testing.T) {
+	ctx := context.Background()
+	src, err := kv.New("badger:///?memory=true")
+	require.NoError(t, err)
+	dst, err := kv.New("badger:///?memory=true")
+	require.NoError(t, err)
+	require.NoError(t, src.Put(ctx, []byte("a"), []byte("1")))
+	require.NoError(t, src.Put(ctx, []byte("b"), []byte("1")))
+
+	keys, values, err := readBatch(ctx, src, nil, 10)
+	require.NoError(t, err)
+	// deleted through the mirror after the batch was read
+	require.NoError(t, New(src, dst, Options{}).Delete(ctx, []byte("a")))
+	written, err := writeBatch(ctx, dst, keys, values)
+	require.NoError(t, err)
+	require.NoError(t, dropDeleted(ctx, src, dst, written))
+
+	_, err = dst.Get(ctx, []byte("a"))
+	assert.Equal(t, kv.ErrNotFound, err)
+	v, err := dst.Get(ctx, []byte("b"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("1"), v)
+}
+
+func TestBackfillKeepsMirroredWritesOnSql(t *testing.T) {
+	ctx := context.Background()
+	src, err := kv.New("badger:///?memory=true")
+	require.NoError(t, err)
+	dst, err := kv.New("sqlite3:///file%3Abackfill%3Fmode%3Dmemory%26cache%3Dshared")
+	require.NoError(t, err)
+	prefix := fmt.Sprintf("backfill/%d/", time.Now().UnixNano())
+	a, b := []byte(prefix+"a"), []byte(prefix+"b")
+	require.NoError(t, src.Put(ctx, a, []byte("old")))
+	require.NoError(t, src.Put(ctx, b, []byte("old")))
+
+	keys, values, err := readBatch(ctx, src, []byte(prefix), 10)
+	require.NoError(t, err)
+	// written through the mirror after the batch was read
+	require.NoError(t, New(src, dst, Options{}).Put(ctx, b, []byte("new")))
+	written, err := writeBatch(ctx, dst, keys, values)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]byte{string(a): []byte("old")}, written)
+
+	v, err := dst.Get(ctx, b)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("new"), v)
+}
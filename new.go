@@ -1,11 +1,21 @@
 package kv
 
 import (
+	"context"
 	"net/url"
 )
 
 // New opens up a new db based on a connection string.
 func New(connectionString string) (OrderedTransactional, error) {
+	return NewWithContext(context.Background(), connectionString)
+}
+
+// NewWithContext opens up a new db based on a connection string. ctx is used
+// while connecting and by clients that keep a context for their lifetime.
+func NewWithContext(ctx context.Context, connectionString string) (OrderedTransactional, error) {
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
 	u, err := url.Parse(connectionString)
 	if err != nil {
 		return nil, err
@@ -13,9 +23,13 @@ func New(connectionString string) (OrderedTransactional, error) {
 
 	switch u.Scheme {
 	case "datastore":
-		return NewDatastoreDbFromUrl(u)
+		return NewDatastoreDbFromUrlWithContext(ctx, u)
 	case "badger":
 		return NewBadgerDbFromUrl(u)
+	case "remote":
+		return NewRemoteDbFromUrl(u)
+	case "grpc":
+		return NewGrpcDbFromUrl(u)
 	default:
 		return NewGormDbFromUrl(u)
 	}
@@ -0,0 +1,67 @@
+package readonly
+
+import (
+	"context"
+
+	"github.com/zatte/kv"
+)
+
+// ReadOnlyDb rejects all writes with kv.ErrReadOnly and only opens read-only
+// transactions on the underlying DB.
+type ReadOnlyDb struct {
+	kv.OrderedTransactional
+}
+
+type ReadOnlyDbTransaction struct {
+	kv.OrderedTransaction
+}
+
+// New creates a read-only handle of db, safe to hand out to code that must
+// never write.
+func New(db kv.OrderedTransactional) *ReadOnlyDb {
+	return &ReadOnlyDb{db}
+}
+
+// NewFromStr creates a read-only DB. Supports all connections strings of kv.New()
+func NewFromStr(connectionString string) (*ReadOnlyDb, error) {
+	db, err := kv.New(connectionString)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(db), nil
+}
+
+// Put always fails with kv.ErrReadOnly
+func (rdb *ReadOnlyDb) Put(ctx context.Context, key, value []byte) error {
+	return kv.ErrReadOnly
+}
+
+// Delete always fails with kv.ErrReadOnly
+func (rdb *ReadOnlyDb) Delete(ctx context.Context, key []byte) error {
+	return kv.ErrReadOnly
+}
+
+// DeleteRange always fails with kv.ErrReadOnly
+func (rdb *ReadOnlyDb) DeleteRange(ctx context.Context, start, end []byte) (int64, error) {
+	return 0, kv.ErrReadOnly
+}
+
+// NewTransaction opens a read-only transaction regardless of readOnly
+func (rdb *ReadOnlyDb) NewTransaction(ctx context.Context, readOnly bool) (kv.OrderedTransaction, error) {
+	ot, err := rdb.OrderedTransactional.NewTransaction(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	return &ReadOnlyDbTransaction{ot}, nil
+}
+
+// Put always fails with kv.ErrReadOnly
+func (tx *ReadOnlyDbTransaction) Put(ctx context.Context, key, value []byte) error {
+	return kv.ErrReadOnly
+}
+
+// Delete always fails with kv.ErrReadOnly
+func (tx *ReadOnlyDbTransaction) Delete(ctx context.Context, key []byte) error {
+	return kv.ErrReadOnly
+}
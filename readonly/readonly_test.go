@@ -0,0 +1,41 @@
+package readonly
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zatte/kv"
+)
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	raw, err := kv.New("badger:///?memory=true")
+	require.NoError(t, err)
+	require.NoError(t, raw.Put(ctx, []byte("A"), []byte("1")))
+
+	db := New(raw)
+	assert.EqualError(t, db.Put(ctx, []byte("A"), []byte("2")), kv.ErrReadOnly.Error())
+	assert.EqualError(t, db.Delete(ctx, []byte("A")), kv.ErrReadOnly.Error())
+	_, err = db.DeleteRange(ctx, nil, nil)
+	assert.EqualError(t, err, kv.ErrReadOnly.Error())
+
+	v, err := db.Get(ctx, []byte("A"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), v)
+
+	tx, err := db.NewTransaction(ctx, false)
+	require.NoError(t, err)
+	defer tx.Discard(ctx)
+	assert.EqualError(t, tx.Put(ctx, []byte("A"), []byte("2")), kv.ErrReadOnly.Error())
+	assert.EqualError(t, tx.Delete(ctx, []byte("A")), kv.ErrReadOnly.Error())
+
+	it, err := tx.Seek(ctx, []byte("A"))
+	require.NoError(t, err)
+	defer it.Close()
+	k, v, err := it.Next(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("A"), k)
+	assert.Equal(t, []byte("1"), v)
+}
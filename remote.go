@@ -0,0 +1,375 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zatte/kv/internal/wire"
+)
+
+// remoteScanPageSize is the number of key/values fetched per scan request
+const remoteScanPageSize = 100
+
+// RemoteDB is a client for a store served over HTTP by the server package
+type RemoteDB struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+// remoteTransaction buffers writes until Commit and remembers the ETag of
+// every key read. Commit sends all writes as one batch that only succeeds if
+// none of the read keys changed, otherwise ErrConflict is returned. Scanned
+// keys are not checked.
+type remoteTransaction struct {
+	*RemoteDB
+	readOnly bool
+	reads    map[string]string // key to ETag, "" for keys that did not exist
+	writes   map[string][]byte // nil values are deletes
+}
+
+type remoteIterator struct {
+	tx     *remoteTransaction
+	start  []byte
+	page   []wire.Item
+	cursor string
+	more   bool
+	writes []string // buffered written keys from start, sorted
+}
+
+// NewRemoteDbFromUrl connects to a kv server, e.g.
+// remote://host:8080/prefix?token=secret&tls=true. Tokens are only sent over
+// https unless insecure=true is set, e.g. for a server on localhost.
+func NewRemoteDbFromUrl(u *url.URL) (*RemoteDB, error) {
+	q := u.Query()
+	scheme := "http"
+	if q.Get("tls") == "true" {
+		scheme = "https"
+	}
+	token := q.Get("token")
+	if token != "" && scheme != "https" && q.Get("insecure") != "true" {
+		return nil, ErrInsecureToken
+	}
+	return &RemoteDB{
+		base:   scheme + "://" + u.Host + strings.TrimSuffix(u.Path, "/"),
+		token:  token,
+		client: &http.Client{},
+	}, nil
+}
+
+// do sends a request and maps error responses to kv errors. The caller closes
+// the body of successful responses.
+func (rdb *RemoteDB) do(ctx context.Context, method, path string, body []byte, header http.Header) (*http.Response, error) {
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, rdb.base+path, r)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if rdb.token != "" {
+		req.Header.Set("Authorization", "Bearer "+rdb.token)
+	}
+
+	resp, err := rdb.client.Do(req)
+	if err != nil {
+		return nil, backendErr(ctx, err)
+	}
+	if resp.StatusCode < 400 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	e := wire.Error{}
+	json.NewDecoder(resp.Body).Decode(&e)
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		// other 404s, e.g. of a wrong base path, are not missing keys
+		if e.Error == ErrNotFound.Error() {
+			return nil, ErrNotFound
+		}
+	case http.StatusConflict, http.StatusPreconditionFailed:
+		return nil, ErrConflict
+	case http.StatusForbidden:
+		return nil, ErrReadOnly
+	}
+	return nil, fmt.Errorf("kv: remote %s: %s", resp.Status, e.Error)
+}
+
+func (rdb *RemoteDB) doJSON(ctx context.Context, method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	resp, err := rdb.do(ctx, method, path, body, http.Header{"Content-Type": {"application/json"}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return backendErr(ctx, json.NewDecoder(resp.Body).Decode(out))
+}
+
+func keyPath(key []byte) string {
+	return "/keys/" + url.PathEscape(string(key))
+}
+
+// Get gets the value of a key
+func (rdb *RemoteDB) Get(ctx context.Context, key []byte) ([]byte, error) {
+	v, _, err := rdb.GetWithETag(ctx, key)
+	return v, err
+}
+
+// GetWithETag gets the value of a key and its ETag for PutIfMatch
+func (rdb *RemoteDB) GetWithETag(ctx context.Context, key []byte) ([]byte, string, error) {
+	resp, err := rdb.do(ctx, http.MethodGet, keyPath(key), nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	v, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", backendErr(ctx, err)
+	}
+	return v, resp.Header.Get("ETag"), nil
+}
+
+// Put sets the value of a key
+func (rdb *RemoteDB) Put(ctx context.Context, key, value []byte) error {
+	return rdb.put(ctx, key, value, nil)
+}
+
+// PutIfMatch sets the value of a key only if its current ETag is etag, or if
+// it does not exist for an empty etag. Returns ErrConflict otherwise.
+func (rdb *RemoteDB) PutIfMatch(ctx context.Context, key, value []byte, etag string) error {
+	if etag == "" {
+		return rdb.put(ctx, key, value, http.Header{"If-None-Match": {"*"}})
+	}
+	return rdb.put(ctx, key, value, http.Header{"If-Match": {etag}})
+}
+
+func (rdb *RemoteDB) put(ctx context.Context, key, value []byte, header http.Header) error {
+	if value == nil {
+		value = []byte{}
+	}
+	resp, err := rdb.do(ctx, http.MethodPut, keyPath(key), value, header)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Delete removes a key
+func (rdb *RemoteDB) Delete(ctx context.Context, key []byte) error {
+	resp, err := rdb.do(ctx, http.MethodDelete, keyPath(key), nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// DeleteRange deletes all keys in [start, end) on the server
+func (rdb *RemoteDB) DeleteRange(ctx context.Context, start, end []byte) (int64, error) {
+	// an empty end is sent as the end of the key space
+	if end != nil && bytes.Compare(start, end) >= 0 {
+		return 0, contextErr(ctx)
+	}
+	q := url.Values{"start": {string(start)}}
+	if end != nil {
+		q.Set("end", string(end))
+	}
+	res := wire.DeleteRangeResponse{}
+	err := rdb.doJSON(ctx, http.MethodDelete, "/range?"+q.Encode(), nil, &res)
+	return res.Deleted, err
+}
+
+// NewTransaction starts a client side transaction, see remoteTransaction
+func (rdb *RemoteDB) NewTransaction(ctx context.Context, readOnly bool) (OrderedTransaction, error) {
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	return &remoteTransaction{rdb, readOnly, map[string]string{}, map[string][]byte{}}, nil
+}
+
+// remoteTransaction
+
+// Seek initializes an iterator at the given key (inclusive). The iterator
+// includes the writes of the transaction.
+func (tx *remoteTransaction) Seek(ctx context.Context, StartKey []byte) (Iterator, error) {
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	var writes []string
+	for k := range tx.writes {
+		if k >= string(StartKey) {
+			writes = append(writes, k)
+		}
+	}
+	sort.Strings(writes)
+	return &remoteIterator{tx: tx, start: StartKey, more: true, writes: writes}, nil
+}
+
+// Get gets the value of a key within the transaction
+func (tx *remoteTransaction) Get(ctx context.Context, key []byte) ([]byte, error) {
+	if v, ok := tx.writes[string(key)]; ok {
+		if v == nil {
+			return nil, ErrNotFound
+		}
+		return v, nil
+	}
+	v, etag, err := tx.RemoteDB.GetWithETag(ctx, key)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	if _, ok := tx.reads[string(key)]; !ok {
+		tx.reads[string(key)] = etag
+	}
+	return v, err
+}
+
+// Put sets the value of a key within the transaction
+func (tx *remoteTransaction) Put(ctx context.Context, key, value []byte) error {
+	if tx.readOnly {
+		return ErrReadOnly
+	}
+	if err := contextErr(ctx); err != nil {
+		return err
+	}
+	tx.writes[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+// Delete removes a key within the transaction
+func (tx *remoteTransaction) Delete(ctx context.Context, key []byte) error {
+	if tx.readOnly {
+		return ErrReadOnly
+	}
+	if err := contextErr(ctx); err != nil {
+		return err
+	}
+	tx.writes[string(key)] = nil
+	return nil
+}
+
+// Discard drops all buffered writes
+func (tx *remoteTransaction) Discard(ctx context.Context) error {
+	tx.reads, tx.writes = map[string]string{}, map[string][]byte{}
+	return nil
+}
+
+// Commit sends all writes in a single batch guarded by the ETags of all read
+// keys. Written keys carry their guard themselves, which the server applies as
+// a conditional write.
+func (tx *remoteTransaction) Commit(ctx context.Context) error {
+	if err := contextErr(ctx); err != nil {
+		return err
+	}
+	if tx.readOnly || len(tx.writes) == 0 {
+		return tx.Discard(ctx)
+	}
+
+	guard := func(op wire.Op) wire.Op {
+		if etag, ok := tx.reads[string(op.Key)]; ok {
+			op.IfMatch = etag
+			if etag == "" {
+				op.IfNoneMatch = "*"
+			}
+		}
+		return op
+	}
+	req := wire.BatchRequest{}
+	for k := range tx.reads {
+		if _, ok := tx.writes[k]; !ok {
+			req.Ops = append(req.Ops, guard(wire.Op{Op: wire.OpCheck, Key: []byte(k)}))
+		}
+	}
+	for k, v := range tx.writes {
+		op := wire.Op{Op: wire.OpPut, Key: []byte(k), Value: v}
+		if v == nil {
+			op.Op = wire.OpDelete
+		}
+		req.Ops = append(req.Ops, guard(op))
+	}
+
+	err := tx.doJSON(ctx, http.MethodPost, "/batch", req, &wire.BatchResponse{})
+	tx.Discard(ctx)
+	return err
+}
+
+// remoteIterator
+
+// fetch loads the next page of the scan
+func (it *remoteIterator) fetch(ctx context.Context) error {
+	q := url.Values{"limit": {strconv.Itoa(remoteScanPageSize)}}
+	if it.cursor != "" {
+		q.Set("cursor", it.cursor)
+	} else {
+		q.Set("start", string(it.start))
+	}
+	res := wire.ScanResponse{}
+	if err := it.tx.doJSON(ctx, http.MethodGet, "/scan?"+q.Encode(), nil, &res); err != nil {
+		return err
+	}
+	it.page, it.cursor, it.more = res.Items, res.Cursor, res.Cursor != ""
+	return nil
+}
+
+// Next yields the next key-value, merging the remote keys with the writes of
+// the transaction.
+func (it *remoteIterator) Next(ctx context.Context) (key, value []byte, err error) {
+	for {
+		if err := contextErr(ctx); err != nil {
+			return nil, nil, err
+		}
+		if len(it.page) == 0 && it.more {
+			if err := it.fetch(ctx); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		hasRemote, hasWrite := len(it.page) > 0, len(it.writes) > 0
+		switch {
+		case !hasRemote && !hasWrite:
+			return nil, nil, ErrNotFound
+		case hasWrite && (!hasRemote || it.writes[0] <= string(it.page[0].Key)):
+			k := it.writes[0]
+			it.writes = it.writes[1:]
+			if hasRemote && k == string(it.page[0].Key) {
+				it.page = it.page[1:]
+			}
+			v := it.tx.writes[k]
+			if v == nil {
+				continue // deleted in the transaction
+			}
+			return []byte(k), v, nil
+		default:
+			item := it.page[0]
+			it.page = it.page[1:]
+			return item.Key, item.Value, nil
+		}
+	}
+}
+
+// Close releases the iterator
+func (it *remoteIterator) Close() error {
+	it.page, it.writes = nil, nil
+	return nil
+}
@@ -0,0 +1,109 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// maxBulkLen is the largest bulk string accepted from clients
+const maxBulkLen = 512 << 20
+
+var errProtocol = errors.New("protocol error")
+
+// Reply types written by writeReply. []byte is a bulk string (nil for the
+// null bulk string), int64 an integer and []interface{} an array.
+type (
+	simpleString string
+	errorReply   string
+	nullArray    struct{}
+)
+
+var ok = simpleString("OK")
+
+func errorf(format string, args ...interface{}) errorReply {
+	return errorReply(fmt.Sprintf(format, args...))
+}
+
+// readCommand reads a command sent as an array of bulk strings or as an
+// inline command.
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	if line[0] != '*' {
+		return bytes.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > 1024*1024 {
+		return nil, errProtocol
+	}
+	args := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errProtocol
+		}
+		l, err := strconv.Atoi(string(line[1:]))
+		if err != nil || l < 0 || l > maxBulkLen {
+			return nil, errProtocol
+		}
+		b := make([]byte, l+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args = append(args, b[:l])
+	}
+	return args, nil
+}
+
+// readLine reads a line without its trailing \r\n
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, errProtocol
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch r := reply.(type) {
+	case simpleString:
+		w.WriteString("+" + string(r) + "\r\n")
+	case errorReply:
+		w.WriteString("-" + string(r) + "\r\n")
+	case int64:
+		w.WriteString(":" + strconv.FormatInt(r, 10) + "\r\n")
+	case []byte:
+		if r == nil {
+			w.WriteString("$-1\r\n")
+			return
+		}
+		w.WriteString("$" + strconv.Itoa(len(r)) + "\r\n")
+		w.Write(r)
+		w.WriteString("\r\n")
+	case nullArray:
+		w.WriteString("*-1\r\n")
+	case []interface{}:
+		w.WriteString("*" + strconv.Itoa(len(r)) + "\r\n")
+		for _, e := range r {
+			writeReply(w, e)
+		}
+	default:
+		panic(fmt.Sprintf("resp: unknown reply type %T", reply))
+	}
+}
@@ -0,0 +1,216 @@
+package resp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zatte/kv"
+)
+
+// client is a minimal RESP client returning replies as strings, int64,
+// nil, errorReply and []interface{}
+type client struct {
+	t *testing.T
+	c net.Conn
+	r *bufio.Reader
+}
+
+func (c *client) do(args ...string) interface{} {
+	cmd := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, a := range args {
+		cmd += "$" + strconv.Itoa(len(a)) + "\r\n" + a + "\r\n"
+	}
+	_, err := c.c.Write([]byte(cmd))
+	require.NoError(c.t, err)
+	return c.read()
+}
+
+func (c *client) read() interface{} {
+	line, err := readLine(c.r)
+	require.NoError(c.t, err)
+	switch line[0] {
+	case '+':
+		return string(line[1:])
+	case '-':
+		return errorReply(line[1:])
+	case ':':
+		n, _ := strconv.ParseInt(string(line[1:]), 10, 64)
+		return n
+	case '$':
+		n, _ := strconv.Atoi(string(line[1:]))
+		if n < 0 {
+			return nil
+		}
+		b := make([]byte, n+2)
+		_, err := io.ReadFull(c.r, b)
+		require.NoError(c.t, err)
+		return string(b[:n])
+	case '*':
+		n, _ := strconv.Atoi(string(line[1:]))
+		if n < 0 {
+			return nullArray{}
+		}
+		res := make([]interface{}, n)
+		for i := range res {
+			res[i] = c.read()
+		}
+		return res
+	}
+	c.t.Fatalf("unexpected reply %q", line)
+	return nil
+}
+
+func start(t *testing.T, opts Options) (*Server, func() *client) {
+	db, err := kv.New("badger:///?memory=true")
+	require.NoError(t, err)
+	srv := New(db, opts)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(lis)
+	t.Cleanup(func() { srv.Close() })
+
+	return srv, func() *client {
+		c, err := net.Dial("tcp", lis.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { c.Close() })
+		return &client{t, c, bufio.NewReader(c)}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	_, connect := start(t, Options{})
+	c := connect()
+
+	assert.Equal(t, "PONG", c.do("PING"))
+	assert.Equal(t, "OK", c.do("SET", "k", "v"))
+	assert.Equal(t, "v", c.do("GET", "k"))
+	assert.Nil(t, c.do("GET", "missing"))
+	assert.Nil(t, c.do("SET", "k", "v2", "NX"))
+	assert.Equal(t, "OK", c.do("SET", "k", "v2", "XX"))
+	assert.Nil(t, c.do("SET", "other", "x", "XX"))
+	assert.Equal(t, "OK", c.do("SET", "other", "x", "NX"))
+	assert.Equal(t, int64(2), c.do("EXISTS", "k", "other", "missing"))
+
+	assert.Equal(t, "OK", c.do("MSET", "a", "1", "b", "2"))
+	assert.Equal(t, []interface{}{"1", nil, "2"}, c.do("MGET", "a", "missing", "b"))
+	assert.Equal(t, int64(2), c.do("DEL", "a", "b", "missing"))
+	assert.Equal(t, int64(0), c.do("EXISTS", "a"))
+
+	assert.IsType(t, errorReply(""), c.do("GET"))
+	assert.IsType(t, errorReply(""), c.do("NOSUCHCOMMAND"))
+	assert.IsType(t, errorReply(""), c.do("SET", "k", "v", "NX", "XX"))
+
+	// inline commands
+	_, err := c.c.Write([]byte("GET k\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "v2", c.read())
+}
+
+func TestExpiry(t *testing.T) {
+	_, connect := start(t, Options{})
+	c := connect()
+
+	assert.Equal(t, "OK", c.do("SET", "short", "v", "PX", "50"))
+	assert.Equal(t, "OK", c.do("SET", "long", "v", "EX", "100"))
+	assert.Equal(t, int64(100), c.do("TTL", "long"))
+	assert.Equal(t, "OK", c.do("SET", "long", "v2", "KEEPTTL"))
+	assert.Equal(t, int64(100), c.do("TTL", "long"))
+	assert.Equal(t, "OK", c.do("SET", "long", "v3"))
+	assert.Equal(t, int64(-1), c.do("TTL", "long"))
+	assert.Equal(t, "v", c.do("GET", "short"))
+
+	time.Sleep(80 * time.Millisecond)
+	assert.Nil(t, c.do("GET", "short"))
+	assert.Equal(t, int64(-2), c.do("TTL", "short"))
+	assert.Equal(t, "OK", c.do("SET", "short", "again", "NX"))
+	assert.Equal(t, []interface{}{"0", []interface{}{"long", "short"}}, c.do("SCAN", "0"))
+}
+
+func TestScan(t *testing.T) {
+	_, connect := start(t, Options{})
+	c := connect()
+	for i := 0; i < 25; i++ {
+		assert.Equal(t, "OK", c.do("SET", fmt.Sprintf("user:%02d", i), "v"))
+		assert.Equal(t, "OK", c.do("SET", fmt.Sprintf("item:%02d", i), "v"))
+	}
+
+	var keys []string
+	cursor := "0"
+	for {
+		res := c.do("SCAN", cursor, "MATCH", "user:1*", "COUNT", "4").([]interface{})
+		for _, k := range res[1].([]interface{}) {
+			keys = append(keys, k.(string))
+		}
+		if cursor = res[0].(string); cursor == "0" {
+			break
+		}
+	}
+	sort.Strings(keys)
+	assert.Equal(t, []string{"user:10", "user:11", "user:12", "user:13", "user:14", "user:15", "user:16", "user:17", "user:18", "user:19"}, keys)
+
+	res := c.do("SCAN", "0", "MATCH", "*:2[0-2]", "COUNT", "1000").([]interface{})
+	assert.Len(t, res[1], 6)
+}
+
+func TestMulti(t *testing.T) {
+	_, connect := start(t, Options{})
+	c, other := connect(), connect()
+
+	assert.Equal(t, "OK", c.do("MULTI"))
+	assert.Equal(t, "QUEUED", c.do("SET", "a", "1"))
+	assert.Equal(t, "QUEUED", c.do("SET", "b", "2", "NX"))
+	assert.Equal(t, "QUEUED", c.do("GET", "a"))
+	assert.Nil(t, other.do("GET", "a"))
+	assert.Equal(t, []interface{}{"OK", "OK", "1"}, c.do("EXEC"))
+	assert.Equal(t, "1", other.do("GET", "a"))
+
+	assert.Equal(t, "OK", c.do("MULTI"))
+	assert.Equal(t, "QUEUED", c.do("SET", "a", "changed"))
+	assert.Equal(t, "OK", c.do("DISCARD"))
+	assert.Equal(t, "1", c.do("GET", "a"))
+
+	assert.Equal(t, "OK", c.do("MULTI"))
+	assert.IsType(t, errorReply(""), c.do("SET", "a"))
+	assert.Equal(t, errorReply("EXECABORT Transaction discarded because of previous errors."), c.do("EXEC"))
+	assert.IsType(t, errorReply(""), c.do("EXEC"))
+}
+
+func TestAuth(t *testing.T) {
+	_, connect := start(t, Options{Password: "secret"})
+	c := connect()
+
+	assert.IsType(t, errorReply(""), c.do("GET", "k"))
+	assert.IsType(t, errorReply(""), c.do("AUTH", "wrong"))
+	assert.Equal(t, "OK", c.do("AUTH", "secret"))
+	assert.Nil(t, c.do("GET", "k"))
+}
+
+func TestGlob(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, key string
+		match        bool
+	}{
+		{"*", "", true},
+		{"user:*", "user:1", true},
+		{"user:*", "item:1", false},
+		{"h?llo", "hello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"a\\*b", "a*b", true},
+		{"a\\*b", "axb", false},
+		{"*b*d", "abcd", true},
+	} {
+		assert.Equal(t, tc.match, globMatch([]byte(tc.pattern), []byte(tc.key)), tc.pattern+" "+tc.key)
+	}
+	assert.Equal(t, []byte("user:"), globPrefix([]byte("user:*")))
+	assert.Equal(t, []byte("a*b"), globPrefix([]byte("a\\*b")))
+}
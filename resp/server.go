@@ -0,0 +1,610 @@
+// Package resp serves a kv store over the Redis protocol (RESP2), so
+// redis-cli and Redis client libraries can use any kv backend.
+//
+// Supported commands are GET, SET (NX, XX, EX, PX, KEEPTTL), DEL, EXISTS,
+// MGET, MSET, TTL, SCAN (MATCH, COUNT), MULTI, EXEC, DISCARD, PING, ECHO,
+// SELECT 0, AUTH, QUIT and COMMAND. Every command runs in its own transaction;
+// MULTI/EXEC runs all queued commands in one.
+//
+// Expiry times are stored under keys with a reserved prefix and expired keys
+// are removed lazily when they are accessed.
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zatte/kv"
+)
+
+// ExpiryPrefix prefixes the keys holding expiry times. SCAN hides them.
+const ExpiryPrefix = "\xff__resp_expiry__/"
+
+const (
+	defaultScanCount = 10
+	// maxCursors is the number of SCAN cursors remembered by a server
+	maxCursors = 10000
+	// maxRetries is the number of times a conflicting command is retried
+	maxRetries = 3
+)
+
+// Options configures a Server. The zero value requires no authentication.
+type Options struct {
+	// Password, when set, must be sent with AUTH before other commands
+	Password string
+}
+
+// Server serves a kv store over RESP
+type Server struct {
+	db       kv.OrderedTransactional
+	opts     Options
+	commands map[string]command
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+
+	cursorMu    sync.Mutex
+	lastCursor  uint64
+	cursors     map[uint64][]byte
+	cursorOrder []uint64
+}
+
+// command runs against a transaction. Errors caused by the client are
+// returned as errorReply without side effects; returned errors abort the
+// transaction.
+type command struct {
+	// arity is the exact number of arguments including the name, or the
+	// negated minimum
+	arity    int
+	readOnly bool
+	fn       func(s *Server, ctx context.Context, tx kv.OrderedTransaction, args [][]byte) (interface{}, error)
+}
+
+// session is the state of a client connection
+type session struct {
+	authed    bool
+	inMulti   bool
+	multiErr  bool
+	queued    [][][]byte
+	queuedCmd []command
+}
+
+// New creates a server for db
+func New(db kv.OrderedTransactional, opts Options) *Server {
+	return &Server{
+		db:   db,
+		opts: opts,
+		commands: map[string]command{
+			"GET":    {2, false, (*Server).get},
+			"SET":    {-3, false, (*Server).set},
+			"DEL":    {-2, false, (*Server).del},
+			"EXISTS": {-2, false, (*Server).exists},
+			"MGET":   {-2, false, (*Server).mget},
+			"MSET":   {-3, false, (*Server).mset},
+			"TTL":    {2, false, (*Server).ttl},
+			"SCAN":   {-2, true, (*Server).scan},
+		},
+		listeners: map[net.Listener]struct{}{},
+		conns:     map[net.Conn]struct{}{},
+		cursors:   map[uint64][]byte{},
+	}
+}
+
+// Serve accepts connections on lis until Close is called
+func (s *Server) Serve(lis net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return lis.Close()
+	}
+	s.listeners[lis] = struct{}{}
+	s.mu.Unlock()
+
+	for {
+		c, err := lis.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go s.ServeConn(c)
+	}
+}
+
+// Close stops all listeners and closes all connections
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return nil
+}
+
+// ServeConn serves a single client connection until it is closed
+func (s *Server) ServeConn(c net.Conn) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		c.Close()
+		return
+	}
+	s.conns[c] = struct{}{}
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		c.Close()
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+	}()
+
+	r := bufio.NewReaderSize(c, 64<<10)
+	w := bufio.NewWriter(c)
+	sess := &session{authed: s.opts.Password == ""}
+	for {
+		args, err := readCommand(r)
+		if err == errProtocol {
+			writeReply(w, errorReply("ERR Protocol error"))
+			w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		reply, quit := s.handle(ctx, sess, args)
+		writeReply(w, reply)
+		// flush once all pipelined commands are answered
+		if r.Buffered() == 0 || quit {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+func (s *Server) handle(ctx context.Context, sess *session, args [][]byte) (reply interface{}, quit bool) {
+	name := strings.ToUpper(string(args[0]))
+	if !sess.authed && name != "AUTH" && name != "QUIT" {
+		return errorReply("NOAUTH Authentication required."), false
+	}
+
+	switch name {
+	case "AUTH":
+		if s.opts.Password == "" {
+			return errorReply("ERR AUTH <password> called without any password configured for the default user."), false
+		}
+		if len(args) < 2 || len(args) > 3 {
+			return arityErr(name), false
+		}
+		if subtle.ConstantTimeCompare(args[len(args)-1], []byte(s.opts.Password)) != 1 {
+			return errorReply("WRONGPASS invalid username-password pair"), false
+		}
+		sess.authed = true
+		return ok, false
+	case "QUIT":
+		return ok, true
+	case "PING":
+		if len(args) > 1 {
+			return args[1], false
+		}
+		return simpleString("PONG"), false
+	case "ECHO":
+		if len(args) != 2 {
+			return arityErr(name), false
+		}
+		return args[1], false
+	case "SELECT":
+		if len(args) != 2 || string(args[1]) != "0" {
+			return errorReply("ERR DB index is out of range"), false
+		}
+		return ok, false
+	case "COMMAND":
+		return []interface{}{}, false
+	case "MULTI":
+		if sess.inMulti {
+			return errorReply("ERR MULTI calls can not be nested"), false
+		}
+		*sess = session{authed: sess.authed, inMulti: true}
+		return ok, false
+	case "DISCARD":
+		if !sess.inMulti {
+			return errorReply("ERR DISCARD without MULTI"), false
+		}
+		*sess = session{authed: sess.authed}
+		return ok, false
+	case "EXEC":
+		if !sess.inMulti {
+			return errorReply("ERR EXEC without MULTI"), false
+		}
+		queued, cmds, failed := sess.queued, sess.queuedCmd, sess.multiErr
+		*sess = session{authed: sess.authed}
+		if failed {
+			return errorReply("EXECABORT Transaction discarded because of previous errors."), false
+		}
+		return s.exec(ctx, queued, cmds), false
+	}
+
+	cmd, found := s.commands[name]
+	if !found {
+		sess.multiErr = sess.inMulti
+		return errorf("ERR unknown command '%s'", args[0]), false
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		sess.multiErr = sess.inMulti
+		return arityErr(name), false
+	}
+	if sess.inMulti {
+		sess.queued = append(sess.queued, args)
+		sess.queuedCmd = append(sess.queuedCmd, cmd)
+		return simpleString("QUEUED"), false
+	}
+
+	reply, err := s.run(ctx, cmd.readOnly, func(tx kv.OrderedTransaction) (interface{}, error) {
+		return cmd.fn(s, ctx, tx, args)
+	})
+	if err != nil {
+		return errorf("ERR %v", err), false
+	}
+	return reply, false
+}
+
+func arityErr(name string) errorReply {
+	return errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(name))
+}
+
+// exec runs queued commands in one transaction. A conflict that persists
+// after retries aborts it with a null array, like a failed WATCH.
+func (s *Server) exec(ctx context.Context, queued [][][]byte, cmds []command) interface{} {
+	reply, err := s.run(ctx, false, func(tx kv.OrderedTransaction) (interface{}, error) {
+		replies := make([]interface{}, len(queued))
+		for i, args := range queued {
+			r, err := cmds[i].fn(s, ctx, tx, args)
+			if err != nil {
+				return nil, err
+			}
+			replies[i] = r
+		}
+		return replies, nil
+	})
+	if err == kv.ErrConflict {
+		return nullArray{}
+	}
+	if err != nil {
+		return errorf("ERR %v", err)
+	}
+	return reply
+}
+
+// run executes fn in a transaction and commits it, retrying on conflicts
+func (s *Server) run(ctx context.Context, readOnly bool, fn func(tx kv.OrderedTransaction) (interface{}, error)) (interface{}, error) {
+	for attempt := 0; ; attempt++ {
+		tx, err := s.db.NewTransaction(ctx, readOnly)
+		if err != nil {
+			return nil, err
+		}
+		reply, err := fn(tx)
+		if err == nil && !readOnly {
+			err = tx.Commit(ctx)
+		}
+		tx.Discard(ctx)
+		if err == kv.ErrConflict && attempt < maxRetries {
+			continue
+		}
+		return reply, err
+	}
+}
+
+func expiryKey(key []byte) []byte {
+	return append([]byte(ExpiryPrefix), key...)
+}
+
+func nowMs() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// expiry returns the expiry time of a key in unix milliseconds, 0 if it has none
+func expiry(ctx context.Context, tx kv.OrderedTransaction, key []byte) (int64, error) {
+	v, err := tx.Get(ctx, expiryKey(key))
+	if err == kv.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(v) != 8 {
+		return 0, nil
+	}
+	return int64(binary.BigEndian.Uint64(v)), nil
+}
+
+// load gets a key, treating expired keys as missing. Expired keys are deleted
+// when tx is writable.
+func load(ctx context.Context, tx kv.OrderedTransaction, key []byte) ([]byte, int64, error) {
+	v, err := tx.Get(ctx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	exp, err := expiry(ctx, tx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if exp != 0 && nowMs() >= exp {
+		if err := remove(ctx, tx, key); err != nil && err != kv.ErrReadOnly {
+			return nil, 0, err
+		}
+		return nil, 0, kv.ErrNotFound
+	}
+	return v, exp, nil
+}
+
+// remove deletes a key and its expiry time
+func remove(ctx context.Context, tx kv.OrderedTransaction, key []byte) error {
+	if err := tx.Delete(ctx, key); err != nil && err != kv.ErrNotFound {
+		return err
+	}
+	if err := tx.Delete(ctx, expiryKey(key)); err != nil && err != kv.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) get(ctx context.Context, tx kv.OrderedTransaction, args [][]byte) (interface{}, error) {
+	v, _, err := load(ctx, tx, args[1])
+	if err == kv.ErrNotFound {
+		return []byte(nil), nil
+	}
+	if v == nil {
+		v = []byte{}
+	}
+	return v, err
+}
+
+func (s *Server) set(ctx context.Context, tx kv.OrderedTransaction, args [][]byte) (interface{}, error) {
+	key, value := args[1], args[2]
+	var nx, xx, keepTTL bool
+	var ttl time.Duration
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "KEEPTTL":
+			keepTTL = true
+		case "EX", "PX":
+			i++
+			if i == len(args) || ttl != 0 {
+				return errorReply("ERR syntax error"), nil
+			}
+			n, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil {
+				return errorReply("ERR value is not an integer or out of range"), nil
+			}
+			if n <= 0 {
+				return errorReply("ERR invalid expire time in 'set' command"), nil
+			}
+			ttl = time.Duration(n) * time.Millisecond
+			if opt == "EX" {
+				ttl = time.Duration(n) * time.Second
+			}
+		default:
+			return errorReply("ERR syntax error"), nil
+		}
+	}
+	if (nx && xx) || (keepTTL && ttl != 0) {
+		return errorReply("ERR syntax error"), nil
+	}
+
+	if nx || xx {
+		_, _, err := load(ctx, tx, key)
+		if err != nil && err != kv.ErrNotFound {
+			return nil, err
+		}
+		if exists := err == nil; (nx && exists) || (xx && !exists) {
+			return []byte(nil), nil
+		}
+	}
+
+	if err := tx.Put(ctx, key, value); err != nil {
+		return nil, err
+	}
+	switch {
+	case ttl != 0:
+		var exp [8]byte
+		binary.BigEndian.PutUint64(exp[:], uint64(nowMs()+int64(ttl/time.Millisecond)))
+		if err := tx.Put(ctx, expiryKey(key), exp[:]); err != nil {
+			return nil, err
+		}
+	case !keepTTL:
+		if err := tx.Delete(ctx, expiryKey(key)); err != nil && err != kv.ErrNotFound {
+			return nil, err
+		}
+	}
+	return ok, nil
+}
+
+func (s *Server) del(ctx context.Context, tx kv.OrderedTransaction, args [][]byte) (interface{}, error) {
+	n := int64(0)
+	for _, key := range args[1:] {
+		_, _, err := load(ctx, tx, key)
+		if err == kv.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := remove(ctx, tx, key); err != nil {
+			return nil, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (s *Server) exists(ctx context.Context, tx kv.OrderedTransaction, args [][]byte) (interface{}, error) {
+	n := int64(0)
+	for _, key := range args[1:] {
+		_, _, err := load(ctx, tx, key)
+		if err == kv.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (s *Server) mget(ctx context.Context, tx kv.OrderedTransaction, args [][]byte) (interface{}, error) {
+	replies := make([]interface{}, 0, len(args)-1)
+	for _, key := range args[1:] {
+		v, err := s.get(ctx, tx, [][]byte{nil, key})
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, v)
+	}
+	return replies, nil
+}
+
+func (s *Server) mset(ctx context.Context, tx kv.OrderedTransaction, args [][]byte) (interface{}, error) {
+	if len(args)%2 != 1 {
+		return arityErr("MSET"), nil
+	}
+	for i := 1; i < len(args); i += 2 {
+		if _, err := s.set(ctx, tx, [][]byte{nil, args[i], args[i+1]}); err != nil {
+			return nil, err
+		}
+	}
+	return ok, nil
+}
+
+func (s *Server) ttl(ctx context.Context, tx kv.OrderedTransaction, args [][]byte) (interface{}, error) {
+	_, exp, err := load(ctx, tx, args[1])
+	switch {
+	case err == kv.ErrNotFound:
+		return int64(-2), nil
+	case err != nil:
+		return nil, err
+	case exp == 0:
+		return int64(-1), nil
+	}
+	return (exp - nowMs() + 500) / 1000, nil
+}
+
+// scan iterates keys matching a glob pattern. The literal prefix of the
+// pattern limits the range of keys read.
+func (s *Server) scan(ctx context.Context, tx kv.OrderedTransaction, args [][]byte) (interface{}, error) {
+	pattern, count := []byte("*"), defaultScanCount
+	for i := 2; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return errorReply("ERR syntax error"), nil
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			n, err := strconv.Atoi(string(args[i+1]))
+			if err != nil || n < 1 {
+				return errorReply("ERR syntax error"), nil
+			}
+			count = n
+		default:
+			return errorReply("ERR syntax error"), nil
+		}
+	}
+
+	prefix := globPrefix(pattern)
+	start := prefix
+	if string(args[1]) != "0" {
+		id, err := strconv.ParseUint(string(args[1]), 10, 64)
+		if err != nil {
+			return errorReply("ERR invalid cursor"), nil
+		}
+		var found bool
+		if start, found = s.cursor(id); !found {
+			return errorReply("ERR invalid cursor"), nil
+		}
+	}
+
+	it, err := tx.Seek(ctx, start)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	keys := []interface{}{}
+	for examined := 0; ; examined++ {
+		k, _, err := it.Next(ctx)
+		if err == kv.ErrNotFound || (err == nil && !bytes.HasPrefix(k, prefix)) {
+			return []interface{}{[]byte("0"), keys}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		key := append([]byte{}, k...)
+		if examined == count {
+			return []interface{}{[]byte(strconv.FormatUint(s.saveCursor(key), 10)), keys}, nil
+		}
+		if bytes.HasPrefix(key, []byte(ExpiryPrefix)) || !globMatch(pattern, key) {
+			continue
+		}
+		if exp, err := expiry(ctx, tx, key); err != nil {
+			return nil, err
+		} else if exp != 0 && nowMs() >= exp {
+			continue
+		}
+		keys = append(keys, key)
+	}
+}
+
+// saveCursor remembers the key a SCAN continues at, forgetting the oldest
+// cursors beyond maxCursors.
+func (s *Server) saveCursor(key []byte) uint64 {
+	s.cursorMu.Lock()
+	defer s.cursorMu.Unlock()
+	s.lastCursor++
+	s.cursors[s.lastCursor] = key
+	s.cursorOrder = append(s.cursorOrder, s.lastCursor)
+	if len(s.cursorOrder) > maxCursors {
+		delete(s.cursors, s.cursorOrder[0])
+		s.cursorOrder = s.cursorOrder[1:]
+	}
+	return s.lastCursor
+}
+
+func (s *Server) cursor(id uint64) ([]byte, bool) {
+	s.cursorMu.Lock()
+	defer s.cursorMu.Unlock()
+	key, ok := s.cursors[id]
+	return key, ok
+}
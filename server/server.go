@@ -0,0 +1,459 @@
+// Package server serves any kv store over HTTP.
+//
+//	GET    /keys/{key}   value of a key with its ETag, honors If-None-Match
+//	PUT    /keys/{key}   sets a key to the request body, honors If-Match and If-None-Match
+//	DELETE /keys/{key}   removes a key, honors If-Match
+//	GET    /scan         key/values in key order, see ServeHTTP
+//	DELETE /range        deletes the keys of a prefix or from start to end, see ServeHTTP
+//	POST   /batch        executes a wire.BatchRequest in a single transaction
+//
+// Keys are path escaped bytes, so any binary key can be used. ETags are the
+// quoted hex sha256 of the value.
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/zatte/kv"
+	"github.com/zatte/kv/internal/wire"
+)
+
+// Defaults for Options
+const (
+	DefaultScanLimit    = 100
+	DefaultMaxScanLimit = 1000
+	DefaultMaxBodySize  = 32 << 20
+)
+
+// Options configures a Server. The zero value uses the defaults and requires
+// no authentication.
+type Options struct {
+	// Token, when set, is required as "Authorization: Bearer <token>"
+	Token string
+	// MaxScanLimit caps the limit of a single scan page
+	MaxScanLimit int
+	// MaxBodySize caps the size of values and batch requests
+	MaxBodySize int64
+}
+
+// Server is an http.Handler serving a kv store
+type Server struct {
+	db   kv.OrderedTransactional
+	opts Options
+}
+
+// httpError is an error with the status code it is served with
+type httpError struct {
+	status int
+	msg    string
+}
+
+func (e httpError) Error() string {
+	return e.msg
+}
+
+var (
+	errPrecondition = httpError{http.StatusPreconditionFailed, "precondition failed"}
+	errUnauthorized = httpError{http.StatusUnauthorized, "unauthorized"}
+	errMethod       = httpError{http.StatusMethodNotAllowed, "method not allowed"}
+	errEmptyKey     = httpError{http.StatusBadRequest, "empty key"}
+)
+
+func badRequest(msg string) error {
+	return httpError{http.StatusBadRequest, msg}
+}
+
+// New creates a server for db. Mount it under a path prefix with http.StripPrefix.
+func New(db kv.OrderedTransactional, opts Options) *Server {
+	if opts.MaxScanLimit <= 0 {
+		opts.MaxScanLimit = DefaultMaxScanLimit
+	}
+	if opts.MaxBodySize <= 0 {
+		opts.MaxBodySize = DefaultMaxBodySize
+	}
+	return &Server{db, opts}
+}
+
+// ServeHTTP serves the API. Scans take the query parameters prefix, start
+// (inclusive) and end (exclusive) as raw key bytes, limit and cursor, the
+// cursor of the previous page. Range deletes take prefix, or start and end.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.opts.Token != "" {
+		auth := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+s.opts.Token)) != 1 {
+			writeError(w, errUnauthorized)
+			return
+		}
+	}
+	// Routed by hand as http.ServeMux redirects paths it would clean, which
+	// breaks keys containing "//" or "..".
+	switch p := r.URL.EscapedPath(); {
+	case strings.HasPrefix(p, "/keys/"):
+		s.handleKey(w, r)
+	case p == "/scan":
+		s.handleScan(w, r)
+	case p == "/batch":
+		s.handleBatch(w, r)
+	case p == "/range":
+		s.handleRange(w, r)
+	default:
+		writeError(w, httpError{http.StatusNotFound, "unknown path " + p})
+	}
+}
+
+func (s *Server) handleKey(w http.ResponseWriter, r *http.Request) {
+	k, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/keys/"))
+	if err != nil {
+		writeError(w, badRequest(err.Error()))
+		return
+	}
+	if k == "" {
+		writeError(w, errEmptyKey)
+		return
+	}
+	key := []byte(k)
+	ctx := r.Context()
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		v, err := s.db.Get(ctx, key)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		etag := wire.ETag(v)
+		w.Header().Set("ETag", etag)
+		if match(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(v)))
+		w.Write(v)
+
+	case http.MethodPut:
+		v, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, s.opts.MaxBodySize))
+		if err != nil {
+			writeError(w, httpError{http.StatusRequestEntityTooLarge, err.Error()})
+			return
+		}
+		op := wire.Op{Op: wire.OpPut, Key: key, Value: v, IfMatch: r.Header.Get("If-Match"), IfNoneMatch: r.Header.Get("If-None-Match")}
+		if err := s.write(ctx, op); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("ETag", wire.ETag(v))
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		op := wire.Op{Op: wire.OpDelete, Key: key, IfMatch: r.Header.Get("If-Match")}
+		if err := s.write(ctx, op); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, errMethod)
+	}
+}
+
+// write applies a single put or delete, in a transaction only if it has preconditions
+func (s *Server) write(ctx context.Context, op wire.Op) error {
+	if op.IfMatch != "" || op.IfNoneMatch != "" {
+		_, err := s.batch(ctx, []wire.Op{op})
+		return err
+	}
+	if op.Op == wire.OpPut {
+		return s.db.Put(ctx, op.Key, op.Value)
+	}
+	return s.db.Delete(ctx, op.Key)
+}
+
+func (s *Server) handleScan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, errMethod)
+		return
+	}
+	q := r.URL.Query()
+	prefix, start, end := []byte(q.Get("prefix")), []byte(q.Get("start")), []byte(q.Get("end"))
+	if string(prefix) > string(start) {
+		start = prefix
+	}
+	if c := q.Get("cursor"); c != "" {
+		cursor, err := base64.RawURLEncoding.DecodeString(c)
+		if err != nil {
+			writeError(w, badRequest("invalid cursor"))
+			return
+		}
+		start = cursor
+	}
+	limit := DefaultScanLimit
+	if l := q.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			writeError(w, badRequest("invalid limit"))
+			return
+		}
+	}
+	if limit > s.opts.MaxScanLimit {
+		limit = s.opts.MaxScanLimit
+	}
+
+	res, err := s.scan(r.Context(), prefix, start, end, limit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, res)
+}
+
+func (s *Server) scan(ctx context.Context, prefix, start, end []byte, limit int) (res wire.ScanResponse, err error) {
+	tx, err := s.db.NewTransaction(ctx, true)
+	if err != nil {
+		return res, err
+	}
+	defer tx.Discard(ctx)
+
+	it, err := tx.Seek(ctx, start)
+	if err != nil {
+		return res, err
+	}
+	defer it.Close()
+
+	res.Items = []wire.Item{}
+	for {
+		k, v, err := it.Next(ctx)
+		if err == kv.ErrNotFound {
+			return res, nil
+		}
+		if err != nil {
+			return res, err
+		}
+		if !strings.HasPrefix(string(k), string(prefix)) || (len(end) > 0 && string(k) >= string(end)) {
+			return res, nil
+		}
+		if len(res.Items) == limit {
+			// the next page starts right after the last returned key
+			last := res.Items[len(res.Items)-1].Key
+			res.Cursor = base64.RawURLEncoding.EncodeToString(append(append([]byte{}, last...), 0))
+			return res, nil
+		}
+		res.Items = append(res.Items, wire.Item{
+			Key:   append([]byte{}, k...),
+			Value: append([]byte{}, v...),
+		})
+	}
+}
+
+func (s *Server) handleRange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, errMethod)
+		return
+	}
+	q := r.URL.Query()
+	start, end := []byte(q.Get("start")), []byte(q.Get("end"))
+	if prefix := q.Get("prefix"); prefix != "" {
+		start, end = []byte(prefix), kv.PrefixEnd([]byte(prefix))
+	}
+	if len(end) == 0 {
+		end = nil
+	}
+	n, err := s.db.DeleteRange(r.Context(), start, end)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, wire.DeleteRangeResponse{Deleted: n})
+}
+
+func (s *Server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, errMethod)
+		return
+	}
+	req := wire.BatchRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.opts.MaxBodySize)).Decode(&req); err != nil {
+		writeError(w, badRequest(err.Error()))
+		return
+	}
+	results, err := s.batch(r.Context(), req.Ops)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, wire.BatchResponse{Results: results})
+}
+
+// versionedTx is a transaction with conditional writes, e.g. of SQL stores
+type versionedTx interface {
+	kv.Versioner
+	kv.VersionedDeleter
+}
+
+// batch executes all ops in one transaction. A failed precondition fails the
+// whole batch without side effects.
+//
+// Puts and deletes with preconditions are written conditionally on the version
+// they were checked at where the transaction supports it, so they fail rather
+// than overwrite a concurrent write even at READ COMMITTED. Preconditions of
+// check and get ops are only as isolated as the transactions of the store.
+func (s *Server) batch(ctx context.Context, ops []wire.Op) ([]wire.Result, error) {
+	readOnly := true
+	for _, op := range ops {
+		if len(op.Key) == 0 {
+			return nil, errEmptyKey
+		}
+		switch op.Op {
+		case wire.OpPut, wire.OpDelete:
+			readOnly = false
+		case wire.OpGet, wire.OpCheck:
+		default:
+			return nil, badRequest("unknown op " + strconv.Quote(op.Op))
+		}
+	}
+
+	tx, err := s.db.NewTransaction(ctx, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Discard(ctx)
+
+	vtx, versioned := tx.(versionedTx)
+	results := make([]wire.Result, len(ops))
+	for i, op := range ops {
+		conditional := op.IfMatch != "" || op.IfNoneMatch != ""
+		if versioned && conditional && (op.Op == wire.OpPut || op.Op == wire.OpDelete) {
+			if results[i], err = writeIfVersion(ctx, vtx, op); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if op.Op == wire.OpGet || op.Op == wire.OpCheck || op.IfMatch != "" || op.IfNoneMatch != "" {
+			v, err := tx.Get(ctx, op.Key)
+			if err != nil && err != kv.ErrNotFound {
+				return nil, err
+			}
+			res := wire.Result{Found: err == nil}
+			if res.Found {
+				res.ETag = wire.ETag(v)
+			}
+			if !preconditionsMet(op, res) {
+				return nil, errPrecondition
+			}
+			if op.Op == wire.OpGet {
+				res.Value = v
+			}
+			results[i] = res
+		}
+
+		switch op.Op {
+		case wire.OpPut:
+			if err := tx.Put(ctx, op.Key, op.Value); err != nil {
+				return nil, err
+			}
+			results[i] = wire.Result{Found: true, ETag: wire.ETag(op.Value)}
+		case wire.OpDelete:
+			if err := tx.Delete(ctx, op.Key); err != nil && err != kv.ErrNotFound {
+				return nil, err
+			}
+			results[i] = wire.Result{}
+		}
+	}
+
+	if readOnly {
+		return results, nil
+	}
+	return results, tx.Commit(ctx)
+}
+
+// writeIfVersion applies a put or delete if its preconditions are met, as a
+// write conditional on the version of the key they were checked against
+func writeIfVersion(ctx context.Context, tx versionedTx, op wire.Op) (wire.Result, error) {
+	v, version, err := tx.GetWithVersion(ctx, op.Key)
+	if err != nil && err != kv.ErrNotFound {
+		return wire.Result{}, err
+	}
+	current := wire.Result{Found: err == nil}
+	if current.Found {
+		current.ETag = wire.ETag(v)
+	}
+	if !preconditionsMet(op, current) {
+		return wire.Result{}, errPrecondition
+	}
+
+	res := wire.Result{}
+	if op.Op == wire.OpPut {
+		err = tx.PutIfVersion(ctx, op.Key, op.Value, version)
+		res = wire.Result{Found: true, ETag: wire.ETag(op.Value)}
+	} else {
+		err = tx.DeleteIfVersion(ctx, op.Key, version)
+	}
+	if err == kv.ErrVersionMismatch {
+		// written concurrently since the check
+		return wire.Result{}, errPrecondition
+	}
+	return res, err
+}
+
+func preconditionsMet(op wire.Op, current wire.Result) bool {
+	if op.IfMatch != "" && (!current.Found || (op.IfMatch != "*" && !match(op.IfMatch, current.ETag))) {
+		return false
+	}
+	if op.IfNoneMatch != "" && current.Found && (op.IfNoneMatch == "*" || match(op.IfNoneMatch, current.ETag)) {
+		return false
+	}
+	return true
+}
+
+// match reports whether a list of ETags from an If-Match or If-None-Match
+// header contains etag. Weak ETags compare equal to their strong form.
+func match(header, etag string) bool {
+	if header == "" || etag == "" {
+		return false
+	}
+	for _, h := range strings.Split(header, ",") {
+		h = strings.TrimPrefix(strings.TrimSpace(h), "W/")
+		if h == "*" || h == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func statusOf(err error) int {
+	var he httpError
+	switch {
+	case errors.As(err, &he):
+		return he.status
+	case errors.Is(err, kv.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, kv.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, kv.ErrReadOnly):
+		return http.StatusForbidden
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusOf(err))
+	json.NewEncoder(w).Encode(wire.Error{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zatte/kv"
+	"github.com/zatte/kv/internal/wire"
+)
+
+func TestServer(t *testing.T) {
+	ctx := context.Background()
+	backend, err := kv.New("badger:///?memory=true")
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(New(backend, Options{Token: "secret", MaxScanLimit: 7}))
+	defer ts.Close()
+
+	db, err := kv.New("remote://" + strings.TrimPrefix(ts.URL, "http://") + "?token=secret&insecure=true")
+	require.NoError(t, err)
+
+	t.Run("get put delete", func(t *testing.T) {
+		for _, key := range [][]byte{[]byte("plain"), []byte("a/../b//c?d#e"), {0, 0xff, '%', ' '}} {
+			require.NoError(t, db.Put(ctx, key, []byte("value")))
+			v, err := db.Get(ctx, key)
+			require.NoError(t, err)
+			assert.Equal(t, []byte("value"), v)
+
+			v, err = backend.Get(ctx, key)
+			require.NoError(t, err)
+			assert.Equal(t, []byte("value"), v)
+
+			require.NoError(t, db.Delete(ctx, key))
+			_, err = db.Get(ctx, key)
+			assert.Equal(t, kv.ErrNotFound, err)
+		}
+	})
+
+	t.Run("delete range", func(t *testing.T) {
+		for _, k := range []string{"range/a", "range/b", "range/c", "range/d"} {
+			require.NoError(t, db.Put(ctx, []byte(k), []byte("v")))
+		}
+		n, err := db.DeleteRange(ctx, []byte("range/b"), []byte("range/d"))
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), n)
+		_, err = db.Get(ctx, []byte("range/c"))
+		assert.Equal(t, kv.ErrNotFound, err)
+
+		n, err = db.DeleteRange(ctx, []byte("range/d"), []byte{})
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), n)
+		_, err = db.Get(ctx, []byte("range/d"))
+		assert.NoError(t, err)
+
+		n, err = db.DeleteRange(ctx, []byte("range/"), kv.PrefixEnd([]byte("range/")))
+		require.NoError(t, err)
+		assert.Equal(t, int64(-1), n, "badger drops prefixes without counting")
+		_, err = db.Get(ctx, []byte("range/a"))
+		assert.Equal(t, kv.ErrNotFound, err)
+	})
+
+	t.Run("token requires tls unless insecure", func(t *testing.T) {
+		_, err := kv.New("remote://" + strings.TrimPrefix(ts.URL, "http://") + "?token=secret")
+		assert.Equal(t, kv.ErrInsecureToken, err)
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/keys/plain")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("etags", func(t *testing.T) {
+		rdb := db.(*kv.RemoteDB)
+		key := []byte("etag")
+
+		require.NoError(t, rdb.PutIfMatch(ctx, key, []byte("v1"), ""))
+		assert.Equal(t, kv.ErrConflict, rdb.PutIfMatch(ctx, key, []byte("v1"), ""))
+
+		_, etag, err := rdb.GetWithETag(ctx, key)
+		require.NoError(t, err)
+		assert.Equal(t, wire.ETag([]byte("v1")), etag)
+
+		require.NoError(t, rdb.PutIfMatch(ctx, key, []byte("v2"), etag))
+		assert.Equal(t, kv.ErrConflict, rdb.PutIfMatch(ctx, key, []byte("v3"), etag))
+
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/keys/etag", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("If-None-Match", wire.ETag([]byte("v2")))
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	})
+
+	t.Run("scan with cursors and transaction writes", func(t *testing.T) {
+		for i := 0; i < 20; i++ {
+			require.NoError(t, db.Put(ctx, []byte(fmt.Sprintf("scan/%02d", i)), []byte{byte(i)}))
+		}
+
+		tx, err := db.NewTransaction(ctx, false)
+		require.NoError(t, err)
+		defer tx.Discard(ctx)
+		require.NoError(t, tx.Delete(ctx, []byte("scan/03")))
+		require.NoError(t, tx.Put(ctx, []byte("scan/05"), []byte("new")))
+		require.NoError(t, tx.Put(ctx, []byte("scan/05b"), []byte("added")))
+
+		it, err := tx.Seek(ctx, []byte("scan/"))
+		require.NoError(t, err)
+		defer it.Close()
+		var keys []string
+		for {
+			k, v, err := it.Next(ctx)
+			if err == kv.ErrNotFound {
+				break
+			}
+			require.NoError(t, err)
+			if !bytes.HasPrefix(k, []byte("scan/")) {
+				break
+			}
+			if string(k) == "scan/05" {
+				assert.Equal(t, []byte("new"), v)
+			}
+			keys = append(keys, string(k))
+		}
+		assert.Len(t, keys, 20)
+		assert.NotContains(t, keys, "scan/03")
+		assert.Equal(t, "scan/05b", keys[5])
+	})
+
+	t.Run("transaction conflict", func(t *testing.T) {
+		require.NoError(t, db.Put(ctx, []byte("counter"), []byte("1")))
+
+		t1, err := db.NewTransaction(ctx, false)
+		require.NoError(t, err)
+		defer t1.Discard(ctx)
+		_, err = t1.Get(ctx, []byte("counter"))
+		require.NoError(t, err)
+		_, err = t1.Get(ctx, []byte("missing"))
+		assert.Equal(t, kv.ErrNotFound, err)
+
+		require.NoError(t, db.Put(ctx, []byte("counter"), []byte("2")))
+
+		require.NoError(t, t1.Put(ctx, []byte("counter"), []byte("from t1")))
+		assert.Equal(t, kv.ErrConflict, t1.Commit(ctx))
+
+		v, err := db.Get(ctx, []byte("counter"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte("2"), v)
+	})
+
+	t.Run("unknown paths are not missing keys", func(t *testing.T) {
+		wrong, err := kv.New("remote://" + strings.TrimPrefix(ts.URL, "http://") + "/prefix?token=secret&insecure=true")
+		require.NoError(t, err)
+		_, err = wrong.Get(ctx, []byte("plain"))
+		require.Error(t, err)
+		assert.NotEqual(t, kv.ErrNotFound, err)
+	})
+
+	t.Run("read-only transactions", func(t *testing.T) {
+		tx, err := db.NewTransaction(ctx, true)
+		require.NoError(t, err)
+		defer tx.Discard(ctx)
+		assert.Equal(t, kv.ErrReadOnly, tx.Put(ctx, []byte("k"), []byte("v")))
+	})
+}
+
+func TestServerConditionalWrites(t *testing.T) {
+	ctx := context.Background()
+	// gorm transactions write preconditions conditionally on the version
+	backend, err := kv.New("sqlite3:///file%3Aserver%3Fmode%3Dmemory%26cache%3Dshared")
+	require.NoError(t, err)
+	ts := httptest.NewServer(New(backend, Options{}))
+	defer ts.Close()
+	db, err := kv.New("remote://" + strings.TrimPrefix(ts.URL, "http://"))
+	require.NoError(t, err)
+	rdb := db.(*kv.RemoteDB)
+	key := []byte(fmt.Sprintf("conditional/%d", time.Now().UnixNano()))
+
+	require.NoError(t, rdb.PutIfMatch(ctx, key, []byte("v1"), ""))
+	assert.Equal(t, kv.ErrConflict, rdb.PutIfMatch(ctx, key, []byte("v1"), ""))
+	etag := wire.ETag([]byte("v1"))
+	require.NoError(t, rdb.PutIfMatch(ctx, key, []byte("v2"), etag))
+	assert.Equal(t, kv.ErrConflict, rdb.PutIfMatch(ctx, key, []byte("v3"), etag))
+
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/keys/"+string(key), nil)
+	req.Header.Set("If-Match", etag)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	tx, err := db.NewTransaction(ctx, false)
+	require.NoError(t, err)
+	_, err = tx.Get(ctx, key)
+	require.NoError(t, err)
+	require.NoError(t, db.Put(ctx, key, []byte("v4")))
+	require.NoError(t, tx.Delete(ctx, key))
+	assert.Equal(t, kv.ErrConflict, tx.Commit(ctx))
+
+	v, err := db.Get(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v4"), v)
+}
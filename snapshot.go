@@ -0,0 +1,32 @@
+package kv
+
+import (
+	"context"
+	"time"
+)
+
+// ErrSnapshotUnsupported is returned by NewSnapshot when a store can not read
+// at the requested time
+const ErrSnapshotUnsupported KvError = "snapshot not supported at the read time"
+
+// Snapshotter is implemented by stores that can pin read-only transactions to
+// a point in time
+type Snapshotter interface {
+	NewSnapshot(ctx context.Context, readTs time.Time) (OrderedTransaction, error)
+}
+
+// NewSnapshot starts a read-only transaction that sees the store as it was at
+// readTs, across all its reads and every page of its scans, while writers
+// carry on. A zero readTs reads at the current time.
+//
+// Badger reads at any time in history mode, as long as the versions at readTs
+// are still retained; times in the future read at the current time. SQL
+// stores only support the current time. Other stores, including datastore
+// whose queries can not be pinned to a transaction's snapshot, return
+// ErrSnapshotUnsupported.
+func NewSnapshot(ctx context.Context, db OrderedTransactional, readTs time.Time) (OrderedTransaction, error) {
+	if s, ok := db.(Snapshotter); ok {
+		return s.NewSnapshot(ctx, readTs)
+	}
+	return nil, ErrSnapshotUnsupported
+}
@@ -2,11 +2,17 @@ package kv
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
 )
 
 func TestKvStores(t *testing.T) {
@@ -32,6 +38,25 @@ func TestKvStores(t *testing.T) {
 	testStores(t, datastore, "datastore")
 }
 
+func TestGormMigrationErrors(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:migration?mode=memory&cache=shared"), &gorm.Config{})
+	require.NoError(t, err)
+	// keys written twice before the key was unique can not get a unique index
+	require.NoError(t, db.Exec("CREATE TABLE grom_key_values (id integer primary key, key blob, val blob)").Error)
+	require.NoError(t, db.Exec("INSERT INTO grom_key_values (key, val) VALUES ('k', '1'), ('k', '2')").Error)
+
+	_, err = NewGormFromDB(db)
+	assert.Error(t, err)
+}
+
+func TestPrefixEnd(t *testing.T) {
+	assert.Equal(t, []byte("b"), PrefixEnd([]byte("a")))
+	assert.Equal(t, []byte{'a', 1}, PrefixEnd([]byte{'a', 0, 0xff}))
+	assert.Equal(t, []byte{'b'}, PrefixEnd([]byte{'a', 0xff, 0xff}))
+	assert.Nil(t, PrefixEnd([]byte{0xff}))
+	assert.Nil(t, PrefixEnd(nil))
+}
+
 func testStores(t *testing.T, db OrderedTransactional, name string) {
 	ctx := context.Background()
 	t.Run(name+": create delete read", func(t *testing.T) {
@@ -63,6 +88,22 @@ func testStores(t *testing.T, db OrderedTransactional, name string) {
 		assert.Equal(t, v, []byte("5"))
 	})
 
+	t.Run(name+": concurrent first puts", func(t *testing.T) {
+		fresh := []byte(fmt.Sprintf("put/%d", time.Now().UnixNano()))
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				assert.NoError(t, db.Put(ctx, fresh, []byte{byte(i)}))
+			}(i)
+		}
+		wg.Wait()
+		_, err := db.Get(ctx, fresh)
+		assert.NoError(t, err)
+		require.NoError(t, db.Delete(ctx, fresh))
+	})
+
 	t.Run(name+": adding and reading (iterator) ordered twice", func(t *testing.T) {
 		assert.NoError(t, db.Put(ctx, []byte("B0"), []byte("1")))
 		assert.NoError(t, db.Put(ctx, []byte("B01"), []byte("2")))
@@ -78,7 +119,7 @@ func testStores(t *testing.T, db OrderedTransactional, name string) {
 		defer t1.Discard(ctx)
 		assert.NoError(t, err)
 		t2, err := db.NewTransaction(ctx, false)
-		defer t1.Discard(ctx)
+		defer t2.Discard(ctx)
 		assert.NoError(t, err)
 
 		it1, err := t1.Seek(ctx, []byte("B02"))
@@ -89,8 +130,9 @@ func testStores(t *testing.T, db OrderedTransactional, name string) {
 		defer it2.Close()
 
 		var previousVal [3]byte
-		_, v, err := it1.Next(ctx)
+		k, v, err := it1.Next(ctx)
 		assert.NoError(t, err)
+		assert.Equal(t, "B02", string(k))
 		assert.Equal(t, "3", string(v))
 		for ; err == nil; _, v, err = it1.Next(ctx) {
 			//t.Logf("got value: %s (err:%v)", string(v), err)
@@ -107,4 +149,272 @@ func testStores(t *testing.T, db OrderedTransactional, name string) {
 			copy(v, previousVal[:])
 		}
 	})
+
+	t.Run(name+": binary keys round trip", func(t *testing.T) {
+		key := []byte{'C', 0xc3, 0x28, 0x00, 0xff}
+		assert.NoError(t, db.Put(ctx, key, []byte("1")))
+
+		v, err := db.Get(ctx, key)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("1"), v)
+
+		tx, err := db.NewTransaction(ctx, true)
+		require.NoError(t, err)
+		defer tx.Discard(ctx)
+
+		it, err := tx.Seek(ctx, []byte("C"))
+		require.NoError(t, err)
+		defer it.Close()
+
+		k, v, err := it.Next(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, key, k)
+		assert.Equal(t, []byte("1"), v)
+	})
+
+	t.Run(name+": canceled context", func(t *testing.T) {
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err := db.Get(canceled, []byte("A0"))
+		assert.True(t, errors.Is(err, context.Canceled), "get: %v", err)
+		err = db.Put(canceled, []byte("A0"), []byte("x"))
+		assert.True(t, errors.Is(err, context.Canceled), "put: %v", err)
+		err = db.Delete(canceled, []byte("A0"))
+		assert.True(t, errors.Is(err, context.Canceled), "delete: %v", err)
+		_, err = db.NewTransaction(canceled, true)
+		assert.True(t, errors.Is(err, context.Canceled), "new transaction: %v", err)
+
+		v, err := db.Get(ctx, []byte("A0"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("1"), v)
+
+		expired, cancel := context.WithDeadline(ctx, time.Now().Add(-time.Second))
+		defer cancel()
+		_, err = db.Get(expired, []byte("A0"))
+		assert.True(t, errors.Is(err, context.DeadlineExceeded), "get: %v", err)
+	})
+
+	t.Run(name+": canceled mid scan", func(t *testing.T) {
+		tx, err := db.NewTransaction(ctx, true)
+		require.NoError(t, err)
+		defer tx.Discard(ctx)
+
+		scanCtx, cancel := context.WithCancel(ctx)
+		it, err := tx.Seek(scanCtx, []byte("B"))
+		require.NoError(t, err)
+		defer it.Close()
+
+		_, _, err = it.Next(scanCtx)
+		assert.NoError(t, err)
+		cancel()
+		_, _, err = it.Next(scanCtx)
+		assert.True(t, errors.Is(err, context.Canceled), "next: %v", err)
+	})
+
+	t.Run(name+": read-only transactions reject writes", func(t *testing.T) {
+		tx, err := db.NewTransaction(ctx, true)
+		require.NoError(t, err)
+		defer tx.Discard(ctx)
+
+		assert.EqualError(t, tx.Put(ctx, []byte("A0"), []byte("x")), ErrReadOnly.Error())
+		assert.EqualError(t, tx.Delete(ctx, []byte("A0")), ErrReadOnly.Error())
+		// writes through optional interfaces of the transaction are rejected too
+		if rd, ok := tx.(RangeDeleter); ok {
+			_, err := rd.DeleteRange(ctx, []byte("A"), []byte("B"))
+			assert.Equal(t, ErrReadOnly, err)
+		}
+		if v, ok := tx.(Versioner); ok {
+			assert.Equal(t, ErrReadOnly, v.PutIfVersion(ctx, []byte("A0"), []byte("x"), VersionNotExist))
+		}
+		if d, ok := tx.(VersionedDeleter); ok {
+			assert.Equal(t, ErrReadOnly, d.DeleteIfVersion(ctx, []byte("A0"), VersionNotExist))
+		}
+		if m, ok := tx.(Mutator); ok {
+			_, err := m.Mutate(ctx, []byte("A0"), MutationAdd, 1)
+			assert.Equal(t, ErrReadOnly, err)
+		}
+
+		v, err := tx.Get(ctx, []byte("A0"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("1"), v)
+	})
+
+	t.Run(name+": delete range", func(t *testing.T) {
+		for _, k := range []string{"R0", "R1", "R2", "R3", "R30", "R4", "S0"} {
+			require.NoError(t, db.Put(ctx, []byte(k), []byte("v")))
+		}
+
+		n, err := db.DeleteRange(ctx, []byte("R1"), []byte("R4"))
+		require.NoError(t, err)
+		assert.Equal(t, int64(4), n)
+		for k, found := range map[string]bool{"R0": true, "R1": false, "R3": false, "R30": false, "R4": true, "S0": true} {
+			_, err := db.Get(ctx, []byte(k))
+			assert.Equal(t, found, err == nil, k)
+		}
+
+		// a whole prefix, which some backends drop without counting
+		n, err = db.DeleteRange(ctx, []byte("R"), PrefixEnd([]byte("R")))
+		require.NoError(t, err)
+		assert.Contains(t, []int64{2, -1}, n)
+		_, err = db.Get(ctx, []byte("R0"))
+		assert.Equal(t, ErrNotFound, err)
+		_, err = db.Get(ctx, []byte("S0"))
+		assert.NoError(t, err)
+
+		n, err = db.DeleteRange(ctx, []byte("S"), []byte("S"))
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), n)
+	})
+
+	t.Run(name+": counters", func(t *testing.T) {
+		key := []byte("counter")
+		defer db.Delete(ctx, key)
+
+		n, err := Add(ctx, db, key, 5)
+		require.NoError(t, err)
+		assert.Equal(t, int64(5), n)
+		n, err = Add(ctx, db, key, -7)
+		require.NoError(t, err)
+		assert.Equal(t, int64(-2), n)
+		v, err := db.Get(ctx, key)
+		require.NoError(t, err)
+		assert.Equal(t, []byte{0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, v, "little-endian")
+
+		for _, m := range []struct {
+			op      MutationType
+			operand int64
+			want    int64
+		}{
+			{MutationMax, 10, 10},
+			{MutationMax, 3, 10},
+			{MutationMin, 4, 4},
+			{MutationBitOr, 3, 7},
+			{MutationBitAnd, 5, 5},
+		} {
+			n, err := Mutate(ctx, db, key, m.op, m.operand)
+			require.NoError(t, err)
+			assert.Equal(t, m.want, n)
+		}
+
+		// without native support mutations run in retried transactions
+		plain := struct{ OrderedTransactional }{db}
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(db OrderedTransactional) {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					_, err := Add(ctx, db, key, 1)
+					assert.NoError(t, err)
+				}
+			}([]OrderedTransactional{db, plain}[i%2])
+		}
+		wg.Wait()
+		v, err = db.Get(ctx, key)
+		require.NoError(t, err)
+		n, err = DecodeCounter(v)
+		require.NoError(t, err)
+		assert.Equal(t, int64(45), n)
+
+		require.NoError(t, db.Put(ctx, key, []byte("x")))
+		_, err = Add(ctx, db, key, 1)
+		assert.Equal(t, ErrNotCounter, err)
+
+		// concurrent first mutations of a key must not both create it
+		fresh := []byte(fmt.Sprintf("counter/%d", time.Now().UnixNano()))
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := Add(ctx, db, fresh, 1)
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+		v, err = db.Get(ctx, fresh)
+		require.NoError(t, err)
+		n, err = DecodeCounter(v)
+		require.NoError(t, err)
+		assert.Equal(t, int64(4), n)
+		if gdb, ok := db.(*GormDB); ok {
+			var rows int64
+			require.NoError(t, gdb.DB.Model(&GromKeyValue{}).Where("key = ?", fresh).Count(&rows).Error)
+			assert.Equal(t, int64(1), rows)
+		}
+		require.NoError(t, db.Delete(ctx, fresh))
+	})
+
+	t.Run(name+": versions", func(t *testing.T) {
+		for _, db := range []OrderedTransactional{db, struct{ OrderedTransactional }{db}} {
+			key := []byte("versioned")
+			_, version, err := GetWithVersion(ctx, db, key)
+			assert.Equal(t, ErrNotFound, err)
+			assert.Equal(t, VersionNotExist, version)
+
+			require.NoError(t, PutIfVersion(ctx, db, key, []byte("1"), VersionNotExist))
+			assert.Equal(t, ErrVersionMismatch, PutIfVersion(ctx, db, key, []byte("x"), VersionNotExist))
+			v, v1, err := GetWithVersion(ctx, db, key)
+			require.NoError(t, err)
+			assert.Equal(t, []byte("1"), v)
+			assert.NotEqual(t, VersionNotExist, v1)
+
+			require.NoError(t, db.Put(ctx, key, []byte("2")))
+			_, v2, err := GetWithVersion(ctx, db, key)
+			require.NoError(t, err)
+			assert.Greater(t, v2, v1)
+			assert.Equal(t, ErrVersionMismatch, PutIfVersion(ctx, db, key, []byte("x"), v1))
+
+			require.NoError(t, PutIfVersion(ctx, db, key, []byte("3"), v2))
+			v, v3, err := GetWithVersion(ctx, db, key)
+			require.NoError(t, err)
+			assert.Equal(t, []byte("3"), v)
+
+			assert.Equal(t, ErrVersionMismatch, DeleteIfVersion(ctx, db, key, v2))
+			assert.Equal(t, ErrVersionMismatch, DeleteIfVersion(ctx, db, key, VersionNotExist))
+			require.NoError(t, DeleteIfVersion(ctx, db, key, v3))
+			_, err = db.Get(ctx, key)
+			assert.Equal(t, ErrNotFound, err)
+			assert.NoError(t, DeleteIfVersion(ctx, db, key, VersionNotExist))
+			assert.Equal(t, ErrVersionMismatch, DeleteIfVersion(ctx, db, key, v3))
+
+			// exactly one of concurrent creates of a key succeeds
+			fresh := []byte(fmt.Sprintf("versioned/%d", time.Now().UnixNano()))
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			created := 0
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					err := PutIfVersion(ctx, db, fresh, []byte("1"), VersionNotExist)
+					if err == ErrVersionMismatch {
+						return
+					}
+					assert.NoError(t, err)
+					mu.Lock()
+					created++
+					mu.Unlock()
+				}()
+			}
+			wg.Wait()
+			assert.Equal(t, 1, created)
+			require.NoError(t, db.Delete(ctx, fresh))
+		}
+	})
+
+	t.Run(name+": snapshot", func(t *testing.T) {
+		snap, err := NewSnapshot(ctx, db, time.Time{})
+		if _, ok := db.(*DatastoreDB); ok {
+			assert.Equal(t, ErrSnapshotUnsupported, err)
+			return
+		}
+		require.NoError(t, err)
+		defer snap.Discard(ctx)
+
+		v, err := snap.Get(ctx, []byte("A0"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte("1"), v)
+		assert.EqualError(t, snap.Put(ctx, []byte("A0"), []byte("x")), ErrReadOnly.Error())
+	})
 }
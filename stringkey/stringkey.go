@@ -38,6 +38,15 @@ func (bs *StringKeyerDb) Delete(ctx context.Context, key string) error {
 	return bs.OrderedTransactional.Delete(ctx, []byte(key))
 }
 
+// DeleteRange deletes all keys in [start, end), or from start on for an empty end
+func (bs *StringKeyerDb) DeleteRange(ctx context.Context, start, end string) (int64, error) {
+	var e []byte
+	if end != "" {
+		e = []byte(end)
+	}
+	return bs.OrderedTransactional.DeleteRange(ctx, []byte(start), e)
+}
+
 // NewTransaction for batching multiple values inside a transaction
 func (bs *StringKeyerDb) NewTransaction(ctx context.Context, readOnly bool) (kv.OrderedTransaction, error) {
 	return bs.OrderedTransactional.NewTransaction(ctx, readOnly)
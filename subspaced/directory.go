@@ -0,0 +1,341 @@
+package subspaced
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+
+	"github.com/zatte/fdbtuple"
+	"github.com/zatte/fdbtuple/subspace"
+	"github.com/zatte/kv"
+)
+
+const (
+	// ErrDirectoryExists is returned when creating a directory that already exists
+	ErrDirectoryExists kv.KvError = "subspaced: directory already exists"
+	// ErrDirectoryNotFound is returned when a directory or one of its parents does not exist
+	ErrDirectoryNotFound kv.KvError = "subspaced: directory not found"
+	// ErrInvalidPath is returned for empty paths and moves of a directory into itself
+	ErrInvalidPath kv.KvError = "subspaced: invalid directory path"
+
+	// errMissingPrefixes reruns a create once more prefixes are allocated
+	errMissingPrefixes kv.KvError = "subspaced: prefixes missing"
+)
+
+// Directory maps human readable paths like ("app", "users") to short prefixes
+// allocated in the store itself, similar to the FoundationDB directory layer.
+// Directories can be renamed and moved without rewriting their content since
+// keys only contain the allocated prefix.
+//
+// Metadata is stored under the "dir" subspace of the directory root; a node
+// (parent prefix, name) holds the prefix allocated for the child. Prefixes are
+// the packed integers of a counter, i.e. only a few bytes after the root. Each
+// prefix is claimed with its own key created by kv.PutIfVersion, so concurrent
+// creates never share a prefix as long as the store's PutIfVersion is atomic;
+// the counter is only a hint where to look for the next free prefix.
+type Directory struct {
+	db    kv.OrderedTransactional
+	root  subspace.Subspace
+	nodes subspace.Subspace
+}
+
+// NewDirectory creates a directory layer with all its metadata and content
+// located under the prefixes
+func NewDirectory(db kv.OrderedTransactional, prefixes ...interface{}) *Directory {
+	root := subspace.Sub(toTupleElements(prefixes)...)
+	return &Directory{db, root, root.Sub("dir")}
+}
+
+func (d *Directory) nodeKey(parent []byte, name string) []byte {
+	return d.nodes.Pack(fdbtuple.Tuple{parent, name})
+}
+
+func (d *Directory) counterKey() []byte {
+	return d.nodes.Pack(fdbtuple.Tuple{"counter"})
+}
+
+func (d *Directory) claimKey(n uint64) []byte {
+	return d.nodes.Pack(fdbtuple.Tuple{"prefix", int64(n)})
+}
+
+// find returns the prefix of path, with an empty path being the root
+func (d *Directory) find(ctx context.Context, tx kv.OrderedTransaction, path []string) ([]byte, error) {
+	prefix := []byte{}
+	for _, name := range path {
+		p, err := tx.Get(ctx, d.nodeKey(prefix, name))
+		if err == kv.ErrNotFound {
+			return nil, ErrDirectoryNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		prefix = p
+	}
+	return prefix, nil
+}
+
+// allocate claims the next free prefix. Claims are made outside of the
+// transaction creating the directory, so they stand even if it fails; the
+// prefix of a failed create is never reused.
+func (d *Directory) allocate(ctx context.Context) ([]byte, error) {
+	var n uint64
+	v, err := d.db.Get(ctx, d.counterKey())
+	switch {
+	case err == nil && len(v) == 8:
+		n = binary.BigEndian.Uint64(v)
+	case err != nil && err != kv.ErrNotFound:
+		return nil, err
+	}
+	for {
+		err := kv.PutIfVersion(ctx, d.db, d.claimKey(n), []byte{}, kv.VersionNotExist)
+		if err == nil {
+			break
+		}
+		if err != kv.ErrVersionMismatch {
+			return nil, err
+		}
+		n++ // claimed by a concurrent create
+	}
+	next := make([]byte, 8)
+	binary.BigEndian.PutUint64(next, n+1)
+	if err := d.db.Put(ctx, d.counterKey(), next); err != nil {
+		return nil, err
+	}
+	return d.root.Pack(fdbtuple.Tuple{int64(n)}), nil
+}
+
+// update runs f in a read-write transaction and commits it
+func (d *Directory) update(ctx context.Context, f func(tx kv.OrderedTransaction) error) error {
+	tx, err := d.db.NewTransaction(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer tx.Discard(ctx)
+	if err := f(tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// children lists the names and prefixes of the direct children of parent
+func (d *Directory) children(ctx context.Context, tx kv.OrderedTransaction, parent []byte) (names []string, prefixes [][]byte, err error) {
+	ss := d.nodes.Sub(parent)
+	begin, end := ss.FDBRangeKeys()
+	it, err := tx.Seek(ctx, begin.FDBKey())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer it.Close()
+	k, v, err := it.Next(ctx)
+	for ; err == nil && bytes.Compare(k, end.FDBKey()) < 0; k, v, err = it.Next(ctx) {
+		t, err := ss.Unpack(fdbtuple.Key(k))
+		if err != nil {
+			return nil, nil, err
+		}
+		names = append(names, t[0].(string))
+		prefixes = append(prefixes, v)
+	}
+	if err != nil && err != kv.ErrNotFound {
+		return nil, nil, err
+	}
+	return names, prefixes, nil
+}
+
+func (d *Directory) open(prefix []byte) *SubSpacedDb {
+	return &SubSpacedDb{d.db, subspace.FromBytes(prefix)}
+}
+
+// Create creates the directory at path, including missing parents, and
+// returns its subspace. Returns ErrDirectoryExists if it already exists.
+func (d *Directory) Create(ctx context.Context, path ...string) (*SubSpacedDb, error) {
+	return d.createOrOpen(ctx, path, false)
+}
+
+// CreateOrOpen opens the directory at path, creating it and any missing
+// parents if needed
+func (d *Directory) CreateOrOpen(ctx context.Context, path ...string) (*SubSpacedDb, error) {
+	return d.createOrOpen(ctx, path, true)
+}
+
+func (d *Directory) createOrOpen(ctx context.Context, path []string, allowOpen bool) (*SubSpacedDb, error) {
+	if len(path) == 0 {
+		return nil, ErrInvalidPath
+	}
+	// prefixes are allocated outside of the transaction, which on some stores
+	// holds a write lock, and the transaction is rerun once enough are claimed
+	var prefix []byte
+	var spare [][]byte
+	for {
+		missing := 0
+		err := d.update(ctx, func(tx kv.OrderedTransaction) error {
+			prefix = []byte{}
+			used := 0
+			for i, name := range path {
+				p, err := tx.Get(ctx, d.nodeKey(prefix, name))
+				if err == nil {
+					if i == len(path)-1 && !allowOpen {
+						return ErrDirectoryExists
+					}
+					prefix = p
+					continue
+				}
+				if err != kv.ErrNotFound {
+					return err
+				}
+				if used == len(spare) {
+					missing = len(path) - i
+					return errMissingPrefixes
+				}
+				p, used = spare[used], used+1
+				if err := tx.Put(ctx, d.nodeKey(prefix, name), p); err != nil {
+					return err
+				}
+				prefix = p
+			}
+			return nil
+		})
+		if err == errMissingPrefixes {
+			for ; missing > 0; missing-- {
+				p, err := d.allocate(ctx)
+				if err != nil {
+					return nil, err
+				}
+				spare = append(spare, p)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return d.open(prefix), nil
+	}
+}
+
+// Open returns the subspace of an existing directory, or ErrDirectoryNotFound
+func (d *Directory) Open(ctx context.Context, path ...string) (*SubSpacedDb, error) {
+	if len(path) == 0 {
+		return nil, ErrInvalidPath
+	}
+	tx, err := d.db.NewTransaction(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Discard(ctx)
+	prefix, err := d.find(ctx, tx, path)
+	if err != nil {
+		return nil, err
+	}
+	return d.open(prefix), nil
+}
+
+// List returns the names of the subdirectories of path in sorted order. An
+// empty path lists the top level directories.
+func (d *Directory) List(ctx context.Context, path ...string) ([]string, error) {
+	tx, err := d.db.NewTransaction(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Discard(ctx)
+	prefix, err := d.find(ctx, tx, path)
+	if err != nil {
+		return nil, err
+	}
+	names, _, err := d.children(ctx, tx, prefix)
+	return names, err
+}
+
+// Move renames the directory at from to to, keeping its prefix and therefore
+// its content and subdirectories. The parent of to must exist.
+func (d *Directory) Move(ctx context.Context, from, to []string) error {
+	if len(from) == 0 || len(to) == 0 || isPrefix(from, to) {
+		return ErrInvalidPath
+	}
+	return d.update(ctx, func(tx kv.OrderedTransaction) error {
+		fromParent, err := d.find(ctx, tx, from[:len(from)-1])
+		if err != nil {
+			return err
+		}
+		fromKey := d.nodeKey(fromParent, from[len(from)-1])
+		prefix, err := tx.Get(ctx, fromKey)
+		if err == kv.ErrNotFound {
+			return ErrDirectoryNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		toParent, err := d.find(ctx, tx, to[:len(to)-1])
+		if err != nil {
+			return err
+		}
+		toKey := d.nodeKey(toParent, to[len(to)-1])
+		if _, err := tx.Get(ctx, toKey); err == nil {
+			return ErrDirectoryExists
+		} else if err != kv.ErrNotFound {
+			return err
+		}
+
+		if err := tx.Delete(ctx, fromKey); err != nil {
+			return err
+		}
+		return tx.Put(ctx, toKey, prefix)
+	})
+}
+
+// Remove deletes the directory at path together with all its content and
+// subdirectories, within a single transaction
+func (d *Directory) Remove(ctx context.Context, path ...string) error {
+	if len(path) == 0 {
+		return ErrInvalidPath
+	}
+	return d.update(ctx, func(tx kv.OrderedTransaction) error {
+		parent, err := d.find(ctx, tx, path[:len(path)-1])
+		if err != nil {
+			return err
+		}
+		key := d.nodeKey(parent, path[len(path)-1])
+		prefix, err := tx.Get(ctx, key)
+		if err == kv.ErrNotFound {
+			return ErrDirectoryNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.Delete(ctx, key); err != nil {
+			return err
+		}
+		return d.removeTree(ctx, tx, prefix)
+	})
+}
+
+// removeTree deletes the content, subdirectory nodes and subdirectories of
+// the directory with prefix
+func (d *Directory) removeTree(ctx context.Context, tx kv.OrderedTransaction, prefix []byte) error {
+	names, prefixes, err := d.children(ctx, tx, prefix)
+	if err != nil {
+		return err
+	}
+	for i, name := range names {
+		if err := tx.Delete(ctx, d.nodeKey(prefix, name)); err != nil {
+			return err
+		}
+		if err := d.removeTree(ctx, tx, prefixes[i]); err != nil {
+			return err
+		}
+	}
+	_, err = clearRange(ctx, tx, subspace.FromBytes(prefix), 0)
+	return err
+}
+
+// isPrefix reports whether path a is a prefix of (or equal to) path b
+func isPrefix(a, b []string) bool {
+	if len(a) > len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,116 @@
+package subspaced
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zatte/kv"
+)
+
+func TestDirectory(t *testing.T) {
+	ctx := context.Background()
+	badger, err := kv.New("badger:///?memory=true")
+	require.NoError(t, err)
+	dir := NewDirectory(badger, "directory")
+
+	users, err := dir.Create(ctx, "app", "users")
+	require.NoError(t, err)
+	require.NoError(t, users.Put(ctx, []byte("1"), []byte("ada")))
+	assert.Less(t, len(users.subspace.Bytes()), 16, "prefixes are short")
+
+	_, err = dir.Create(ctx, "app", "users")
+	assert.Equal(t, ErrDirectoryExists, err)
+	_, err = dir.Open(ctx, "app", "missing")
+	assert.Equal(t, ErrDirectoryNotFound, err)
+
+	opened, err := dir.CreateOrOpen(ctx, "app", "users")
+	require.NoError(t, err)
+	v, err := opened.Get(ctx, []byte("1"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("ada"), v)
+
+	_, err = dir.CreateOrOpen(ctx, "app", "orders")
+	require.NoError(t, err)
+	names, err := dir.List(ctx, "app")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"orders", "users"}, names)
+	names, err = dir.List(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"app"}, names)
+
+	t.Run("move keeps content", func(t *testing.T) {
+		require.NoError(t, dir.Move(ctx, []string{"app", "users"}, []string{"app", "people"}))
+		_, err := dir.Open(ctx, "app", "users")
+		assert.Equal(t, ErrDirectoryNotFound, err)
+		people, err := dir.Open(ctx, "app", "people")
+		require.NoError(t, err)
+		v, err := people.Get(ctx, []byte("1"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte("ada"), v)
+
+		assert.Equal(t, ErrInvalidPath, dir.Move(ctx, []string{"app"}, []string{"app", "nested"}))
+		assert.Equal(t, ErrDirectoryExists, dir.Move(ctx, []string{"app", "people"}, []string{"app", "orders"}))
+		assert.Equal(t, ErrDirectoryNotFound, dir.Move(ctx, []string{"app", "people"}, []string{"missing", "people"}))
+	})
+
+	t.Run("remove deletes content and subdirectories", func(t *testing.T) {
+		nested, err := dir.Create(ctx, "app", "people", "archive")
+		require.NoError(t, err)
+		require.NoError(t, nested.Put(ctx, []byte("old"), []byte("x")))
+		people, err := dir.Open(ctx, "app", "people")
+		require.NoError(t, err)
+
+		require.NoError(t, dir.Remove(ctx, "app", "people"))
+		_, err = people.Get(ctx, []byte("1"))
+		assert.Equal(t, kv.ErrNotFound, err)
+		_, err = nested.Get(ctx, []byte("old"))
+		assert.Equal(t, kv.ErrNotFound, err)
+		names, err := dir.List(ctx, "app")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"orders"}, names)
+		assert.Equal(t, ErrDirectoryNotFound, dir.Remove(ctx, "app", "people"))
+
+		recreated, err := dir.Create(ctx, "app", "people")
+		require.NoError(t, err)
+		assert.NotEqual(t, people.subspace.Bytes(), recreated.subspace.Bytes())
+	})
+}
+
+func TestDirectoryConcurrentCreate(t *testing.T) {
+	ctx := context.Background()
+	badger, err := kv.New("badger:///?memory=true")
+	require.NoError(t, err)
+	sqlite, err := kv.New("sqlite3:///file%3Adirectory%3Fmode%3Dmemory%26cache%3Dshared")
+	require.NoError(t, err)
+
+	for name, db := range map[string]kv.OrderedTransactional{"badger": badger, "gorm": sqlite} {
+		t.Run(name, func(t *testing.T) {
+			// shared in-memory sqlite databases outlive a test run
+			dir := NewDirectory(db, "concurrent", time.Now().UnixNano())
+			subspaces := make([]*SubSpacedDb, 8)
+			var wg sync.WaitGroup
+			for i := range subspaces {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					var err error
+					subspaces[i], err = dir.Create(ctx, fmt.Sprintf("d%d", i), "nested")
+					assert.NoError(t, err)
+				}(i)
+			}
+			wg.Wait()
+
+			prefixes := map[string]bool{}
+			for _, ss := range subspaces {
+				require.NotNil(t, ss)
+				prefixes[string(ss.subspace.Bytes())] = true
+			}
+			assert.Len(t, prefixes, len(subspaces), "every directory has its own prefix")
+		})
+	}
+}
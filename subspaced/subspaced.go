@@ -1,6 +1,7 @@
 package subspaced
 
 import (
+	"bytes"
 	"context"
 
 	"github.com/zatte/fdbtuple"
@@ -21,6 +22,7 @@ type SubSpacedDbTransaction struct {
 type SubSpacedDbIterator struct {
 	kv.Iterator
 	subspace subspace.Subspace
+	end      []byte
 }
 
 // New creates a DB which where all keys are located under the prefix. Only the exact
@@ -47,6 +49,27 @@ func NewFromStr(connectionString string, prefixes ...interface{}) (*SubSpacedDb,
 	return New(db, prefixes...), nil
 }
 
+// Sub returns a DB for the nested subspace prefixes under this subspace. It
+// shares the underlying store, so modules can carve out their own key space.
+// Note that New(db, a).Sub(b) is a different key space than New(db, a, b).
+func (bs *SubSpacedDb) Sub(prefixes ...interface{}) *SubSpacedDb {
+	return &SubSpacedDb{bs.OrderedTransactional, bs.subspace.Sub(toTupleElements(prefixes)...)}
+}
+
+// Sub returns a view of this transaction limited to the nested subspace
+// prefixes. Writes through it are part of this transaction.
+func (bst *SubSpacedDbTransaction) Sub(prefixes ...interface{}) *SubSpacedDbTransaction {
+	return &SubSpacedDbTransaction{bst.OrderedTransaction, bst.subspace.Sub(toTupleElements(prefixes)...)}
+}
+
+func toTupleElements(prefixes []interface{}) []fdbtuple.TupleElement {
+	t := make([]fdbtuple.TupleElement, len(prefixes))
+	for i, p := range prefixes {
+		t[i] = p
+	}
+	return t
+}
+
 // Get gets the value of a key within a single query transaction
 func (bs *SubSpacedDb) Get(ctx context.Context, key []byte) (res []byte, err error) {
 	res, err = bs.OrderedTransactional.Get(ctx, bs.subspace.Pack(fdbtuple.Tuple{key}))
@@ -71,9 +94,68 @@ func (bs *SubSpacedDb) NewTransaction(ctx context.Context, readOnly bool) (kv.Or
 	return &SubSpacedDbTransaction{ot, bs.subspace}, err
 }
 
+// DeleteRange deletes all keys in [start, end) of the subspace, or to the end
+// of the subspace for a nil end
+func (bs *SubSpacedDb) DeleteRange(ctx context.Context, start, end []byte) (int64, error) {
+	rawEnd := bs.subspace.Pack(fdbtuple.Tuple{end})
+	if end == nil {
+		_, e := bs.subspace.FDBRangeKeys()
+		rawEnd = e.FDBKey()
+	}
+	return bs.OrderedTransactional.DeleteRange(ctx, bs.subspace.Pack(fdbtuple.Tuple{start}), rawEnd)
+}
+
+// Clear deletes every key of the subspace, including nested subspaces, with
+// DeleteRange over its prefix. The store decides whether it can drop the
+// prefix at once, e.g. badger outside of history mode; otherwise the range is
+// deleted in batches, which is not atomic for large subspaces.
+func (bs *SubSpacedDb) Clear(ctx context.Context) error {
+	prefix := bs.subspace.Bytes()
+	_, err := bs.OrderedTransactional.DeleteRange(ctx, prefix, kv.PrefixEnd(prefix))
+	return err
+}
+
+// clearRange deletes up to limit keys of ss, or all if limit is 0, and returns
+// the number of deleted keys
+func clearRange(ctx context.Context, tx kv.OrderedTransaction, ss subspace.Subspace, limit int) (int, error) {
+	begin, end := ss.FDBRangeKeys()
+	it, err := tx.Seek(ctx, begin.FDBKey())
+	if err != nil {
+		return 0, err
+	}
+	var keys [][]byte
+	k, _, err := it.Next(ctx)
+	for ; err == nil && bytes.Compare(k, end.FDBKey()) < 0; k, _, err = it.Next(ctx) {
+		keys = append(keys, k)
+		if len(keys) == limit {
+			break
+		}
+	}
+	it.Close()
+	if err != nil && err != kv.ErrNotFound {
+		return 0, err
+	}
+	for _, k := range keys {
+		if err := tx.Delete(ctx, k); err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
+}
+
+// Seek initializes an iterator at the given key (inclusive). The iterator
+// stops at the end of the subspace.
 func (bst *SubSpacedDbTransaction) Seek(ctx context.Context, StartKey []byte) (kv.Iterator, error) {
 	it, err := bst.OrderedTransaction.Seek(ctx, bst.subspace.Pack(fdbtuple.Tuple{StartKey}))
-	return &SubSpacedDbIterator{it, bst.subspace}, err
+	_, end := bst.subspace.FDBRangeKeys()
+	return &SubSpacedDbIterator{it, bst.subspace, end.FDBKey()}, err
+}
+
+// Clear deletes every key of the subspace, including nested subspaces,
+// within the transaction
+func (bst *SubSpacedDbTransaction) Clear(ctx context.Context) error {
+	_, err := clearRange(ctx, bst.OrderedTransaction, bst.subspace, 0)
+	return err
 }
 
 // Get gets the value of a key within a single query transaction
@@ -94,17 +176,24 @@ func (bs *SubSpacedDbTransaction) Delete(ctx context.Context, key []byte) error
 	return err
 }
 
+// Next yields the next key-value of the subspace. Keys of nested subspaces are
+// skipped and kv.ErrNotFound is returned at the end of the subspace.
 func (it *SubSpacedDbIterator) Next(ctx context.Context) (key, value []byte, err error) {
-	k, v, e := it.Iterator.Next(ctx)
-
-	if e != nil {
-		return nil, nil, e
+	for {
+		k, v, e := it.Iterator.Next(ctx)
+		if e != nil {
+			return nil, nil, e
+		}
+		if bytes.Compare(k, it.end) >= 0 {
+			return nil, nil, kv.ErrNotFound
+		}
+
+		t, err := it.subspace.Unpack(fdbtuple.Key(k))
+		if err != nil {
+			return nil, nil, err
+		}
+		if key, ok := t[0].([]byte); ok && len(t) == 1 {
+			return key, v, nil
+		}
 	}
-
-	t, err := it.subspace.Unpack(fdbtuple.Key(k))
-	if err != nil {
-		return nil, nil, err
-	}
-
-	return t[0].([]byte), v, nil
 }
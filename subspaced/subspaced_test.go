@@ -3,7 +3,9 @@ package subspaced
 import (
 	"context"
 	"testing"
+	"time"
 
+	"github.com/zatte/fdbtuple"
 	"github.com/zatte/kv"
 
 	"github.com/stretchr/testify/assert"
@@ -18,6 +20,94 @@ func TestKvStores(t *testing.T) {
 	testStores(t, New(badger, "something", 123), "test_basic_subspace_conflict")
 }
 
+func TestSub(t *testing.T) {
+	ctx := context.Background()
+	badger, err := kv.New("badger:///?memory=true")
+	require.NoError(t, err)
+
+	parent := New(badger, "app")
+	users, orders := parent.Sub("users"), parent.Sub("orders")
+	require.NoError(t, users.Put(ctx, []byte("1"), []byte("ada")))
+	require.NoError(t, orders.Put(ctx, []byte("1"), []byte("order")))
+
+	v, err := users.Get(ctx, []byte("1"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("ada"), v)
+	v, err = parent.Sub("users").Get(ctx, []byte("1"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("ada"), v)
+	_, err = parent.Get(ctx, []byte("1"))
+	assert.Equal(t, kv.ErrNotFound, err)
+
+	tx, err := parent.NewTransaction(ctx, false)
+	require.NoError(t, err)
+	require.NoError(t, tx.(*SubSpacedDbTransaction).Sub("users").Put(ctx, []byte("2"), []byte("grace")))
+	require.NoError(t, tx.Commit(ctx))
+	v, err = users.Get(ctx, []byte("2"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("grace"), v)
+}
+
+func TestBoundedIterationAndClear(t *testing.T) {
+	ctx := context.Background()
+	badger, err := kv.New("badger:///?memory=true")
+	require.NoError(t, err)
+	// badger in history mode deletes in transactions instead of dropping the prefix
+	history, err := kv.New("badger:///?memory=true&history=10")
+	require.NoError(t, err)
+
+	for name, db := range map[string]kv.OrderedTransactional{"drop prefix": badger, "history": history} {
+		t.Run(name, func(t *testing.T) {
+			a, b := New(db, name, "a"), New(db, name, "b")
+			for _, k := range []string{"1", "2", "3"} {
+				require.NoError(t, a.Put(ctx, []byte(k), []byte("a"+k)))
+				require.NoError(t, b.Put(ctx, []byte(k), []byte("b"+k)))
+			}
+			require.NoError(t, a.Sub("nested").Put(ctx, []byte("4"), []byte("nested")))
+
+			keys := func(db *SubSpacedDb) (res []string) {
+				tx, err := db.NewTransaction(ctx, true)
+				require.NoError(t, err)
+				defer tx.Discard(ctx)
+				it, err := tx.Seek(ctx, nil)
+				require.NoError(t, err)
+				defer it.Close()
+				k, _, err := it.Next(ctx)
+				for ; err == nil; k, _, err = it.Next(ctx) {
+					res = append(res, string(k))
+				}
+				assert.Equal(t, kv.ErrNotFound, err)
+				return res
+			}
+			assert.Equal(t, []string{"1", "2", "3"}, keys(a))
+			assert.Equal(t, []string{"1", "2", "3"}, keys(b))
+
+			cleared := time.Now()
+			require.NoError(t, a.Clear(ctx))
+			assert.Empty(t, keys(a))
+			_, err := a.Sub("nested").Get(ctx, []byte("4"))
+			assert.Equal(t, kv.ErrNotFound, err)
+			assert.Equal(t, []string{"1", "2", "3"}, keys(b))
+			if db == history {
+				v, err := kv.GetAt(ctx, history, a.subspace.Pack(fdbtuple.Tuple{[]byte("1")}), cleared)
+				require.NoError(t, err, "clear must keep the revisions")
+				assert.Equal(t, []byte("a1"), v)
+			}
+
+			n, err := b.DeleteRange(ctx, []byte("2"), nil)
+			require.NoError(t, err)
+			assert.Equal(t, int64(2), n)
+			assert.Equal(t, []string{"1"}, keys(b))
+
+			tx, err := b.NewTransaction(ctx, false)
+			require.NoError(t, err)
+			require.NoError(t, tx.(*SubSpacedDbTransaction).Clear(ctx))
+			require.NoError(t, tx.Commit(ctx))
+			assert.Empty(t, keys(b))
+		})
+	}
+}
+
 func testStores(t *testing.T, db kv.OrderedTransactional, name string) {
 	ctx := context.Background()
 	t.Run(name+": create delete read", func(t *testing.T) {
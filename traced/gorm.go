@@ -0,0 +1,99 @@
+package traced
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const gormSpanKey = "kv:traced_span"
+
+// gormPlugin starts a client span for every SQL statement of a kv.GormDB run
+// with a context carrying a span, making the statements children of the kv
+// spans. Statements without a span in their context are not traced.
+type gormPlugin struct {
+	tracer trace.Tracer
+}
+
+// gormSpan is kept on the statement between the before and after callbacks
+type gormSpan struct {
+	span   trace.Span
+	parent context.Context
+}
+
+func (p gormPlugin) Name() string {
+	return "kv:traced"
+}
+
+func (p gormPlugin) Initialize(db *gorm.DB) error {
+	cb := db.Callback()
+	if err := cb.Create().Before("gorm:create").Register("kv:traced_before_create", p.before("gorm.Create")); err != nil {
+		return err
+	}
+	if err := cb.Create().After("gorm:create").Register("kv:traced_after_create", p.after); err != nil {
+		return err
+	}
+	if err := cb.Query().Before("gorm:query").Register("kv:traced_before_query", p.before("gorm.Query")); err != nil {
+		return err
+	}
+	if err := cb.Query().After("gorm:query").Register("kv:traced_after_query", p.after); err != nil {
+		return err
+	}
+	if err := cb.Update().Before("gorm:update").Register("kv:traced_before_update", p.before("gorm.Update")); err != nil {
+		return err
+	}
+	if err := cb.Update().After("gorm:update").Register("kv:traced_after_update", p.after); err != nil {
+		return err
+	}
+	if err := cb.Delete().Before("gorm:delete").Register("kv:traced_before_delete", p.before("gorm.Delete")); err != nil {
+		return err
+	}
+	if err := cb.Delete().After("gorm:delete").Register("kv:traced_after_delete", p.after); err != nil {
+		return err
+	}
+	if err := cb.Row().Before("gorm:row").Register("kv:traced_before_row", p.before("gorm.Row")); err != nil {
+		return err
+	}
+	if err := cb.Row().After("gorm:row").Register("kv:traced_after_row", p.after); err != nil {
+		return err
+	}
+	if err := cb.Raw().Before("gorm:raw").Register("kv:traced_before_raw", p.before("gorm.Raw")); err != nil {
+		return err
+	}
+	return cb.Raw().After("gorm:raw").Register("kv:traced_after_raw", p.after)
+}
+
+func (p gormPlugin) before(name string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		parent := db.Statement.Context
+		if parent == nil || !trace.SpanFromContext(parent).SpanContext().IsValid() {
+			return
+		}
+		ctx, span := p.tracer.Start(parent, name,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(AttrDbSystem.String(db.Dialector.Name())),
+		)
+		db.Statement.Context = ctx
+		db.InstanceSet(gormSpanKey, gormSpan{span, parent})
+	}
+}
+
+func (p gormPlugin) after(db *gorm.DB) {
+	v, ok := db.InstanceGet(gormSpanKey)
+	if !ok {
+		return
+	}
+	s := v.(gormSpan)
+	db.Statement.Context = s.parent
+	s.span.SetAttributes(
+		AttrDbStatement.String(db.Statement.SQL.String()),
+		AttrRows.Int64(db.RowsAffected),
+	)
+	if db.Error != nil && db.Error != gorm.ErrRecordNotFound {
+		s.span.RecordError(db.Error)
+		s.span.SetStatus(codes.Error, db.Error.Error())
+	}
+	s.span.End()
+}
@@ -0,0 +1,239 @@
+package traced
+
+import (
+	"context"
+
+	"github.com/zatte/kv"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/zatte/kv/traced"
+
+// Span attribute keys
+const (
+	AttrBackend   = attribute.Key("kv.backend")
+	AttrKeySize   = attribute.Key("kv.key_size")
+	AttrValueSize = attribute.Key("kv.value_size")
+	AttrResult    = attribute.Key("kv.result")
+	AttrRows      = attribute.Key("kv.rows")
+	AttrReadOnly  = attribute.Key("kv.read_only")
+
+	// SQL statement spans of gorm backends
+	AttrDbSystem    = attribute.Key("db.system")
+	AttrDbStatement = attribute.Key("db.statement")
+)
+
+type TracedDb struct {
+	kv.OrderedTransactional
+	tracer  trace.Tracer
+	backend string
+}
+
+// TracedDbTransaction has a span covering the whole transaction. All
+// operations on the transaction are children of it.
+type TracedDbTransaction struct {
+	kv.OrderedTransaction
+	tracer  trace.Tracer
+	backend string
+	span    trace.Span
+	done    bool
+}
+
+// TracedDbIterator has a single scan span from Seek until Close
+type TracedDbIterator struct {
+	kv.Iterator
+	span trace.Span
+	rows int
+	done bool
+}
+
+// New creates a DB that starts a span for every operation. A nil tp uses the
+// global tracer provider.
+//
+// For a *kv.GormDB, a gorm plugin is registered that adds a span for every SQL
+// statement as a child of the kv span. The plugin is registered once per gorm
+// DB with the tracer of the first call. Datastore client spans are not
+// parented: the client traces with OpenCensus, which needs the OpenCensus
+// bridge of OpenTelemetry installed by the application.
+func New(db kv.OrderedTransactional, backend string, tp trace.TracerProvider) *TracedDb {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	tracer := tp.Tracer(instrumentationName)
+	if gdb, ok := db.(*kv.GormDB); ok {
+		// Use fails with gorm.ErrRegistered for an already traced DB; the
+		// callbacks of gorm's default processors always register
+		_ = gdb.Use(gormPlugin{tracer})
+	}
+	return &TracedDb{db, tracer, backend}
+}
+
+func start(ctx context.Context, tracer trace.Tracer, backend, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return startWith(ctx, tracer, backend, name, nil, attrs...)
+}
+
+func startWith(ctx context.Context, tracer trace.Tracer, backend, name string, opts []trace.SpanOption, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, append(opts,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(append(attrs, AttrBackend.String(backend))...),
+	)...)
+}
+
+// end records the result of an operation and ends the span
+func end(span trace.Span, err error) {
+	switch err {
+	case nil:
+		span.SetAttributes(AttrResult.String("ok"))
+	case kv.ErrNotFound:
+		span.SetAttributes(AttrResult.String("not_found"))
+	default:
+		span.SetAttributes(AttrResult.String("error"))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Get gets the value of a key within a single query transaction
+func (tdb *TracedDb) Get(ctx context.Context, key []byte) (res []byte, err error) {
+	ctx, span := start(ctx, tdb.tracer, tdb.backend, "kv.Get", AttrKeySize.Int(len(key)))
+	defer func() { end(span, err) }()
+	res, err = tdb.OrderedTransactional.Get(ctx, key)
+	span.SetAttributes(AttrValueSize.Int(len(res)))
+	return res, err
+}
+
+// Put sets the value of a key within a single query transaction
+func (tdb *TracedDb) Put(ctx context.Context, key, value []byte) (err error) {
+	ctx, span := start(ctx, tdb.tracer, tdb.backend, "kv.Put", AttrKeySize.Int(len(key)), AttrValueSize.Int(len(value)))
+	defer func() { end(span, err) }()
+	return tdb.OrderedTransactional.Put(ctx, key, value)
+}
+
+// Delete removes a key within a single transaction
+func (tdb *TracedDb) Delete(ctx context.Context, key []byte) (err error) {
+	ctx, span := start(ctx, tdb.tracer, tdb.backend, "kv.Delete", AttrKeySize.Int(len(key)))
+	defer func() { end(span, err) }()
+	return tdb.OrderedTransactional.Delete(ctx, key)
+}
+
+// DeleteRange deletes all keys in [start, end) and records the number of
+// deleted keys as rows
+func (tdb *TracedDb) DeleteRange(ctx context.Context, startKey, endKey []byte) (n int64, err error) {
+	ctx, span := start(ctx, tdb.tracer, tdb.backend, "kv.DeleteRange", AttrKeySize.Int(len(startKey)))
+	defer func() {
+		span.SetAttributes(AttrRows.Int64(n))
+		end(span, err)
+	}()
+	return tdb.OrderedTransactional.DeleteRange(ctx, startKey, endKey)
+}
+
+// NewTransaction starts a transaction span that ends on Commit or Discard
+func (tdb *TracedDb) NewTransaction(ctx context.Context, readOnly bool) (kv.OrderedTransaction, error) {
+	ctx, span := start(ctx, tdb.tracer, tdb.backend, "kv.Transaction", AttrReadOnly.Bool(readOnly))
+	ot, err := tdb.OrderedTransactional.NewTransaction(ctx, readOnly)
+	if err != nil {
+		end(span, err)
+		return nil, err
+	}
+	return &TracedDbTransaction{ot, tdb.tracer, tdb.backend, span, false}, nil
+}
+
+// tracedDbTransaction
+
+// child starts a span for an operation in the transaction. Operations are
+// always parented to the transaction span; a different span carried by ctx,
+// e.g. of the caller, is linked instead.
+func (tx *TracedDbTransaction) child(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	var opts []trace.SpanOption
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() && sc.SpanID() != tx.span.SpanContext().SpanID() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: sc}))
+	}
+	return startWith(trace.ContextWithSpan(ctx, tx.span), tx.tracer, tx.backend, name, opts, attrs...)
+}
+
+// Seek starts a scan span that covers all calls to Next until the iterator is closed
+func (tx *TracedDbTransaction) Seek(ctx context.Context, StartKey []byte) (kv.Iterator, error) {
+	ctx, span := tx.child(ctx, "kv.Scan", AttrKeySize.Int(len(StartKey)))
+	it, err := tx.OrderedTransaction.Seek(ctx, StartKey)
+	if err != nil {
+		end(span, err)
+		return nil, err
+	}
+	return &TracedDbIterator{it, span, 0, false}, nil
+}
+
+// Get gets the value of a key within the transaction
+func (tx *TracedDbTransaction) Get(ctx context.Context, key []byte) (res []byte, err error) {
+	ctx, span := tx.child(ctx, "kv.Get", AttrKeySize.Int(len(key)))
+	defer func() { end(span, err) }()
+	res, err = tx.OrderedTransaction.Get(ctx, key)
+	span.SetAttributes(AttrValueSize.Int(len(res)))
+	return res, err
+}
+
+// Put sets the value of a key within the transaction
+func (tx *TracedDbTransaction) Put(ctx context.Context, key, value []byte) (err error) {
+	ctx, span := tx.child(ctx, "kv.Put", AttrKeySize.Int(len(key)), AttrValueSize.Int(len(value)))
+	defer func() { end(span, err) }()
+	return tx.OrderedTransaction.Put(ctx, key, value)
+}
+
+// Delete removes a key within the transaction
+func (tx *TracedDbTransaction) Delete(ctx context.Context, key []byte) (err error) {
+	ctx, span := tx.child(ctx, "kv.Delete", AttrKeySize.Int(len(key)))
+	defer func() { end(span, err) }()
+	return tx.OrderedTransaction.Delete(ctx, key)
+}
+
+// Discard removes all sides effects of the transaction and ends the
+// transaction span. Discarding a finished transaction is not traced.
+func (tx *TracedDbTransaction) Discard(ctx context.Context) (err error) {
+	if tx.done {
+		return tx.OrderedTransaction.Discard(ctx)
+	}
+	tx.done = true
+	defer func() { end(tx.span, err) }()
+	ctx, span := tx.child(ctx, "kv.Discard")
+	defer func() { end(span, err) }()
+	return tx.OrderedTransaction.Discard(ctx)
+}
+
+// Commit persists all side effects of the transaction and ends the transaction span
+func (tx *TracedDbTransaction) Commit(ctx context.Context) (err error) {
+	if tx.done {
+		return tx.OrderedTransaction.Commit(ctx)
+	}
+	tx.done = true
+	defer func() { end(tx.span, err) }()
+	ctx, span := tx.child(ctx, "kv.Commit")
+	defer func() { end(span, err) }()
+	return tx.OrderedTransaction.Commit(ctx)
+}
+
+// tracedDbIterator
+
+// Next yields the next key-value in iterator as part of the scan span
+func (it *TracedDbIterator) Next(ctx context.Context) (key, value []byte, err error) {
+	key, value, err = it.Iterator.Next(ctx)
+	if err == nil {
+		it.rows++
+	} else if err != kv.ErrNotFound {
+		it.span.RecordError(err)
+	}
+	return key, value, err
+}
+
+// Close ends the scan span
+func (it *TracedDbIterator) Close() error {
+	err := it.Iterator.Close()
+	if !it.done {
+		it.done = true
+		it.span.SetAttributes(AttrRows.Int(it.rows))
+		end(it.span, err)
+	}
+	return err
+}
@@ -0,0 +1,98 @@
+package traced
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zatte/kv"
+	"go.opentelemetry.io/otel/oteltest"
+)
+
+func TestTraced(t *testing.T) {
+	ctx := context.Background()
+	raw, err := kv.New("badger:///?memory=true")
+	require.NoError(t, err)
+
+	sr := new(oteltest.SpanRecorder)
+	tp := oteltest.NewTracerProvider(oteltest.WithSpanRecorder(sr))
+	db := New(raw, "badger", tp)
+	ctx, parent := tp.Tracer("test").Start(ctx, "request")
+
+	require.NoError(t, db.Put(ctx, []byte("A"), []byte("1")))
+	require.NoError(t, db.Put(ctx, []byte("B"), []byte("2")))
+	_, err = db.Get(ctx, []byte("C"))
+	require.EqualError(t, err, kv.ErrNotFound.Error())
+
+	tx, err := db.NewTransaction(ctx, true)
+	require.NoError(t, err)
+	it, err := tx.Seek(ctx, []byte("A"))
+	require.NoError(t, err)
+	for _, _, err := it.Next(ctx); err == nil; _, _, err = it.Next(ctx) {
+	}
+	require.NoError(t, it.Close())
+	require.NoError(t, tx.Commit(ctx))
+	require.NoError(t, tx.Discard(ctx))
+	parent.End()
+
+	spans := map[string]*oteltest.Span{}
+	var names []string
+	for _, s := range sr.Completed() {
+		spans[s.Name()] = s
+		names = append(names, s.Name())
+	}
+	assert.Equal(t, []string{"kv.Put", "kv.Put", "kv.Get", "kv.Scan", "kv.Commit", "kv.Transaction", "request"}, names)
+
+	get := spans["kv.Get"]
+	assert.Equal(t, "badger", get.Attributes()[AttrBackend].AsString())
+	assert.Equal(t, int64(1), get.Attributes()[AttrKeySize].AsInt64())
+	assert.Equal(t, "not_found", get.Attributes()[AttrResult].AsString())
+
+	txSpan := spans["kv.Transaction"]
+	scan := spans["kv.Scan"]
+	assert.Equal(t, int64(2), scan.Attributes()[AttrRows].AsInt64())
+	assert.Equal(t, txSpan.SpanContext().SpanID(), scan.ParentSpanID())
+	assert.Equal(t, txSpan.SpanContext().SpanID(), spans["kv.Commit"].ParentSpanID())
+	assert.Equal(t, parent.SpanContext().SpanID(), txSpan.ParentSpanID())
+	assert.Equal(t, parent.SpanContext().SpanID(), get.ParentSpanID())
+	require.Len(t, scan.Links(), 1, "the caller's span is linked")
+	assert.Equal(t, parent.SpanContext().SpanID(), scan.Links()[0].SpanID())
+}
+
+func TestTracedGorm(t *testing.T) {
+	ctx := context.Background()
+	raw, err := kv.New("sqlite3:///file%3Atraced%3Fmode%3Dmemory%26cache%3Dshared")
+	require.NoError(t, err)
+
+	sr := new(oteltest.SpanRecorder)
+	tp := oteltest.NewTracerProvider(oteltest.WithSpanRecorder(sr))
+	db := New(raw, "sqlite", tp)
+	New(raw, "sqlite", tp) // registering twice must not fail or trace twice
+
+	// statements without a span in their context are not traced
+	require.NoError(t, raw.Put(ctx, []byte("untraced"), []byte("1")))
+	assert.Empty(t, sr.Completed())
+
+	ctx, parent := tp.Tracer("test").Start(ctx, "request")
+	require.NoError(t, db.Put(ctx, []byte("A"), []byte("1")))
+	_, err = db.Get(ctx, []byte("missing"))
+	require.EqualError(t, err, kv.ErrNotFound.Error())
+	parent.End()
+
+	spans := map[string]*oteltest.Span{}
+	var names []string
+	for _, s := range sr.Completed() {
+		spans[s.Name()] = s
+		names = append(names, s.Name())
+	}
+	assert.Equal(t, []string{"gorm.Create", "kv.Put", "gorm.Query", "kv.Get", "request"}, names)
+
+	create := spans["gorm.Create"]
+	assert.Equal(t, spans["kv.Put"].SpanContext().SpanID(), create.ParentSpanID())
+	assert.Equal(t, "sqlite", create.Attributes()[AttrDbSystem].AsString())
+	assert.Contains(t, create.Attributes()[AttrDbStatement].AsString(), "INSERT INTO")
+	query := spans["gorm.Query"]
+	assert.Equal(t, spans["kv.Get"].SpanContext().SpanID(), query.ParentSpanID())
+	assert.Empty(t, query.Events(), "a missing row is not an error")
+}
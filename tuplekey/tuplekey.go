@@ -0,0 +1,225 @@
+// Package tuplekey addresses values by fdbtuple.Tuple keys. Tuples are packed
+// with the order preserving FoundationDB tuple encoding, so composite keys of
+// ints, strings, []byte, UUIDs and versionstamps sort component by component
+// on every backend.
+//
+//	db := tuplekey.New(raw)
+//	err := db.Put(ctx, fdbtuple.Tuple{"user", 42, "profile"}, value)
+//	it, err := db.Range(ctx, fdbtuple.Tuple{"user", 42})
+//	defer it.Close()
+//	for key, value, err := it.Next(ctx); err == nil; key, value, err = it.Next(ctx) {
+//		// key is fdbtuple.Tuple{"user", int64(42), ...}
+//	}
+package tuplekey
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/zatte/fdbtuple"
+	"github.com/zatte/kv"
+)
+
+// ErrInvalidTuple is returned for tuples which can not be packed, e.g. with
+// elements of unsupported types or incomplete versionstamps
+const ErrInvalidTuple kv.KvError = "tuplekey: invalid tuple"
+
+type TupleKeyDb struct {
+	kv.OrderedTransactional
+}
+
+type TupleKeyDbTransaction struct {
+	kv.OrderedTransaction
+}
+
+type TupleKeyDbIterator struct {
+	kv.Iterator
+	end []byte
+	// tx is discarded on Close when the iterator owns its transaction
+	tx kv.OrderedTransaction
+}
+
+// New creates a DB where keys are tuples packed with fdbtuple
+func New(db kv.OrderedTransactional) *TupleKeyDb {
+	return &TupleKeyDb{db}
+}
+
+// NewFromStr creates a tuple keyed DB. Supports all connections strings of kv.New()
+func NewFromStr(connectionString string) (*TupleKeyDb, error) {
+	db, err := kv.New(connectionString)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(db), nil
+}
+
+// Pack packs t into a key, returning ErrInvalidTuple instead of panicking
+// like fdbtuple.Tuple.Pack
+func Pack(t fdbtuple.Tuple) (key []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrInvalidTuple, r)
+		}
+	}()
+	return t.Pack(), nil
+}
+
+// Get gets the value of a key within a single query transaction
+func (tdb *TupleKeyDb) Get(ctx context.Context, key fdbtuple.Tuple) ([]byte, error) {
+	k, err := Pack(key)
+	if err != nil {
+		return nil, err
+	}
+	return tdb.OrderedTransactional.Get(ctx, k)
+}
+
+// Put sets the value of a key within a single query transaction
+func (tdb *TupleKeyDb) Put(ctx context.Context, key fdbtuple.Tuple, value []byte) error {
+	k, err := Pack(key)
+	if err != nil {
+		return err
+	}
+	return tdb.OrderedTransactional.Put(ctx, k, value)
+}
+
+// Delete removes a key within a single transaction
+func (tdb *TupleKeyDb) Delete(ctx context.Context, key fdbtuple.Tuple) error {
+	k, err := Pack(key)
+	if err != nil {
+		return err
+	}
+	return tdb.OrderedTransactional.Delete(ctx, k)
+}
+
+// DeleteRange deletes all keys from start (inclusive) to end (exclusive), or
+// to the end of the key space for a nil end
+func (tdb *TupleKeyDb) DeleteRange(ctx context.Context, start, end fdbtuple.Tuple) (int64, error) {
+	s, err := Pack(start)
+	if err != nil {
+		return 0, err
+	}
+	var e []byte
+	if end != nil {
+		if e, err = Pack(end); err != nil {
+			return 0, err
+		}
+	}
+	return tdb.OrderedTransactional.DeleteRange(ctx, s, e)
+}
+
+// Clear deletes all keys strictly prefixed by prefix, the keys Range yields
+func (tdb *TupleKeyDb) Clear(ctx context.Context, prefix fdbtuple.Tuple) (int64, error) {
+	if _, err := Pack(prefix); err != nil {
+		return 0, err
+	}
+	begin, end := prefix.FDBRangeKeys()
+	return tdb.OrderedTransactional.DeleteRange(ctx, begin.FDBKey(), end.FDBKey())
+}
+
+// NewTransaction for batching multiple values inside a transaction
+func (tdb *TupleKeyDb) NewTransaction(ctx context.Context, readOnly bool) (*TupleKeyDbTransaction, error) {
+	tx, err := tdb.OrderedTransactional.NewTransaction(ctx, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return &TupleKeyDbTransaction{tx}, nil
+}
+
+// Range iterates all keys strictly prefixed by prefix, within a read only
+// transaction which is discarded when the iterator is closed
+func (tdb *TupleKeyDb) Range(ctx context.Context, prefix fdbtuple.Tuple) (*TupleKeyDbIterator, error) {
+	tx, err := tdb.NewTransaction(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	it, err := tx.Range(ctx, prefix)
+	if err != nil {
+		tx.Discard(ctx)
+		return nil, err
+	}
+	it.tx = tx.OrderedTransaction
+	return it, nil
+}
+
+// Get gets the value of a key within the transaction
+func (tx *TupleKeyDbTransaction) Get(ctx context.Context, key fdbtuple.Tuple) ([]byte, error) {
+	k, err := Pack(key)
+	if err != nil {
+		return nil, err
+	}
+	return tx.OrderedTransaction.Get(ctx, k)
+}
+
+// Put sets the value of a key within the transaction
+func (tx *TupleKeyDbTransaction) Put(ctx context.Context, key fdbtuple.Tuple, value []byte) error {
+	k, err := Pack(key)
+	if err != nil {
+		return err
+	}
+	return tx.OrderedTransaction.Put(ctx, k, value)
+}
+
+// Delete removes a key within the transaction
+func (tx *TupleKeyDbTransaction) Delete(ctx context.Context, key fdbtuple.Tuple) error {
+	k, err := Pack(key)
+	if err != nil {
+		return err
+	}
+	return tx.OrderedTransaction.Delete(ctx, k)
+}
+
+// Seek initializes an iterator at the given key (inclusive) running to the
+// end of the key space. All keys passed must be packed tuples.
+func (tx *TupleKeyDbTransaction) Seek(ctx context.Context, StartKey fdbtuple.Tuple) (*TupleKeyDbIterator, error) {
+	k, err := Pack(StartKey)
+	if err != nil {
+		return nil, err
+	}
+	it, err := tx.OrderedTransaction.Seek(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+	return &TupleKeyDbIterator{Iterator: it}, nil
+}
+
+// Range iterates all keys strictly prefixed by prefix, i.e. tuples longer
+// than prefix starting with its elements. The prefix key itself is excluded.
+func (tx *TupleKeyDbTransaction) Range(ctx context.Context, prefix fdbtuple.Tuple) (*TupleKeyDbIterator, error) {
+	if _, err := Pack(prefix); err != nil {
+		return nil, err
+	}
+	begin, end := prefix.FDBRangeKeys()
+	it, err := tx.OrderedTransaction.Seek(ctx, begin.FDBKey())
+	if err != nil {
+		return nil, err
+	}
+	return &TupleKeyDbIterator{Iterator: it, end: end.FDBKey()}, nil
+}
+
+// Next yields the next key-value in iterator with the key unpacked. Returns
+// kv.ErrNotFound after the last key of the range.
+func (it *TupleKeyDbIterator) Next(ctx context.Context) (key fdbtuple.Tuple, value []byte, err error) {
+	k, v, err := it.Iterator.Next(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if it.end != nil && bytes.Compare(k, it.end) >= 0 {
+		return nil, nil, kv.ErrNotFound
+	}
+	t, err := fdbtuple.Unpack(k)
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, v, nil
+}
+
+// Close releases the iterator and the transaction it owns, if any
+func (it *TupleKeyDbIterator) Close() error {
+	err := it.Iterator.Close()
+	if it.tx != nil {
+		it.tx.Discard(context.Background())
+	}
+	return err
+}
@@ -0,0 +1,93 @@
+package tuplekey
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zatte/fdbtuple"
+	"github.com/zatte/kv"
+)
+
+func TestTupleKey(t *testing.T) {
+	ctx := context.Background()
+	db, err := NewFromStr("badger:///?memory=true")
+	require.NoError(t, err)
+
+	uuid := fdbtuple.UUID{1, 2, 3}
+	vs := fdbtuple.Versionstamp{TransactionVersion: [10]byte{0, 0, 0, 0, 0, 0, 0, 1}, UserVersion: 2}
+	keys := []fdbtuple.Tuple{
+		{"user", int64(-1), "profile"},
+		{"user", int64(2), "profile"},
+		{"user", int64(10), "profile"},
+		{"user", int64(10), "settings"},
+		{"user", int64(300), uuid},
+		{"user", int64(300), vs},
+		{"userx"},
+	}
+	// write in reverse to make sure order comes from the encoding
+	for i := len(keys) - 1; i >= 0; i-- {
+		require.NoError(t, db.Put(ctx, keys[i], []byte{byte(i)}))
+	}
+	require.NoError(t, db.Put(ctx, fdbtuple.Tuple{"user"}, []byte("prefix key")))
+
+	v, err := db.Get(ctx, fdbtuple.Tuple{"user", 10, "settings"})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{3}, v)
+
+	collect := func(it *TupleKeyDbIterator) (res []fdbtuple.Tuple) {
+		defer it.Close()
+		k, _, err := it.Next(ctx)
+		for ; err == nil; k, _, err = it.Next(ctx) {
+			res = append(res, k)
+		}
+		assert.Equal(t, kv.ErrNotFound, err)
+		return res
+	}
+
+	t.Run("range", func(t *testing.T) {
+		it, err := db.Range(ctx, fdbtuple.Tuple{"user"})
+		require.NoError(t, err)
+		assert.Equal(t, keys[:6], collect(it))
+
+		it, err = db.Range(ctx, fdbtuple.Tuple{"user", 10})
+		require.NoError(t, err)
+		assert.Equal(t, keys[2:4], collect(it))
+
+		it, err = db.Range(ctx, fdbtuple.Tuple{"nobody"})
+		require.NoError(t, err)
+		assert.Empty(t, collect(it))
+	})
+
+	t.Run("transaction", func(t *testing.T) {
+		tx, err := db.NewTransaction(ctx, false)
+		require.NoError(t, err)
+		defer tx.Discard(ctx)
+
+		require.NoError(t, tx.Delete(ctx, fdbtuple.Tuple{"user", 2, "profile"}))
+		it, err := tx.Seek(ctx, fdbtuple.Tuple{"user", 0})
+		require.NoError(t, err)
+		assert.Equal(t, keys[2:], collect(it))
+	})
+
+	t.Run("delete range and clear", func(t *testing.T) {
+		n, err := db.DeleteRange(ctx, fdbtuple.Tuple{"user", 10}, fdbtuple.Tuple{"user", 300})
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), n)
+		_, err = db.Clear(ctx, fdbtuple.Tuple{"user"})
+		require.NoError(t, err)
+
+		it, err := db.Range(ctx, fdbtuple.Tuple{})
+		require.NoError(t, err)
+		assert.Equal(t, []fdbtuple.Tuple{{"user"}, {"userx"}}, collect(it))
+	})
+
+	t.Run("invalid tuples", func(t *testing.T) {
+		err := db.Put(ctx, fdbtuple.Tuple{struct{}{}}, nil)
+		assert.True(t, errors.Is(err, ErrInvalidTuple))
+		_, err = db.Range(ctx, fdbtuple.Tuple{fdbtuple.IncompleteVersionstamp(0)})
+		assert.True(t, errors.Is(err, ErrInvalidTuple))
+	})
+}
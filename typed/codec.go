@@ -0,0 +1,100 @@
+package typed
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/zatte/kv"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrNotProtoMessage is returned by the Protobuf codec for values that are not a proto.Message
+const ErrNotProtoMessage kv.KvError = "typed: value is not a proto.Message"
+
+// Codec marshals Go values. The ID is stored as the header byte of every
+// value and must be unique and stable.
+type Codec interface {
+	ID() byte
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Header bytes of the built in codecs
+const (
+	JSONID     byte = 1
+	GobID      byte = 2
+	ProtobufID byte = 3
+	MsgpackID  byte = 4
+)
+
+var (
+	JSON     Codec = jsonCodec{}
+	Gob      Codec = gobCodec{}
+	Protobuf Codec = protobufCodec{}
+	Msgpack  Codec = msgpackCodec{}
+)
+
+// builtinCodecs can always be read, regardless of the codec used for writing
+var builtinCodecs = []Codec{JSON, Gob, Protobuf, Msgpack}
+
+type jsonCodec struct{}
+
+func (c jsonCodec) ID() byte { return JSONID }
+
+func (c jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (c gobCodec) ID() byte { return GobID }
+
+func (c gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type protobufCodec struct{}
+
+func (c protobufCodec) ID() byte { return ProtobufID }
+
+func (c protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, ErrNotProtoMessage
+	}
+	return proto.Marshal(m)
+}
+
+func (c protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return ErrNotProtoMessage
+	}
+	return proto.Unmarshal(data, m)
+}
+
+type msgpackCodec struct{}
+
+func (c msgpackCodec) ID() byte { return MsgpackID }
+
+func (c msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (c msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
@@ -0,0 +1,225 @@
+// Package typed stores Go values instead of raw bytes. Values are marshalled
+// with a pluggable Codec and tagged with a schema version so that old values
+// can be upgraded when the stored type evolves.
+//
+//	db := typed.New(raw, typed.JSON, typed.Options{Version: 2, Upgrade: upgradeUser})
+//	err := db.Put(ctx, []byte("user/1"), &User{Name: "Ada"})
+//	var u User
+//	err = db.Get(ctx, []byte("user/1"), &u)
+package typed
+
+import (
+	"context"
+	"encoding/binary"
+
+	"github.com/zatte/kv"
+)
+
+const (
+	// ErrUnknownCodec is returned when a value has a header byte without a matching codec
+	ErrUnknownCodec kv.KvError = "typed: unknown codec"
+	// ErrInvalidValue is returned when a value has no valid header
+	ErrInvalidValue kv.KvError = "typed: invalid value header"
+)
+
+// Upgrade converts a value stored with another schema version than
+// Options.Version into v. decode unmarshals the stored value, with the codec
+// it was written with, into any type; typically the old version of the type.
+type Upgrade func(version uint32, decode func(v interface{}) error, v interface{}) error
+
+// Options configures a typed DB
+type Options struct {
+	// Version is the schema version written with every value
+	Version uint32
+	// Upgrade is called for values stored with another version. If nil such
+	// values are decoded as is.
+	Upgrade Upgrade
+	// ReadCodecs are codecs, beside the built in ones, accepted when reading
+	ReadCodecs []Codec
+}
+
+type TypedDb struct {
+	db kv.OrderedTransactional
+	*encoder
+}
+
+type TypedDbTransaction struct {
+	tx kv.OrderedTransaction
+	*encoder
+}
+
+type TypedDbIterator struct {
+	it kv.Iterator
+	*encoder
+}
+
+type encoder struct {
+	codec   Codec
+	codecs  map[byte]Codec
+	version uint32
+	upgrade Upgrade
+}
+
+// New creates a DB storing values marshalled with codec. Every value is
+// prefixed with the codec header byte and the schema version, so values
+// written with any of the built in codecs (or extra codecs in
+// opts.ReadCodecs) read back correctly after the codec changes.
+func New(db kv.OrderedTransactional, codec Codec, opts Options) *TypedDb {
+	e := &encoder{
+		codec:   codec,
+		codecs:  map[byte]Codec{},
+		version: opts.Version,
+		upgrade: opts.Upgrade,
+	}
+	for _, rc := range builtinCodecs {
+		e.codecs[rc.ID()] = rc
+	}
+	for _, rc := range opts.ReadCodecs {
+		e.codecs[rc.ID()] = rc
+	}
+	e.codecs[codec.ID()] = codec
+	return &TypedDb{db, e}
+}
+
+// NewFromStr creates a typed DB. Supports all connections strings of kv.New()
+func NewFromStr(connectionString string, codec Codec, opts Options) (*TypedDb, error) {
+	db, err := kv.New(connectionString)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(db, codec, opts), nil
+}
+
+// Marshal encodes v with its header the way it is stored
+func (e *encoder) Marshal(v interface{}) ([]byte, error) {
+	data, err := e.codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 1+binary.MaxVarintLen32)
+	header[0] = e.codec.ID()
+	n := binary.PutUvarint(header[1:], uint64(e.version))
+	return append(header[:1+n], data...), nil
+}
+
+// Unmarshal decodes a stored value into v, upgrading it if it was written
+// with another schema version
+func (e *encoder) Unmarshal(value []byte, v interface{}) error {
+	if len(value) == 0 {
+		return ErrInvalidValue
+	}
+	codec, ok := e.codecs[value[0]]
+	if !ok {
+		return ErrUnknownCodec
+	}
+	version, n := binary.Uvarint(value[1:])
+	if n <= 0 || version > 1<<32-1 {
+		return ErrInvalidValue
+	}
+	data := value[1+n:]
+	decode := func(v interface{}) error {
+		return codec.Unmarshal(data, v)
+	}
+	if uint32(version) != e.version && e.upgrade != nil {
+		return e.upgrade(uint32(version), decode, v)
+	}
+	return decode(v)
+}
+
+// Get decodes the value of a key into v within a single query transaction
+func (tdb *TypedDb) Get(ctx context.Context, key []byte, v interface{}) error {
+	res, err := tdb.db.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	return tdb.Unmarshal(res, v)
+}
+
+// Put sets the value of a key within a single query transaction
+func (tdb *TypedDb) Put(ctx context.Context, key []byte, v interface{}) error {
+	value, err := tdb.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tdb.db.Put(ctx, key, value)
+}
+
+// Delete removes a key within a single query transaction
+func (tdb *TypedDb) Delete(ctx context.Context, key []byte) error {
+	return tdb.db.Delete(ctx, key)
+}
+
+// DeleteRange deletes all keys in [start, end), see kv.RangeDeleter
+func (tdb *TypedDb) DeleteRange(ctx context.Context, start, end []byte) (int64, error) {
+	return tdb.db.DeleteRange(ctx, start, end)
+}
+
+// NewTransaction for batching multiple values inside a transaction
+func (tdb *TypedDb) NewTransaction(ctx context.Context, readOnly bool) (*TypedDbTransaction, error) {
+	tx, err := tdb.db.NewTransaction(ctx, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return &TypedDbTransaction{tx, tdb.encoder}, nil
+}
+
+// Get decodes the value of a key into v within the transaction
+func (tx *TypedDbTransaction) Get(ctx context.Context, key []byte, v interface{}) error {
+	res, err := tx.tx.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	return tx.Unmarshal(res, v)
+}
+
+// Put sets the value of a key within the transaction
+func (tx *TypedDbTransaction) Put(ctx context.Context, key []byte, v interface{}) error {
+	value, err := tx.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tx.tx.Put(ctx, key, value)
+}
+
+// Delete removes a key within the transaction
+func (tx *TypedDbTransaction) Delete(ctx context.Context, key []byte) error {
+	return tx.tx.Delete(ctx, key)
+}
+
+// Seek initializes an iterator at the given key (inclusive)
+func (tx *TypedDbTransaction) Seek(ctx context.Context, StartKey []byte) (*TypedDbIterator, error) {
+	it, err := tx.tx.Seek(ctx, StartKey)
+	if err != nil {
+		return nil, err
+	}
+	return &TypedDbIterator{it, tx.encoder}, nil
+}
+
+// Commit commits the transaction
+func (tx *TypedDbTransaction) Commit(ctx context.Context) error {
+	return tx.tx.Commit(ctx)
+}
+
+// Discard discards the transaction
+func (tx *TypedDbTransaction) Discard(ctx context.Context) error {
+	return tx.tx.Discard(ctx)
+}
+
+// Next decodes the next value in the iterator into v and returns its key.
+// It returns kv.ErrNotFound when the iterator is exhausted.
+func (it *TypedDbIterator) Next(ctx context.Context, v interface{}) (key []byte, err error) {
+	k, value, err := it.it.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := it.Unmarshal(value, v); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Close releases the iterator
+func (it *TypedDbIterator) Close() error {
+	return it.it.Close()
+}
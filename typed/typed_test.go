@@ -0,0 +1,119 @@
+package typed
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zatte/kv"
+	"github.com/zatte/kv/kvpb"
+	"google.golang.org/protobuf/proto"
+)
+
+type userV1 struct {
+	Name string
+}
+
+type user struct {
+	First, Last string
+	Age         int
+}
+
+func TestTyped(t *testing.T) {
+	ctx := context.Background()
+	raw, err := kv.New("badger:///?memory=true")
+	require.NoError(t, err)
+
+	for _, codec := range []Codec{JSON, Gob, Msgpack} {
+		db := New(raw, codec, Options{})
+		key := []byte{'A', codec.ID()}
+		require.NoError(t, db.Put(ctx, key, &user{"Ada", "Lovelace", 36}))
+
+		stored, err := raw.Get(ctx, key)
+		require.NoError(t, err)
+		assert.Equal(t, codec.ID(), stored[0])
+
+		var u user
+		require.NoError(t, db.Get(ctx, key, &u))
+		assert.Equal(t, user{"Ada", "Lovelace", 36}, u)
+	}
+
+	t.Run("protobuf", func(t *testing.T) {
+		db := New(raw, Protobuf, Options{})
+		require.NoError(t, db.Put(ctx, []byte("P"), &kvpb.KeyValue{Key: []byte("k"), Value: []byte("v")}))
+
+		var m kvpb.KeyValue
+		require.NoError(t, db.Get(ctx, []byte("P"), &m))
+		assert.True(t, proto.Equal(&kvpb.KeyValue{Key: []byte("k"), Value: []byte("v")}, &m))
+		assert.EqualError(t, db.Put(ctx, []byte("P"), user{}), ErrNotProtoMessage.Error())
+	})
+
+	t.Run("iterator reads values of every codec", func(t *testing.T) {
+		db := New(raw, JSON, Options{})
+		tx, err := db.NewTransaction(ctx, true)
+		require.NoError(t, err)
+		defer tx.Discard(ctx)
+
+		it, err := tx.Seek(ctx, []byte("A"))
+		require.NoError(t, err)
+		defer it.Close()
+
+		values := 0
+		var u user
+		k, err := it.Next(ctx, &u)
+		for ; err == nil && k[0] == 'A'; k, err = it.Next(ctx, &u) {
+			assert.Equal(t, user{"Ada", "Lovelace", 36}, u)
+			u = user{}
+			values++
+		}
+		assert.Equal(t, 3, values)
+	})
+
+	t.Run("upgrade old versions", func(t *testing.T) {
+		require.NoError(t, New(raw, Gob, Options{Version: 1}).Put(ctx, []byte("U"), &userV1{"Grace Hopper"}))
+
+		db := New(raw, JSON, Options{
+			Version: 2,
+			Upgrade: func(version uint32, decode func(v interface{}) error, v interface{}) error {
+				assert.Equal(t, uint32(1), version)
+				var old userV1
+				if err := decode(&old); err != nil {
+					return err
+				}
+				*v.(*user) = user{First: old.Name}
+				return nil
+			},
+		})
+		var u user
+		require.NoError(t, db.Get(ctx, []byte("U"), &u))
+		assert.Equal(t, user{First: "Grace Hopper"}, u)
+
+		require.NoError(t, db.Put(ctx, []byte("U"), &u))
+		stored, err := raw.Get(ctx, []byte("U"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte{JSONID, 2}, stored[:2])
+	})
+
+	t.Run("transaction", func(t *testing.T) {
+		db := New(raw, Msgpack, Options{})
+		tx, err := db.NewTransaction(ctx, false)
+		require.NoError(t, err)
+		require.NoError(t, tx.Put(ctx, []byte("T"), &user{First: "Alan"}))
+		var u user
+		require.NoError(t, tx.Get(ctx, []byte("T"), &u))
+		assert.Equal(t, "Alan", u.First)
+		require.NoError(t, tx.Commit(ctx))
+
+		require.NoError(t, db.Delete(ctx, []byte("T")))
+		assert.Equal(t, kv.ErrNotFound, db.Get(ctx, []byte("T"), &u))
+	})
+
+	t.Run("invalid values", func(t *testing.T) {
+		db := New(raw, JSON, Options{})
+		require.NoError(t, raw.Put(ctx, []byte("X"), []byte{0xf0, 0, '1'}))
+		assert.EqualError(t, db.Get(ctx, []byte("X"), new(int)), ErrUnknownCodec.Error())
+		require.NoError(t, raw.Put(ctx, []byte("X"), []byte{JSONID}))
+		assert.EqualError(t, db.Get(ctx, []byte("X"), new(int)), ErrInvalidValue.Error())
+	})
+}
@@ -0,0 +1,119 @@
+package kv
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// ErrVersionMismatch is returned by PutIfVersion when the key is not at the
+// expected version
+const ErrVersionMismatch KvError = "version mismatch"
+
+// VersionNotExist is the version of missing keys. Passed to PutIfVersion it
+// requires the key to not exist.
+const VersionNotExist uint64 = 0
+
+// Versioner is implemented by stores keeping a version per key, which changes
+// on every write of the key. Versions of existing keys are never
+// VersionNotExist.
+type Versioner interface {
+	GetWithVersion(ctx context.Context, key []byte) (value []byte, version uint64, err error)
+	PutIfVersion(ctx context.Context, key, value []byte, expectedVersion uint64) error
+}
+
+// VersionedDeleter is implemented by Versioners that can also delete a key
+// conditionally on its version
+type VersionedDeleter interface {
+	DeleteIfVersion(ctx context.Context, key []byte, expectedVersion uint64) error
+}
+
+// GetWithVersion returns the value of a key and its version, for a later
+// PutIfVersion. Stores without native versions derive the version from a hash
+// of the value, so it only changes when the value does.
+func GetWithVersion(ctx context.Context, db OrderedTransactional, key []byte) ([]byte, uint64, error) {
+	if v, ok := db.(Versioner); ok {
+		return v.GetWithVersion(ctx, key)
+	}
+	value, err := db.Get(ctx, key)
+	if err != nil {
+		return nil, VersionNotExist, err
+	}
+	return value, valueVersion(value), nil
+}
+
+// PutIfVersion sets the value of a key if it still is at expectedVersion,
+// as returned by GetWithVersion, and returns ErrVersionMismatch otherwise.
+// VersionNotExist only creates missing keys. Stores without native versions
+// check the version in a transaction that is retried on conflicts.
+func PutIfVersion(ctx context.Context, db OrderedTransactional, key, value []byte, expectedVersion uint64) error {
+	if v, ok := db.(Versioner); ok {
+		return v.PutIfVersion(ctx, key, value, expectedVersion)
+	}
+	for attempt := 0; ; attempt++ {
+		err := putIfVersionTx(ctx, db, key, value, false, expectedVersion)
+		if err == ErrConflict && attempt < maxRetries {
+			continue
+		}
+		return err
+	}
+}
+
+// DeleteIfVersion removes a key if it still is at expectedVersion and returns
+// ErrVersionMismatch otherwise. VersionNotExist only succeeds for missing keys,
+// without writing anything.
+func DeleteIfVersion(ctx context.Context, db OrderedTransactional, key []byte, expectedVersion uint64) error {
+	if d, ok := db.(VersionedDeleter); ok {
+		return d.DeleteIfVersion(ctx, key, expectedVersion)
+	}
+	for attempt := 0; ; attempt++ {
+		err := putIfVersionTx(ctx, db, key, nil, true, expectedVersion)
+		if err == ErrConflict && attempt < maxRetries {
+			continue
+		}
+		return err
+	}
+}
+
+// putIfVersionTx checks the version and writes value, or deletes the key, in
+// a transaction
+func putIfVersionTx(ctx context.Context, db OrderedTransactional, key, value []byte, deleted bool, expectedVersion uint64) error {
+	tx, err := db.NewTransaction(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer tx.Discard(ctx)
+	version := VersionNotExist
+	cur, err := tx.Get(ctx, key)
+	switch {
+	case err == nil:
+		version = valueVersion(cur)
+	case err != ErrNotFound:
+		return err
+	}
+	if version != expectedVersion {
+		return ErrVersionMismatch
+	}
+	if deleted {
+		if version == VersionNotExist {
+			return nil
+		}
+		err = tx.Delete(ctx, key)
+	} else {
+		err = tx.Put(ctx, key, value)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// valueVersion is the version of a value in stores without native versions
+func valueVersion(value []byte) uint64 {
+	sum := sha256.Sum256(value)
+	v := binary.BigEndian.Uint64(sum[:8])
+	if v == VersionNotExist {
+		v = 1
+	}
+	return v
+}